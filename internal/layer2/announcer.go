@@ -3,299 +3,3286 @@
 package layer2
 
 import (
-	"io/ioutil"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"golang.org/x/time/rate"
 )
 
 // Announce is used to "announce" new IPs mapped to the node's MAC address.
 type Announce struct {
 	logger log.Logger
+	cfg    config
+	// lister and sys give access to the node's interfaces, they are only
+	// replaced in tests.
+	lister interfaceLister
+	sys    sysfs
+
+	// newARP and newNDP create the responders of an interface, and
+	// newSlaveARP the one of the active slave of a bond. They are only
+	// replaced in tests.
+	newARP      func(ifi *net.Interface) (responder, error)
+	newNDP      func(ifi *net.Interface) (watchingResponder, error)
+	newSlaveARP func(ifi *net.Interface) (responder, error)
 
 	sync.RWMutex
-	arps     map[int]*arpResponder
-	ndps     map[int]*ndpResponder
+	// The responders are keyed by interface name, along with the index
+	// of the interface they were created for in ifIndex: the kernel
+	// reuses the indices of deleted interfaces.
+	arps     map[string]responder
+	ndps     map[string]watchingResponder
+	ifIndex  map[string]int      // interface name -> index
 	ips      map[string][]net.IP // svcName -> IPs
-	ipRefcnt map[string]int      // ip.String() -> number of uses
+	ipRefcnt map[ipKey]int       // IP -> number of uses
+	// owned is the number of IPs used by at least one service, kept for
+	// the announced IPs gauge.
+	owned int
+	// svcIfaces restricts services to some interfaces, services without
+	// an entry may be announced on all interfaces.
+	svcIfaces map[string]map[string]bool // svcName -> allowed interface names
+	// floatingMACs holds the MAC addresses the services set with
+	// SetBalancerWithFloatingMAC must be announced at.
+	floatingMACs map[string]net.HardwareAddr // svcName -> MAC
+	// missed counts the consecutive scans the interfaces with responders
+	// were missing from, see WithInterfaceDebounce.
+	missed map[string]int // interface name -> scans
+	// missingSince holds when the interfaces in missed were first
+	// missing, see WithResponderGracePeriod.
+	missingSince map[string]time.Time // interface name -> first missing
+	// noLinkLocal holds the interfaces reported for lacking a link-local
+	// address, see WithEnsureLinkLocal.
+	noLinkLocal map[string]bool // interface name -> reported
+	// ifAddrs holds the addresses the responders of an interface were
+	// created with, the responders are recreated when they change.
+	ifAddrs map[string]string // interface name -> responderAddrs
+	// ifSubnets holds the subnets of the interfaces seen by the last
+	// scan, see WithOnlyMatchingSubnet.
+	ifSubnets map[string][]*net.IPNet // interface name -> subnets
+	// lastRoles holds the roles last read from the role file, which are
+	// kept while the file can't be read, see interfaceRoles.
+	lastRoles map[string]string // interface name -> role
+	// activeSlaves holds the active slaves of the bonds seen by the last
+	// scan, see WithBondActiveSlave.
+	activeSlaves map[string]string // slave name -> bond name
+	// cidrs holds the ranges set with SetBalancerCIDR.
+	cidrs map[string][]*net.IPNet // svcName -> CIDRs
+	// draining is set by Drain, the IPs are kept but not announced.
+	draining bool
+	// paused is set to 1 by Pause. It is accessed atomically, without
+	// the lock, so that it can be toggled cheaply.
+	paused int32
+	// routingReady holds the IPs routing is ready for, see
+	// WithRoutingReadiness.
+	routingReady map[ipKey]bool // IP -> ready
+	// handedOver holds the IPs given up with Handover.
+	handedOver map[ipKey]bool // IP -> handed over
+	// suppressed holds the IPs set aside with Suppress.
+	suppressed map[ipKey]net.IP
+	// zones holds the interfaces of the zoned IPs set with
+	// SetBalancerIPAddr, which are only used on them.
+	zones map[ipKey]string // IP -> interface name
+	// policies holds the IPs set with SetBalancerWithPolicy.
+	policies map[ipKey]SpamPolicy // IP -> policy
+	// leaseHeld is set by SetLeaderState, see WithLeaderElection.
+	leaseHeld bool
+	// ownershipChanges holds the ownership changes not yet passed to the
+	// handler set with WithOwnershipChangeHandler, see notifyOwnership.
+	ownershipChanges []ownershipChange
+	// notifying is set while a notifyOwnership call is passing the
+	// changes to the handler, the other calls leave the changes they
+	// queue to it.
+	notifying bool
+	// withdrawals holds the withdrawals queued by releaseIP, which are
+	// sent by sendWithdrawals without the lock held.
+	withdrawals []pendingWithdrawal
+	// lastAnnounced is updated by gratuitous, which only holds the read
+	// lock, so it has its own mutex.
+	lastMu        sync.Mutex
+	lastAnnounced map[ipKey]time.Time // IP -> last successful gratuitous
+	// recentDrops is updated by answerReason and dropped, which only
+	// hold the read lock, so it has its own mutex.
+	dropsMu     sync.Mutex
+	recentDrops map[ipKey][]DropEvent // IP -> last drops, oldest first
+	// lastScan is the end of the last interface scan.
+	lastScan time.Time
+	// probes holds the replies awaited by Probe. The responders report
+	// the replies from the goroutine reading them, hence the mutex.
+	probeMu sync.Mutex
+	probes  map[ipKey][]chan net.HardwareAddr
+
+	// limiter limits the rate of the gratuitous announcements, see
+	// WithGratuitousRateLimit. It is only nil in tests.
+	limiter *rate.Limiter
 
-	// This channel can block - do not write to it while holding the mutex
-	// to avoid deadlocking.
+	// spamCh feeds the IPs to announce to spamLoop. It is written to
+	// without blocking, see doSpam.
 	spamCh chan net.IP
+	// rescanCh asks interfaceScan to rescan interfaces right away.
+	rescanCh chan struct{}
+	// spamCtl passes commands to spamLoop, which owns the spam windows.
+	spamCtl chan spamCmd
+
+	// done is closed by Close to stop the background goroutines, which
+	// are tracked by loops.
+	done      chan struct{}
+	closeOnce sync.Once
+	loops     sync.WaitGroup
 }
 
 // New returns an initialized Announce.
-func New(l log.Logger) (*Announce, error) {
+func New(l log.Logger, opts ...Option) (*Announce, error) {
+	return NewWithContext(context.Background(), l, opts...)
+}
+
+// NewWithContext returns an initialized Announce, which is closed when
+// ctx is done.
+func NewWithContext(ctx context.Context, l log.Logger, opts ...Option) (*Announce, error) {
 	ret := &Announce{
-		logger:   l,
-		arps:     map[int]*arpResponder{},
-		ndps:     map[int]*ndpResponder{},
-		ips:      map[string][]net.IP{},
-		ipRefcnt: map[string]int{},
-		spamCh:   make(chan net.IP, 1024),
+		logger:        l,
+		lister:        netInterfaces{},
+		sys:           realSysfs{},
+		arps:          map[string]responder{},
+		ndps:          map[string]watchingResponder{},
+		ifIndex:       map[string]int{},
+		missed:        map[string]int{},
+		ips:           map[string][]net.IP{},
+		ipRefcnt:      map[ipKey]int{},
+		svcIfaces:     map[string]map[string]bool{},
+		cidrs:         map[string][]*net.IPNet{},
+		routingReady:  map[ipKey]bool{},
+		lastAnnounced: map[ipKey]time.Time{},
+		rescanCh:      make(chan struct{}, 1),
+		spamCtl:       make(chan spamCmd),
+		done:          make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(&ret.cfg)
+	}
+	if ret.cfg.err != nil {
+		return nil, ret.cfg.err
+	}
+	if ret.cfg.discovery != nil {
+		ret.lister = discoveredInterfaces{interfaceLister: ret.lister, discover: ret.cfg.discovery}
 	}
+	ret.spamCh = make(chan net.IP, ret.cfg.getSpamChannelSize())
+	ret.limiter = rate.NewLimiter(ret.cfg.rateLimit())
+	// The responders are created by updateResponders, with the lock held.
+	ret.newARP = func(ifi *net.Interface) (responder, error) {
+		return newARPResponder(ret.cfg.eventLogger(ret.logger), ifi, ret.answerReason, ret.conflict, ret.dropped, ret.cfg)
+	}
+	ret.newNDP = func(ifi *net.Interface) (watchingResponder, error) {
+		return newNDPResponder(ret.cfg.eventLogger(ret.logger), ifi, ret.answerReason, ret.conflict, ret.dropped, ret.cfg)
+	}
+	ret.newSlaveARP = func(ifi *net.Interface) (responder, error) {
+		return newSlaveARPResponder(ret.cfg.eventLogger(ret.logger), ifi, ret.cfg)
+	}
+	ret.loops.Add(2)
 	go ret.interfaceScan()
 	go ret.spamLoop()
+	if ret.cfg.keepaliveInterval > 0 {
+		ret.loops.Add(1)
+		go ret.keepaliveLoop(ret.cfg.keepaliveInterval)
+	}
+	go ret.closeOnDone(ctx)
 
 	return ret, nil
 }
 
+// closeOnDone closes the Announce when ctx is done.
+func (a *Announce) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		a.Close()
+	case <-a.done:
+	}
+}
+
+// Close stops the background goroutines and closes all the responders.
+// The Announce must not be used after Close. Calling Close more than once
+// is safe.
+func (a *Announce) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.loops.Wait()
+
+		a.Lock()
+		defer a.Unlock()
+		for name := range a.arps {
+			a.deleteARPResponder(name)
+		}
+		for name := range a.ndps {
+			a.deleteNDPResponder(name)
+		}
+		// Drop the IPs nobody is going to spam anymore.
+		for {
+			select {
+			case <-a.spamCh:
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// closed returns true once Close has been called.
+func (a *Announce) closed() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Configure applies opts to the running Announce. Options that can only
+// be set in New make it return an error, in which case none of opts is
+// applied. Interfaces are rescanned right away so that the new settings
+// take effect.
+func (a *Announce) Configure(opts ...Option) error {
+	a.Lock()
+	cfg := a.cfg
+	cfg.runtime = true
+	for _, o := range opts {
+		o(&cfg)
+	}
+	if cfg.err != nil {
+		a.Unlock()
+		return cfg.err
+	}
+	cfg.runtime = false
+	old := a.cfg
+	a.cfg = cfg
+	a.Unlock()
+
+	if a.limiter != nil && (cfg.gratuitousRate != old.gratuitousRate || cfg.gratuitousRateBurst != old.gratuitousRateBurst) {
+		limit, burst := cfg.rateLimit()
+		a.limiter.SetLimit(limit)
+		a.limiter.SetBurst(burst)
+	}
+
+	a.requestRescan()
+	return nil
+}
+
+// config returns a copy of the current settings.
+func (a *Announce) config() config {
+	a.RLock()
+	defer a.RUnlock()
+	return a.cfg
+}
+
 func (a *Announce) interfaceScan() {
+	defer a.loops.Done()
+	// Rescan as soon as links or addresses change when possible, polling
+	// remains as a safety net.
+	events, err := watchLinks(a.done)
+	if err != nil {
+		level.Warn(a.logger).Log("op", "watchLinks", "error", err, "msg", "couldn't subscribe to link changes, relying on polling only")
+	}
+	failures := 0
+	lastRewatch := time.Now()
 	for {
-		a.updateInterfaces()
-		time.Sleep(10 * time.Second)
+		err := a.updateInterfaces()
+		cfg := a.config()
+		if d := cfg.getNDPReWatchInterval(); d > 0 && time.Since(lastRewatch) >= d {
+			a.rewatchNDP()
+			lastRewatch = time.Now()
+		}
+		wait := cfg.getScanInterval()
+		if err != nil {
+			// Retry quickly after a transient failure, without spinning
+			// on a persistent one.
+			wait = scanRetryDelay(failures, wait)
+			failures++
+		} else {
+			failures = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-a.rescanCh:
+		case <-events:
+			level.Debug(cfg.eventLogger(a.logger)).Log("event", "linkChanged", "msg", "rescanning interfaces after a link or address change")
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// scanRetryDelay returns the delay before the next scan after failures+1
+// consecutive failed ones: minScanRetry, doubled for each earlier failure
+// and capped at interval.
+func scanRetryDelay(failures int, interval time.Duration) time.Duration {
+	d := minScanRetry
+	for i := 0; i < failures && d < interval; i++ {
+		d *= 2
+	}
+	if d > interval {
+		return interval
+	}
+	return d
+}
+
+// requestRescan asks interfaceScan to rescan interfaces without waiting
+// for the end of the current interval.
+func (a *Announce) requestRescan() {
+	select {
+	case a.rescanCh <- struct{}{}:
+	default:
+		// A rescan is already pending.
 	}
 }
 
-func (a *Announce) updateInterfaces() {
-	ifs, err := net.Interfaces()
+// RescanNow scans the interfaces right away and returns once their
+// responders are up to date, rather than waiting for the next periodic
+// scan. It is safe to call concurrently with the background scans.
+func (a *Announce) RescanNow() {
+	a.updateInterfaces()
+}
+
+// updateInterfaces updates the responders to match the interfaces. It
+// returns an error, already logged, if the interfaces couldn't be listed.
+func (a *Announce) updateInterfaces() error {
+	ifs, err := a.lister.Interfaces()
 	if err != nil {
 		level.Error(a.logger).Log("op", "getInterfaces", "error", err, "msg", "couldn't list interfaces")
-		return
+		return err
 	}
+	cfg := a.config()
+	roles := a.interfaceRoles(cfg)
+	skipped := skippedVirtualLinks(cfg, a.sys, ifs)
+	slaves := activeSlaves(cfg, a.sys, ifs)
+
+	// During the first scan, the responders are created one interface
+	// at a time when staggered.
+	stagger := cfg.startupStagger > 0 && a.lastScanTime().IsZero()
+	for {
+		respam, pending := a.updateResponders(ifs, cfg, roles, skipped, slaves, stagger)
+		// Announce the IPs again on the new responders so that the
+		// network relearns them quickly, without holding the lock.
+		for _, ip := range respam {
+			a.doSpam(ip)
+		}
+		if !pending {
+			return nil
+		}
+		select {
+		case <-time.After(cfg.startupStagger):
+		case <-a.done:
+			return nil
+		}
+	}
+}
 
+// lastScanTime returns the end of the last interface scan, which is zero
+// before the first one.
+func (a *Announce) lastScanTime() time.Time {
+	a.RLock()
+	defer a.RUnlock()
+	return a.lastScan
+}
+
+// updateResponders creates and deletes responders to match ifs, skipping
+// the interfaces in skipped and giving an ARP responder to the active
+// slaves in slaves. It returns the announced IPs of the families
+// for which new responders were created. When stagger is set, only the
+// responders of the first interface lacking some are created, and pending
+// tells whether other interfaces still lack responders.
+func (a *Announce) updateResponders(ifs []net.Interface, cfg config, roles map[string]string, skipped map[string]bool, slaves map[string]string, stagger bool) (respam []net.IP, pending bool) {
 	a.Lock()
 	defer a.Unlock()
+	if a.closed() {
+		return nil, false
+	}
+	a.activeSlaves = slaves
+
+	newARP, newNDP := false, false
+	defer func() {
+		respam = a.ownedIPs(newARP, newNDP)
+		a.lastScan = time.Now()
+	}()
 
-	keepARP, keepNDP := map[int]bool{}, map[int]bool{}
+	keepARP, keepNDP := map[string]bool{}, map[string]bool{}
 	for _, intf := range ifs {
 		ifi := intf
 		l := log.With(a.logger, "interface", ifi.Name)
-		addrs, err := ifi.Addrs()
+		if roles != nil && roles[ifi.Name] != interfaceRoleFrontend {
+			continue
+		}
+		if !cfg.interfaceAllowed(ifi.Name) {
+			continue
+		}
+		addrs, err := a.lister.Addrs(&ifi)
 		if err != nil {
 			level.Error(l).Log("op", "getAddresses", "error", err, "msg", "couldn't get addresses for interface")
-			return
+			// Leave the responders of the interface as they are until
+			// its addresses can be read again.
+			keepARP[ifi.Name], keepNDP[ifi.Name] = a.arps[ifi.Name] != nil, a.ndps[ifi.Name] != nil
+			continue
 		}
 
-		if ifi.Flags&net.FlagUp == 0 {
-			continue
+		keepARP[ifi.Name], keepNDP[ifi.Name] = wantResponders(cfg, a.sys, &ifi, addrs)
+		if skipped[ifi.Name] {
+			keepARP[ifi.Name], keepNDP[ifi.Name] = false, false
 		}
-		if _, err = os.Stat("/sys/class/net/" + ifi.Name + "/master"); !os.IsNotExist(err) {
-			continue
+		if _, ok := slaves[ifi.Name]; ok {
+			// The active slave of a bond only sends the announcements
+			// of the bond, over ARP since it has no link-local address.
+			keepARP[ifi.Name], keepNDP[ifi.Name] = true, false
 		}
-		f, err := ioutil.ReadFile("/sys/class/net/" + ifi.Name + "/flags")
-		if err == nil {
-			flags, _ := strconv.ParseUint(string(f)[:len(string(f))-1], 0, 32)
-			// NOARP flag
-			if flags&0x80 != 0 {
-				continue
-			}
+		if cfg.ensureLinkLocal {
+			a.reportLinkLocal(l, &ifi, eligible(cfg, a.sys, &ifi) && lacksLinkLocal(addrs))
 		}
 
-		for _, a := range addrs {
-			ipaddr, ok := a.(*net.IPNet)
-			if !ok {
-				continue
+		if idx, ok := a.ifIndex[ifi.Name]; ok && idx != ifi.Index {
+			// The interface was recreated, the responders are bound to
+			// the old one.
+			level.Info(l).Log("event", "interfaceRecreated", "oldIndex", idx, "index", ifi.Index, "msg", "interface index changed, recreating responders")
+			if a.arps[ifi.Name] != nil {
+				a.deleteARPResponder(ifi.Name)
+			}
+			if a.ndps[ifi.Name] != nil {
+				a.deleteNDPResponder(ifi.Name)
 			}
-			if ipaddr.IP.To4() != nil && (ifi.Flags&net.FlagBroadcast) != 0 {
-				keepARP[ifi.Index] = true
+		}
+		if a.ifSubnets == nil {
+			a.ifSubnets = map[string][]*net.IPNet{}
+		}
+		a.ifSubnets[ifi.Name] = interfaceSubnets(addrs)
+		addrKey := responderAddrs(addrs)
+		if old, ok := a.ifAddrs[ifi.Name]; ok && old != addrKey {
+			// The ARP responder reads the IPv4 addresses of the interface
+			// and the NDP one binds to its link-local address when they
+			// are created.
+			level.Info(l).Log("event", "interfaceAddressesChanged", "old", old, "new", addrKey, "msg", "interface addresses changed, recreating responders")
+			if a.arps[ifi.Name] != nil {
+				a.deleteARPResponder(ifi.Name)
 			}
-			if ipaddr.IP.IsLinkLocalUnicast() {
-				keepNDP[ifi.Index] = true
+			if a.ndps[ifi.Name] != nil {
+				a.deleteNDPResponder(ifi.Name)
 			}
 		}
 
-		if keepARP[ifi.Index] && a.arps[ifi.Index] == nil {
-			resp, err := newARPResponder(a.logger, &ifi, a.shouldAnnounce)
-			if err != nil {
-				level.Error(l).Log("op", "createARPResponder", "error", err, "msg", "failed to create ARP responder")
-				return
+		if a.macChanged(&ifi) {
+			// The responders announce the MAC address the interface had
+			// when they were created, the new ones announce the owned IPs
+			// again at the new address.
+			level.Info(l).Log("event", "interfaceMACChanged", "mac", ifi.HardwareAddr, "msg", "interface MAC address changed, recreating responders")
+			if a.arps[ifi.Name] != nil {
+				a.deleteARPResponder(ifi.Name)
 			}
-			a.arps[ifi.Index] = resp
-			level.Info(l).Log("event", "createARPResponder", "msg", "created ARP responder for interface")
-		}
-		if keepNDP[ifi.Index] && a.ndps[ifi.Index] == nil {
-			resp, err := newNDPResponder(a.logger, &ifi, a.shouldAnnounce)
-			if err != nil {
-				level.Error(l).Log("op", "createNDPResponder", "error", err, "msg", "failed to create NDP responder")
-				return
+			if a.ndps[ifi.Name] != nil {
+				a.deleteNDPResponder(ifi.Name)
 			}
-			a.ndps[ifi.Index] = resp
-			level.Info(l).Log("event", "createNDPResponder", "msg", "created NDP responder for interface")
+		}
+
+		if stagger && (newARP || newNDP) && (keepARP[ifi.Name] && a.arps[ifi.Name] == nil || keepNDP[ifi.Name] && a.ndps[ifi.Name] == nil) {
+			// Leave the interface to the next round.
+			pending = true
+			continue
+		}
+		if keepARP[ifi.Name] && a.arps[ifi.Name] != nil && !a.arps[ifi.Name].Healthy() {
+			// Retry responders that failed their transmit probe.
+			a.deleteARPResponder(ifi.Name)
+		}
+		if keepARP[ifi.Name] && a.arps[ifi.Name] == nil && a.createARPResponder(l, &ifi, addrKey) {
+			newARP = true
+		}
+		if keepNDP[ifi.Name] && a.ndps[ifi.Name] != nil && !a.ndps[ifi.Name].Healthy() {
+			a.deleteNDPResponder(ifi.Name)
+		}
+		if keepNDP[ifi.Name] && a.ndps[ifi.Name] == nil && a.createNDPResponder(l, &ifi, addrKey) {
+			newNDP = true
 		}
 	}
 
-	for i, client := range a.arps {
-		if !keepARP[i] {
-			client.Close()
-			delete(a.arps, i)
-			level.Info(a.logger).Log("interface", client.Interface(), "event", "deleteARPResponder", "msg", "deleted ARP responder for interface")
+	for name := range a.noLinkLocal {
+		if _, ok := keepARP[name]; !ok {
+			// The interface is gone, report it again if it comes back.
+			delete(a.noLinkLocal, name)
 		}
 	}
-	for i, client := range a.ndps {
-		if !keepNDP[i] {
-			client.Close()
-			delete(a.ndps, i)
-			level.Info(a.logger).Log("interface", client.Interface(), "event", "deleteNDPResponder", "msg", "deleted NDP responder for interface")
+	for name := range a.ifSubnets {
+		if _, ok := keepARP[name]; !ok {
+			delete(a.ifSubnets, name)
 		}
 	}
+	a.removeMissing(keepARP, keepNDP, cfg.getInterfaceDebounce(), cfg.responderGrace)
+	stats.Responders("arp", len(a.arps))
+	stats.Responders("ndp", len(a.ndps))
+	return
 }
 
-func (a *Announce) spamLoop() {
-	// Map IP to spam stop time.
-	m := map[string]time.Time{}
-	// We can't create a stopped ticker, so create one with a big period to avoid ticking for nothing
-	ticker := time.NewTicker(time.Hour)
-	ticker.Stop()
-	for {
-		select {
-		case ip := <-a.spamCh:
-			if len(m) == 0 {
-				// See https://github.com/metallb/metallb/issues/172 for the 1100 choice.
-				ticker.Reset(1100 * time.Millisecond)
-			}
-			ipStr := ip.String()
-			_, ok := m[ipStr]
-			// Set spam stop time to 5 seconds from now.
-			m[ipStr] = time.Now().Add(5 * time.Second)
-			if !ok {
-				// Spam right away to avoid waiting up to 1100 milliseconds even if
-				// it means we call gratuitous() twice in a row in a short amount of time.
-				a.gratuitous(ip)
-			}
-		case now := <-ticker.C:
-			for ipStr, until := range m {
-				if now.After(until) {
-					// We have spammed enough - remove the IP from the map.
-					delete(m, ipStr)
-				} else {
-					a.gratuitous(net.ParseIP(ipStr))
-				}
-			}
-			if len(m) == 0 {
-				ticker.Stop()
-			}
-		}
+// macChanged returns whether a responder of ifi was created for another
+// MAC address. It must be called with the lock held.
+func (a *Announce) macChanged(ifi *net.Interface) bool {
+	if r := a.arps[ifi.Name]; r != nil && !bytes.Equal(r.HardwareAddr(), ifi.HardwareAddr) {
+		return true
 	}
+	if r := a.ndps[ifi.Name]; r != nil && !bytes.Equal(r.HardwareAddr(), ifi.HardwareAddr) {
+		return true
+	}
+	return false
 }
 
-func (a *Announce) doSpam(ip net.IP) {
-	a.spamCh <- ip
+// createARPResponder creates the ARP responder of ifi, whose addresses
+// are addrKey, and returns whether it succeeded. A failure is logged and
+// retried on the next scan. It must be called with the lock held.
+func (a *Announce) createARPResponder(l log.Logger, ifi *net.Interface, addrKey string) bool {
+	newARP := a.newARP
+	if _, ok := a.activeSlaves[ifi.Name]; ok {
+		newARP = a.newSlaveARP
+	}
+	resp, err := newARP(ifi)
+	if err != nil {
+		level.Error(l).Log("op", "createARPResponder", "error", err, "msg", "failed to create ARP responder")
+		return false
+	}
+	a.arps[ifi.Name] = resp
+	a.ifIndex[ifi.Name] = ifi.Index
+	a.rememberAddrs(ifi.Name, addrKey)
+	level.Info(l).Log("event", "createARPResponder", "mac", resp.HardwareAddr(), "msg", "created ARP responder for interface")
+	a.emit(InterfaceEvent{Name: ifi.Name, Index: ifi.Index, Protocol: "arp", Type: InterfaceAdded})
+	err = resp.Probe()
+	if err != nil {
+		level.Error(l).Log("op", "probeARPResponder", "error", err, "msg", "ARP responder can't transmit, will retry on next scan")
+	}
+	stats.ResponderHealth("arp", ifi.Name, resp.HardwareAddr().String(), err == nil)
+	return true
 }
 
-func (a *Announce) gratuitous(ip net.IP) {
-	a.RLock()
-	defer a.RUnlock()
+// createNDPResponder creates the NDP responder of ifi, whose addresses
+// are addrKey, and returns whether it succeeded. A failure is logged and
+// retried on the next scan. It must be called with the lock held.
+func (a *Announce) createNDPResponder(l log.Logger, ifi *net.Interface, addrKey string) bool {
+	resp, err := a.newNDP(ifi)
+	if err != nil {
+		level.Error(l).Log("op", "createNDPResponder", "error", err, "msg", "failed to create NDP responder")
+		return false
+	}
+	a.ndps[ifi.Name] = resp
+	a.ifIndex[ifi.Name] = ifi.Index
+	a.rememberAddrs(ifi.Name, addrKey)
+	level.Info(l).Log("event", "createNDPResponder", "mac", resp.HardwareAddr(), "msg", "created NDP responder for interface")
+	a.emit(InterfaceEvent{Name: ifi.Name, Index: ifi.Index, Protocol: "ndp", Type: InterfaceAdded})
+	a.watchAnnounced(l, resp)
+	err = resp.Probe()
+	if err != nil {
+		level.Error(l).Log("op", "probeNDPResponder", "error", err, "msg", "NDP responder can't transmit, will retry on next scan")
+	}
+	stats.ResponderHealth("ndp", ifi.Name, resp.HardwareAddr().String(), err == nil)
+	return true
+}
 
-	if a.ipRefcnt[ip.String()] <= 0 {
-		// We've lost control of the IP, someone else is
-		// doing announcements.
+// reportLinkLocal logs an error the first time missing is set for ifi,
+// see WithEnsureLinkLocal. It must be called with the lock held.
+func (a *Announce) reportLinkLocal(l log.Logger, ifi *net.Interface, missing bool) {
+	if !missing {
+		delete(a.noLinkLocal, ifi.Name)
+		return
+	}
+	if a.noLinkLocal[ifi.Name] {
 		return
 	}
+	if a.noLinkLocal == nil {
+		a.noLinkLocal = map[string]bool{}
+	}
+	a.noLinkLocal[ifi.Name] = true
+	if ll := eui64LinkLocal(ifi.HardwareAddr); ll != nil {
+		level.Error(l).Log("op", "createNDPResponder", "linkLocal", ll, "msg", fmt.Sprintf("interface has IPv6 addresses but no link-local address, its IPv6 addresses can't be announced: add one, for instance with \"ip address add %s/64 dev %s\"", ll, ifi.Name))
+		return
+	}
+	level.Error(l).Log("op", "createNDPResponder", "msg", "interface has IPv6 addresses but no link-local address, its IPv6 addresses can't be announced: add a link-local address to the interface")
+}
 
-	if ip.To4() != nil {
-		for _, client := range a.arps {
-			if err := client.Gratuitous(ip); err != nil {
-				level.Error(a.logger).Log("op", "gratuitousAnnounce", "error", err, "ip", ip, "msg", "failed to make gratuitous ARP announcement")
-			}
+// removeMissing deletes the responders which are not to be kept, once
+// their interface has been missing from debounce consecutive scans and
+// for grace, so that a flapping interface doesn't churn its responders.
+// It must be called with the lock held.
+func (a *Announce) removeMissing(keepARP, keepNDP map[string]bool, debounce int, grace time.Duration) {
+	missing := map[string]bool{}
+	for name := range a.arps {
+		if !keepARP[name] {
+			missing[name] = true
 		}
-	} else {
-		for _, client := range a.ndps {
-			if err := client.Gratuitous(ip); err != nil {
-				level.Error(a.logger).Log("op", "gratuitousAnnounce", "error", err, "ip", ip, "msg", "failed to make gratuitous NDP announcement")
+	}
+	for name := range a.ndps {
+		if !keepNDP[name] {
+			missing[name] = true
+		}
+	}
+	for name, scans := range a.missed {
+		if !missing[name] {
+			level.Info(a.cfg.eventLogger(a.logger)).Log("event", "interfaceFlapping", "interface", name, "missedScans", scans, "msg", "interface came back before its responders were deleted")
+			delete(a.missed, name)
+			delete(a.missingSince, name)
+		}
+	}
+
+	now := time.Now()
+	for name := range missing {
+		if a.missed == nil {
+			a.missed = map[string]int{}
+		}
+		if a.missingSince == nil {
+			a.missingSince = map[string]time.Time{}
+		}
+		a.missed[name]++
+		if _, ok := a.missingSince[name]; !ok {
+			a.missingSince[name] = now
+			if grace > 0 {
+				// Don't wait for the next scan to delete the responders
+				// when the grace period is over.
+				time.AfterFunc(grace, a.requestRescan)
 			}
 		}
+		if a.missed[name] < debounce {
+			level.Debug(a.cfg.eventLogger(a.logger)).Log("event", "interfaceMissing", "interface", name, "missedScans", a.missed[name], "msg", "interface missing, keeping its responders until the next scans")
+			continue
+		}
+		if now.Sub(a.missingSince[name]) < grace {
+			level.Debug(a.cfg.eventLogger(a.logger)).Log("event", "interfaceMissing", "interface", name, "missingFor", now.Sub(a.missingSince[name]), "msg", "interface missing, keeping its responders for the grace period")
+			continue
+		}
+		delete(a.missed, name)
+		delete(a.missingSince, name)
+		if a.arps[name] != nil && !keepARP[name] {
+			a.deleteARPResponder(name)
+		}
+		if a.ndps[name] != nil && !keepNDP[name] {
+			a.deleteNDPResponder(name)
+		}
 	}
 }
 
-func (a *Announce) shouldAnnounce(ip net.IP) dropReason {
-	a.RLock()
-	defer a.RUnlock()
-	for _, ips := range a.ips {
-		for _, i := range ips {
-			if i.Equal(ip) {
-				return dropReasonNone
-			}
+// ownedIPs returns the announced IPv4 addresses if v4 is set and the
+// announced IPv6 addresses if v6 is set. It must be called with the lock
+// held.
+func (a *Announce) ownedIPs(v4, v6 bool) []net.IP {
+	var ret []net.IP
+	for k, cnt := range a.ipRefcnt {
+		if cnt <= 0 {
+			continue
+		}
+		ip := k.IP()
+		if (ip.To4() != nil && v4) || (ip.To4() == nil && v6) {
+			ret = append(ret, ip)
 		}
 	}
-	return dropReasonAnnounceIP
+	return ret
 }
 
-// SetBalancer adds ip to the set of announced addresses.
-func (a *Announce) SetBalancer(name string, ip net.IP) {
-	// Call doSpam at the end of the function without holding the lock
-	defer a.doSpam(ip)
+// watchAnnounced makes w watch all the IPv6 addresses currently
+// announced, so that a new NDP responder answers for them right away. It
+// must be called with the lock held.
+func (a *Announce) watchAnnounced(l log.Logger, w watchingResponder) {
+	if a.draining {
+		return
+	}
+	for _, ip := range a.ownedIPs(false, true) {
+		if !a.inZone(ip, w.Interface()) {
+			continue
+		}
+		if err := w.Watch(ip); err != nil {
+			level.Error(l).Log("op", "watchMulticastGroup", "error", err, "ip", ip, "msg", "failed to watch NDP multicast group for IP, NDP responder will not respond to requests for this address")
+		}
+	}
+}
+
+// rewatchNDP makes the NDP responders join the multicast groups of the
+// announced IPv6 addresses again, see WithNDPReWatchInterval.
+func (a *Announce) rewatchNDP() {
 	a.Lock()
 	defer a.Unlock()
-
-	// Kubernetes may inform us that we should advertise this address multiple
-	// times, so just no-op any subsequent requests.
-	if ips, ok := a.ips[name]; ok {
-		for i, ip := range ips {
-			if ip.Equal(a.ips[name][i]) {
+	if a.draining {
+		return
+	}
+	for _, ip := range a.ownedIPs(false, true) {
+		for _, client := range a.ndps {
+			if !a.inZone(ip, client.Interface()) {
 				continue
 			}
+			if err := client.Rewatch(ip); err != nil {
+				level.Error(a.logger).Log("op", "rewatchMulticastGroup", "interface", client.Interface(), "error", err, "ip", ip, "msg", "failed to rejoin NDP multicast group for IP")
+			}
 		}
 	}
+}
 
-	a.ips[name] = append(a.ips[name], ip)
+// deleteARPResponder closes and forgets the ARP responder of the
+// interface named name. It must be called with the lock held.
+func (a *Announce) deleteARPResponder(name string) {
+	client := a.arps[name]
+	client.Close()
+	delete(a.arps, name)
+	a.emit(InterfaceEvent{Name: name, Index: a.ifIndex[name], Protocol: "arp", Type: InterfaceRemoved})
+	a.forgetIndex(name)
+	stats.ResponderDeleted("arp", client.Interface(), client.HardwareAddr().String())
+	stats.DeleteDrops("arp", client.Interface())
+	level.Info(a.logger).Log("interface", client.Interface(), "mac", client.HardwareAddr(), "event", "deleteARPResponder", "msg", "deleted ARP responder for interface")
+}
 
-	a.ipRefcnt[ip.String()]++
-	if a.ipRefcnt[ip.String()] > 1 {
-		// Multiple services are using this IP, so there's nothing
-		// else to do right now.
-		return
+// deleteNDPResponder closes and forgets the NDP responder of the
+// interface named name. It must be called with the lock held.
+func (a *Announce) deleteNDPResponder(name string) {
+	client := a.ndps[name]
+	client.Close()
+	delete(a.ndps, name)
+	a.emit(InterfaceEvent{Name: name, Index: a.ifIndex[name], Protocol: "ndp", Type: InterfaceRemoved})
+	a.forgetIndex(name)
+	stats.ResponderDeleted("ndp", client.Interface(), client.HardwareAddr().String())
+	stats.DeleteDrops("ndp", client.Interface())
+	level.Info(a.logger).Log("interface", client.Interface(), "mac", client.HardwareAddr(), "event", "deleteNDPResponder", "msg", "deleted NDP responder for interface")
+}
+
+// forgetIndex forgets the index of the interface named name once it has
+// no responders left. It must be called with the lock held.
+func (a *Announce) forgetIndex(name string) {
+	if a.arps[name] == nil && a.ndps[name] == nil {
+		delete(a.ifIndex, name)
+		delete(a.ifAddrs, name)
 	}
+}
 
-	for _, client := range a.ndps {
-		if err := client.Watch(ip); err != nil {
-			level.Error(a.logger).Log("op", "watchMulticastGroup", "error", err, "ip", ip, "msg", "failed to watch NDP multicast group for IP, NDP responder will not respond to requests for this address")
-		}
+// rememberAddrs records the addresses the responders of the interface
+// named name were created with. It must be called with the lock held.
+func (a *Announce) rememberAddrs(name, addrs string) {
+	if a.ifAddrs == nil {
+		a.ifAddrs = map[string]string{}
 	}
+	a.ifAddrs[name] = addrs
 }
 
-// DeleteBalancer deletes an address from the set of addresses we should announce.
-func (a *Announce) DeleteBalancer(name string) {
+// interfaceRoles returns the roles assigned to interfaces by the role
+// file, or nil if announcements are not restricted by role. Only a
+// missing or empty file leaves the interfaces unrestricted: when the file
+// can't be read or parsed, the last roles read are kept, and no interface
+// has a role if there are none, so that a broken file never makes the
+// node announce on all its interfaces.
+func (a *Announce) interfaceRoles(cfg config) map[string]string {
+	if cfg.roleFile == "" {
+		return nil
+	}
+	roles, err := readInterfaceRoles(cfg.roleFile)
+	switch {
+	case os.IsNotExist(err):
+		level.Warn(a.logger).Log("op", "readInterfaceRoles", "file", cfg.roleFile, "msg", "interface role file is missing, not restricting interfaces")
+		roles = nil
+	case err != nil:
+		a.RLock()
+		roles = a.lastRoles
+		a.RUnlock()
+		level.Error(a.logger).Log("op", "readInterfaceRoles", "file", cfg.roleFile, "error", err, "kept", len(roles), "msg", "couldn't read interface role file, keeping the last roles read")
+		if roles == nil {
+			roles = map[string]string{}
+		}
+		return roles
+	case len(roles) == 0:
+		level.Warn(a.logger).Log("op", "readInterfaceRoles", "file", cfg.roleFile, "msg", "interface role file is empty, not restricting interfaces")
+		roles = nil
+	}
 	a.Lock()
-	defer a.Unlock()
+	a.lastRoles = roles
+	a.Unlock()
+	return roles
+}
 
-	ips, ok := a.ips[name]
+func (a *Announce) spamLoop() {
+	defer a.loops.Done()
+	sched := a.config().scheduler
+	if sched == nil {
+		ws := newWindowScheduler(a.spamTiming, a.spamPolicy)
+		ws.maxSize = func() int { return a.config().maxSpamWindow }
+		ws.completed = a.spamComplete
+		sched = ws
+	}
+
+	pending := &spamPending{}
+	send := func(ip net.IP) { a.spamSend(pending, ip) }
+
+	// The timer firing when the scheduler has announcements due, nil
+	// when nothing is scheduled.
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	arm := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timerC = nil, nil
+		due, ok := sched.Next()
+		if len(pending.deferred) > 0 {
+			if retry := time.Now().Add(a.limiterDelay()); !ok || retry.Before(due) {
+				due, ok = retry, true
+			}
+		}
+		if at, held := pending.nextHeld(); held && (!ok || at.Before(due)) {
+			due, ok = at, true
+		}
+		if ok {
+			timer = time.NewTimer(time.Until(due))
+			timerC = timer.C
+		}
+	}
+	for {
+		select {
+		case ip := <-a.spamCh:
+			if a.Draining() {
+				break
+			}
+			if sched.Schedule(ip, time.Now()) {
+				send(ip)
+			}
+		case now := <-timerC:
+			due := sched.Due(now)
+			if a.Draining() {
+				// Forget the spam windows, Undrain starts them anew.
+				if ws, ok := sched.(*windowScheduler); ok {
+					ws.clear()
+				}
+				pending.clear()
+				break
+			}
+			retry := pending.deferred
+			pending.deferred = nil
+			retry = append(retry, pending.release(now)...)
+			for _, ip := range append(retry, due...) {
+				send(ip)
+			}
+		case cmd := <-a.spamCtl:
+			cmd(sched, pending)
+		case <-a.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		arm()
+	}
+}
+
+// spamSend announces ip from spamLoop, unless the announcement must be
+// held back for the rate limit or the spacing, see pending.
+func (a *Announce) spamSend(pending *spamPending, ip net.IP) {
+	now := time.Now()
+	if at, ok := pending.spaced(ip, now, a.config().minGratuitousSpacing); !ok {
+		pending.hold(ip, at)
+		return
+	}
+	if !a.gratuitous(ip) {
+		pending.deferred = append(pending.deferred, ip)
+		return
+	}
+	pending.sent(ip, now)
+}
+
+// spamPending holds the announcements spamLoop holds back.
+type spamPending struct {
+	// deferred holds the announcements delayed by the rate limiter,
+	// which are retried before the ones due.
+	deferred []net.IP
+	// held holds the announcements coalesced by WithMinGratuitousSpacing,
+	// with when they may be sent.
+	held map[ipKey]heldIP
+	// last holds when the IPs were last announced, for the spacing. The
+	// IPs are forgotten once the spacing elapsed.
+	last map[ipKey]time.Time
+}
+
+type heldIP struct {
+	ip net.IP
+	at time.Time
+}
+
+// spaced returns whether ip may be announced at now given the spacing, or
+// when it may be announced otherwise.
+func (p *spamPending) spaced(ip net.IP, now time.Time, spacing time.Duration) (time.Time, bool) {
+	if spacing <= 0 {
+		return time.Time{}, true
+	}
+	for k, t := range p.last {
+		if now.Sub(t) >= spacing {
+			delete(p.last, k)
+		}
+	}
+	last, ok := p.last[keyOf(ip)]
 	if !ok {
+		return time.Time{}, true
+	}
+	return last.Add(spacing), false
+}
+
+// sent records that ip was announced at now.
+func (p *spamPending) sent(ip net.IP, now time.Time) {
+	if p.last == nil {
+		p.last = map[ipKey]time.Time{}
+	}
+	p.last[keyOf(ip)] = now
+}
+
+// hold delays the announcement of ip until at. The announcements held for
+// the same IP are coalesced.
+func (p *spamPending) hold(ip net.IP, at time.Time) {
+	if _, ok := p.held[keyOf(ip)]; ok {
 		return
 	}
-	delete(a.ips, name)
-	for _, ip := range ips {
-		a.ipRefcnt[ip.String()]--
-		if a.ipRefcnt[ip.String()] > 0 {
-			// Another service is still using this IP, don't touch any
-			// more things.
-			return
+	if p.held == nil {
+		p.held = map[ipKey]heldIP{}
+	}
+	p.held[keyOf(ip)] = heldIP{ip: ip, at: at}
+}
+
+// nextHeld returns when the next held announcement may be sent, or false
+// if none is held.
+func (p *spamPending) nextHeld() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, h := range p.held {
+		if !found || h.at.Before(next) {
+			next, found = h.at, true
 		}
+	}
+	return next, found
+}
 
-		for _, client := range a.ndps {
-			if err := client.Unwatch(ip); err != nil {
-				level.Error(a.logger).Log("op", "unwatchMulticastGroup", "error", err, "ip", ip, "msg", "failed to unwatch NDP multicast group for IP")
-			}
+// release returns the held announcements which may be sent at now, and
+// forgets them.
+func (p *spamPending) release(now time.Time) []net.IP {
+	var ret []net.IP
+	for k, h := range p.held {
+		if !now.Before(h.at) {
+			delete(p.held, k)
+			ret = append(ret, h.ip)
 		}
 	}
+	return ret
+}
 
+// ips returns the IPs of the pending announcements.
+func (p *spamPending) ips() []net.IP {
+	ret := append([]net.IP(nil), p.deferred...)
+	for _, h := range p.held {
+		ret = append(ret, h.ip)
+	}
+	return ret
 }
 
-// AnnounceName returns true when we have an announcement under name.
-func (a *Announce) AnnounceName(name string) bool {
-	a.RLock()
-	defer a.RUnlock()
-	_, ok := a.ips[name]
-	return ok
+// cancel forgets the pending announcements of ip, and returns whether
+// there were any.
+func (p *spamPending) cancel(ip net.IP) bool {
+	_, cancelled := p.held[keyOf(ip)]
+	delete(p.held, keyOf(ip))
+	kept := p.deferred[:0]
+	for _, d := range p.deferred {
+		if d.Equal(ip) {
+			cancelled = true
+			continue
+		}
+		kept = append(kept, d)
+	}
+	p.deferred = kept
+	return cancelled
 }
 
-// dropReason is the reason why a layer2 protocol packet was not
-// responded to.
-type dropReason int
+// clear forgets all the pending announcements.
+func (p *spamPending) clear() {
+	p.deferred = nil
+	p.held = nil
+}
 
-// Various reasons why a packet was dropped.
-const (
-	dropReasonNone dropReason = iota
-	dropReasonClosed
-	dropReasonError
-	dropReasonARPReply
-	dropReasonMessageType
-	dropReasonNoSourceLL
-	dropReasonEthernetDestination
-	dropReasonAnnounceIP
-)
+// spamCmd is run by spamLoop with its scheduler and its pending
+// announcements.
+type spamCmd func(sched Scheduler, pending *spamPending)
+
+// inSpamLoop runs cmd in spamLoop and waits for it. It returns false if
+// the announcer was closed before cmd could run.
+func (a *Announce) inSpamLoop(cmd spamCmd) bool {
+	ran := make(chan struct{})
+	select {
+	case a.spamCtl <- func(sched Scheduler, pending *spamPending) {
+		cmd(sched, pending)
+		close(ran)
+	}:
+	case <-a.done:
+		return false
+	}
+	<-ran
+	return true
+}
+
+// ActiveSpamWindows returns the sorted IPs whose gratuitous announcements
+// are still scheduled, including the ones delayed by
+// WithGratuitousRateLimit and WithMinGratuitousSpacing. The windows are
+// only known with the default scheduler.
+func (a *Announce) ActiveSpamWindows() []net.IP {
+	var ret []net.IP
+	a.inSpamLoop(func(sched Scheduler, pending *spamPending) {
+		seen := map[ipKey]bool{}
+		var ips []net.IP
+		if ws, ok := sched.(*windowScheduler); ok {
+			ips = ws.scheduled()
+		}
+		for _, ip := range append(ips, pending.ips()...) {
+			if !seen[keyOf(ip)] {
+				seen[keyOf(ip)] = true
+				ret = append(ret, copyIP(ip))
+			}
+		}
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].To16(), ret[j].To16()) < 0
+	})
+	return ret
+}
+
+// CancelSpam stops the gratuitous announcements still scheduled for ip
+// right away, without waiting for the end of its spam window, and returns
+// whether there were any. The IP stays announced and answered for, and is
+// announced again when it is set again or reannounced.
+func (a *Announce) CancelSpam(ip net.IP) bool {
+	ip = normalizeIP(ip)
+	cancelled := false
+	a.inSpamLoop(func(sched Scheduler, pending *spamPending) {
+		if ws, ok := sched.(*windowScheduler); ok {
+			cancelled = ws.cancel(ip)
+		}
+		if pending.cancel(ip) {
+			cancelled = true
+		}
+	})
+	return cancelled
+}
+
+// keepaliveLoop announces all the owned IPs again every interval, see
+// WithKeepaliveInterval.
+func (a *Announce) keepaliveLoop(interval time.Duration) {
+	defer a.loops.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.ReannounceAll()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// spamComplete is called by the default scheduler when it is done
+// announcing ip, and passes it on to the handler set with
+// WithSpamCompleteHandler.
+func (a *Announce) spamComplete(ip net.IP) {
+	if handler := a.config().spamCompleteHandler; handler != nil {
+		handler(copyIP(ip))
+	}
+}
+
+// spamTiming returns the configured spam window and interval. The
+// interval is jittered anew on each call, so that every tick gets its own
+// jitter.
+func (a *Announce) spamTiming() (time.Duration, time.Duration) {
+	cfg := a.config()
+	return cfg.getSpamDuration(), jitter(cfg.getSpamInterval(), cfg.spamJitter)
+}
+
+// spamPolicy returns the SpamPolicy of ip, if any.
+func (a *Announce) spamPolicy(ip net.IP) (SpamPolicy, bool) {
+	a.RLock()
+	defer a.RUnlock()
+	p, ok := a.policies[keyOf(ip)]
+	return p, ok
+}
+
+// doSpam hands ip over to spamLoop. It never blocks, so that a backed up
+// spamLoop cannot stall the callers: the IP is dropped when the channel is
+// full. It does nothing once the announcer is closed, as spamLoop is gone.
+func (a *Announce) doSpam(ip net.IP) {
+	select {
+	case <-a.done:
+		return
+	default:
+	}
+	select {
+	case a.spamCh <- ip:
+	default:
+		level.Warn(a.logger).Log("op", "doSpam", "ip", ip, "msg", "spam channel full, dropping gratuitous announcements for IP")
+		stats.SpamDropped()
+	}
+}
+
+// gratuitous announces ip on the responders it can be announced with. It
+// returns false if the announcement was delayed by the rate limiter and
+// must be retried.
+func (a *Announce) gratuitous(ip net.IP) bool {
+	proto, clients, timeout, burst := a.gratuitousClients(ip)
+	if len(clients) == 0 {
+		return true
+	}
+	if !a.allowGratuitous(len(clients) * burst) {
+		return false
+	}
+
+	if a.sendGratuitous(ip, proto, clients, timeout, burst) {
+		a.RLock()
+		// The IP may have been deleted meanwhile.
+		if a.ipRefcnt[keyOf(ip)] > 0 {
+			a.setLastAnnounced(ip, time.Now())
+		}
+		a.RUnlock()
+	}
+	return true
+}
+
+// allowGratuitous returns whether n announcements may be sent now given
+// the rate limit, see WithGratuitousRateLimit. More announcements than
+// the burst of the limit are allowed once the burst is available, the
+// ones over the burst are still charged and delay the next ones.
+func (a *Announce) allowGratuitous(n int) bool {
+	if a.limiter == nil {
+		return true
+	}
+	first := n
+	if burst := a.limiter.Burst(); first > burst {
+		first = burst
+	}
+	if !a.limiter.AllowN(time.Now(), first) {
+		return false
+	}
+	a.chargeGratuitous(n - first)
+	return true
+}
+
+// chargeGratuitous charges n announcements to the rate limit without
+// refusing any of them. Not waiting for the reservations leaves the
+// limiter in debt, which delays the next announcements.
+func (a *Announce) chargeGratuitous(n int) {
+	if a.limiter == nil {
+		return
+	}
+	now := time.Now()
+	burst := a.limiter.Burst()
+	for ; n > 0; n -= burst {
+		k := n
+		if k > burst {
+			k = burst
+		}
+		a.limiter.ReserveN(now, k)
+	}
+}
+
+// rateLimit returns the limit and the burst of the gratuitous
+// announcements, see WithGratuitousRateLimit.
+func (c *config) rateLimit() (rate.Limit, int) {
+	if c.gratuitousRate <= 0 {
+		return rate.Inf, 1
+	}
+	return rate.Limit(c.gratuitousRate), c.gratuitousRateBurst
+}
+
+// limiterDelay returns how long to wait before retrying the announcements
+// delayed by the rate limiter.
+func (a *Announce) limiterDelay() time.Duration {
+	if a.limiter == nil {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / float64(a.limiter.Limit()))
+}
+
+// sendGratuitous makes clients send burst gratuitous announcements of ip
+// each, waiting for them for timeout at most. It returns true if at least
+// one of them succeeded.
+func (a *Announce) sendGratuitous(ip net.IP, proto string, clients []responder, timeout time.Duration, burst int) bool {
+	// Send on all the interfaces at once without holding the lock, so
+	// that a hung socket can only delay this IP.
+	type result struct {
+		intf string
+		err  error
+	}
+	results := make(chan result, len(clients))
+	pending := map[string]bool{}
+	for _, client := range clients {
+		client := client
+		pending[client.Interface()] = true
+		go func() {
+			results <- result{client.Interface(), sendBurst(client, ip, burst)}
+		}()
+	}
+
+	events := a.config().lifecycleEvents
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	sent := false
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.intf)
+			if r.err != nil {
+				level.Error(a.logger).Log("op", "gratuitousAnnounce", "error", r.err, "interface", r.intf, "ip", ip, "msg", "failed to make gratuitous "+strings.ToUpper(proto)+" announcement")
+			}
+			stats.GratuitousResult(proto, r.intf, r.err)
+			if r.err == nil {
+				a.emitLifecycle(events, LifecycleEvent{Type: GratuitousSent, IP: ip, Interface: r.intf, Protocol: proto})
+			}
+			sent = sent || r.err == nil
+		case <-timer.C:
+			for intf := range pending {
+				level.Warn(a.logger).Log("op", "gratuitousAnnounce", "interface", intf, "ip", ip, "timeout", timeout, "msg", "gratuitous announcement timed out, not waiting for it")
+				stats.GratuitousResult(proto, intf, errGratuitousTimeout)
+			}
+			pending = nil
+		}
+	}
+	return sent
+}
+
+// sendBurst sends n gratuitous announcements of ip in a row with client,
+// stopping at the first error.
+func sendBurst(client responder, ip net.IP, n int) error {
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(gratuitousBurstDelay)
+		}
+		if err := client.Gratuitous(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errGratuitousTimeout is counted for gratuitous announcements which did
+// not complete in time.
+var errGratuitousTimeout = errors.New("gratuitous announcement timed out")
+
+// gratuitousClients returns the protocol and the responders to announce
+// ip with, along with how long to wait for them and how many packets
+// each of them sends. It returns no responders if ip must not be
+// announced.
+func (a *Announce) gratuitousClients(ip net.IP) (string, []responder, time.Duration, int) {
+	a.RLock()
+	defer a.RUnlock()
+
+	timeout, burst := a.cfg.getGratuitousTimeout(), a.cfg.getGratuitousBurst()
+	if p := a.policies[keyOf(ip)]; p.Burst > 0 {
+		burst = p.Burst
+	}
+	if a.ipRefcnt[keyOf(ip)] <= 0 {
+		// We've lost control of the IP, someone else is
+		// doing announcements.
+		level.Debug(a.cfg.eventLogger(a.logger)).Log("op", "gratuitousAnnounce", "ip", ip, "msg", "not announcing IP, it is no longer owned")
+		stats.LostOwnership()
+		return "", nil, timeout, burst
+	}
+	if a.cfg.waitRouting && !a.routingReady[keyOf(ip)] {
+		return "", nil, timeout, burst
+	}
+	if a.draining || a.Paused() || a.handedOver[keyOf(ip)] || a.suppressed[keyOf(ip)] != nil || !a.gateOpen(ip) || a.notLeader() {
+		return "", nil, timeout, burst
+	}
+	proto, clients := a.familyClients(ip)
+	return proto, clients, timeout, burst
+}
+
+// gateOpen returns whether the gate set with WithAnnounceGate lets this
+// node announce ip. It must be called with the lock held.
+func (a *Announce) gateOpen(ip net.IP) bool {
+	return a.cfg.announceGate == nil || a.cfg.announceGate(ip)
+}
+
+// familyClients returns the protocol and the responders ip can be
+// announced with. It must be called with the lock held.
+func (a *Announce) familyClients(ip net.IP) (string, []responder) {
+	var clients []responder
+	if ip.To4() != nil {
+		for _, client := range a.arps {
+			intf := client.Interface()
+			if bond, ok := a.activeSlaves[intf]; ok {
+				// The active slave follows its bond.
+				if a.arps[bond] == nil {
+					continue
+				}
+				intf = bond
+			}
+			if a.sendsOn(ip, intf) {
+				clients = append(clients, client)
+			}
+		}
+		return "arp", a.onePerSegment(ip, clients)
+	}
+	for _, client := range a.ndps {
+		if a.sendsOn(ip, client.Interface()) {
+			clients = append(clients, client)
+		}
+	}
+	return "ndp", a.onePerSegment(ip, clients)
+}
+
+// onePerSegment returns clients keeping only the first one, by interface
+// name, of each L2 segment, see WithSegmentGroups and
+// WithSegmentsBySubnet. It must be called with the lock held.
+func (a *Announce) onePerSegment(ip net.IP, clients []responder) []responder {
+	if len(a.cfg.segmentGroups) == 0 && !a.cfg.segmentsBySubnet {
+		return clients
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Interface() < clients[j].Interface() })
+	seen := map[string]bool{}
+	ret := clients[:0]
+	for _, client := range clients {
+		if segment := a.segmentOf(ip, client.Interface()); segment != "" {
+			if seen[segment] {
+				continue
+			}
+			seen[segment] = true
+		}
+		ret = append(ret, client)
+	}
+	return ret
+}
+
+// segmentOf returns the L2 segment intf announces ip on, or an empty
+// string if intf is on a segment of its own. It must be called with the
+// lock held.
+func (a *Announce) segmentOf(ip net.IP, intf string) string {
+	if group := a.cfg.segmentGroups[intf]; group != "" {
+		return "group " + group
+	}
+	if !a.cfg.segmentsBySubnet {
+		return ""
+	}
+	for _, n := range a.ifSubnets[intf] {
+		if n.Contains(ip) {
+			return "subnet " + n.String()
+		}
+	}
+	return ""
+}
+
+// sendsOn returns whether the gratuitous announcements of ip are sent on
+// intf. It must be called with the lock held.
+func (a *Announce) sendsOn(ip net.IP, intf string) bool {
+	return a.ipAllowedOn(ip, intf) && a.subnetReason(ip, intf) == DropReasonNone && a.priorityReason(ip, intf) == DropReasonNone
+}
+
+// Handover stops answering requests for ip and sends a final burst of
+// gratuitous announcements of it, so that the other hosts refresh their
+// caches right away, for planned changes of the node announcing ip. The
+// announcements still scheduled for ip are skipped. The IP stays handed
+// over until it is released with DeleteBalancer or DeleteBalancerIP. It
+// returns an error if ip is not announced by this node.
+func (a *Announce) Handover(ip net.IP) error {
+	ip = normalizeIP(ip)
+	a.Lock()
+	if a.ipRefcnt[keyOf(ip)] <= 0 {
+		a.Unlock()
+		return fmt.Errorf("%s is not announced by this node", ip)
+	}
+	if a.handedOver == nil {
+		a.handedOver = map[ipKey]bool{}
+	}
+	a.handedOver[keyOf(ip)] = true
+	proto, clients := a.familyClients(ip)
+	timeout := a.cfg.getGratuitousTimeout()
+	a.Unlock()
+
+	level.Info(a.logger).Log("event", "handover", "ip", ip, "msg", "handing over IP, sending final announcements")
+	if len(clients) > 0 {
+		a.sendGratuitous(ip, proto, clients, timeout, handoverBurst)
+	}
+	return nil
+}
+
+// Suppress stops answering requests and sending gratuitous packets for ip
+// until Unsuppress is called, for instance to take a problematic IP out of
+// service during an incident without touching the services. The services
+// keep using ip and the NDP multicast groups stay joined. Unlike a
+// handover, the suppression outlives the release of ip.
+func (a *Announce) Suppress(ip net.IP) {
+	ip = copyIP(normalizeIP(ip))
+	a.Lock()
+	defer a.Unlock()
+	if a.suppressed == nil {
+		a.suppressed = map[ipKey]net.IP{}
+	}
+	a.suppressed[keyOf(ip)] = ip
+	level.Info(a.logger).Log("event", "suppress", "ip", ip, "msg", "stopped announcing IP")
+}
+
+// Unsuppress undoes Suppress, and announces ip again as after a failover
+// if it is owned.
+func (a *Announce) Unsuppress(ip net.IP) {
+	ip = normalizeIP(ip)
+	a.Lock()
+	if a.suppressed[keyOf(ip)] == nil {
+		a.Unlock()
+		return
+	}
+	delete(a.suppressed, keyOf(ip))
+	owned := a.ipRefcnt[keyOf(ip)] > 0
+	a.Unlock()
+
+	level.Info(a.logger).Log("event", "unsuppress", "ip", ip, "msg", "resumed announcing IP")
+	if owned {
+		a.doSpam(ip)
+	}
+}
+
+// SuppressedIPs returns the IPs set aside with Suppress, sorted.
+func (a *Announce) SuppressedIPs() []net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	ret := make([]net.IP, 0, len(a.suppressed))
+	for _, ip := range a.suppressed {
+		ret = append(ret, copyIP(ip))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].To16(), ret[j].To16()) < 0
+	})
+	return ret
+}
+
+// setLastAnnounced records that ip was announced at t. It must be called
+// with the lock held for reading at least.
+func (a *Announce) setLastAnnounced(ip net.IP, t time.Time) {
+	a.lastMu.Lock()
+	defer a.lastMu.Unlock()
+	if a.lastAnnounced == nil {
+		a.lastAnnounced = map[ipKey]time.Time{}
+	}
+	a.lastAnnounced[keyOf(ip)] = t
+	stats.LastAnnounced(ip.String(), t)
+}
+
+// LastAnnounced returns when a gratuitous packet was last sent
+// successfully for ip, on any interface. It returns false if ip has not
+// been announced since it was set.
+func (a *Announce) LastAnnounced(ip net.IP) (time.Time, bool) {
+	a.lastMu.Lock()
+	defer a.lastMu.Unlock()
+	t, ok := a.lastAnnounced[keyOf(ip)]
+	return t, ok
+}
+
+// conflict is called by the responders when another host claims ip on
+// intf with mac. Claims made with the MAC address of one of our
+// responders, as seen with several interfaces on the same segment, and
+// claims on IPs we do not own are ignored, the others are counted and
+// passed on to the handler set with WithConflictHandler.
+func (a *Announce) conflict(ip net.IP, mac net.HardwareAddr, intf string) {
+	a.RLock()
+	ours := a.ownMAC(mac)
+	owned := a.ipRefcnt[keyOf(ip)] > 0
+	handler := a.cfg.conflictHandler
+	a.RUnlock()
+	if ours {
+		return
+	}
+	a.probeReply(ip, mac)
+	if !owned {
+		return
+	}
+
+	level.Warn(a.logger).Log("op", "conflict", "interface", intf, "ip", ip, "mac", mac, "msg", "another host claims an announced IP")
+	stats.Conflict(intf)
+	if handler != nil {
+		handler(copyIP(ip), append(net.HardwareAddr(nil), mac...), intf)
+	}
+}
+
+// ownMAC returns whether mac is the MAC address of one of the responders.
+// It must be called with the lock held.
+func (a *Announce) ownMAC(mac net.HardwareAddr) bool {
+	for _, client := range a.arps {
+		if bytes.Equal(client.HardwareAddr(), mac) {
+			return true
+		}
+	}
+	for _, client := range a.ndps {
+		if bytes.Equal(client.HardwareAddr(), mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropped is called by the responders when they drop a packet about ip
+// received on intf from requester, and passes it on to the handler set
+// with WithDropHandler. The requests refused by the responders themselves
+// are kept for RecentDrops, see byResponder, answerReason keeps the others.
+func (a *Announce) dropped(ip net.IP, intf string, requester net.IP, reason DropReason) {
+	if reason.byResponder() {
+		a.recordDrop(ip, DropEvent{Interface: intf, Reason: reason, Requester: copyIP(requester)})
+	}
+	a.RLock()
+	handler := a.cfg.dropHandler
+	a.RUnlock()
+	if handler != nil {
+		handler(copyIP(ip), intf, reason)
+	}
+}
+
+// answerReason tells whether to answer a request for ip received on intf
+// from requester, which is nil when the request has no sender address.
+// It returns the first reason not to answer among the settings of the
+// announcer, from the pause to the requester ACL.
+func (a *Announce) answerReason(ip net.IP, intf string, requester net.IP) DropReason {
+	reason := a.shouldAnnounce(ip, intf)
+	if reason == DropReasonNone && requester != nil {
+		reason = a.allowRequester(requester)
+	}
+	if reason != DropReasonNone {
+		a.recordDrop(ip, DropEvent{Interface: intf, Reason: reason, Requester: copyIP(requester)})
+	}
+	return reason
+}
+
+func (a *Announce) shouldAnnounce(ip net.IP, intf string) DropReason {
+	if a.Paused() {
+		return DropReasonPaused
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return a.announceReason(ip, intf)
+}
+
+// announceReason is shouldAnnounce without the pause check. It must be
+// called with the lock held.
+func (a *Announce) announceReason(ip net.IP, intf string) DropReason {
+	if a.draining {
+		return DropReasonDraining
+	}
+	if a.notLeader() {
+		return DropReasonNotLeader
+	}
+	if _, ok := a.activeSlaves[intf]; ok {
+		// The requests are answered on the bond.
+		return DropReasonBondSlave
+	}
+	if a.suppressed[keyOf(ip)] != nil {
+		return DropReasonSuppressed
+	}
+	if !a.gateOpen(ip) {
+		return DropReasonGated
+	}
+	if a.ipRefcnt[keyOf(ip)] <= 0 {
+		if reason := a.cidrAnnounce(ip, intf); reason != DropReasonNone {
+			return reason
+		}
+		if reason := a.subnetReason(ip, intf); reason != DropReasonNone {
+			return reason
+		}
+		return a.priorityReason(ip, intf)
+	}
+	if a.handedOver[keyOf(ip)] {
+		return DropReasonHandedOver
+	}
+	if a.cfg.waitRouting && !a.routingReady[keyOf(ip)] {
+		return DropReasonRoutingNotReady
+	}
+	if !a.ipAllowedOn(ip, intf) {
+		return DropReasonInterfaceRestricted
+	}
+	if reason := a.subnetReason(ip, intf); reason != DropReasonNone {
+		return reason
+	}
+	return a.priorityReason(ip, intf)
+}
+
+// priorityReason tells whether ip may be announced on intf given the
+// priorities of the interfaces with a subnet containing ip, see
+// WithInterfacePriority. It must be called with the lock held.
+func (a *Announce) priorityReason(ip net.IP, intf string) DropReason {
+	prios := a.cfg.interfacePriority
+	if len(prios) == 0 || !inSubnets(a.ifSubnets[intf], ip) {
+		return DropReasonNone
+	}
+	for _, name := range a.familyInterfaces(ip) {
+		if prios[name] > prios[intf] && inSubnets(a.ifSubnets[name], ip) {
+			return DropReasonLowerPriority
+		}
+	}
+	return DropReasonNone
+}
+
+// familyInterfaces returns the names of the interfaces with a responder
+// for the family of ip. It must be called with the lock held.
+func (a *Announce) familyInterfaces(ip net.IP) []string {
+	var ret []string
+	if ip.To4() != nil {
+		for name := range a.arps {
+			ret = append(ret, name)
+		}
+		return ret
+	}
+	for name := range a.ndps {
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// subnetReason tells whether ip may be announced on intf given the
+// subnets of intf, see WithOnlyMatchingSubnet. It must be called with the
+// lock held.
+func (a *Announce) subnetReason(ip net.IP, intf string) DropReason {
+	if !a.cfg.onlyMatchingSubnet || inSubnets(a.ifSubnets[intf], ip) {
+		return DropReasonNone
+	}
+	return DropReasonSubnetMismatch
+}
+
+// InterfacesForIP returns the sorted names of the interfaces whose
+// responders would answer requests for ip right now: the ARP responders
+// for an IPv4 address and the NDP responders for an IPv6 one, minus the
+// interfaces the services of ip are restricted away from.
+func (a *Announce) InterfacesForIP(ip net.IP) []string {
+	if a.Paused() {
+		return nil
+	}
+	a.RLock()
+	defer a.RUnlock()
+	names := map[string]bool{}
+	if ip.To4() != nil {
+		for _, client := range a.arps {
+			if a.announceReason(ip, client.Interface()) == DropReasonNone {
+				names[client.Interface()] = true
+			}
+		}
+	} else {
+		for _, client := range a.ndps {
+			if a.announceReason(ip, client.Interface()) == DropReasonNone {
+				names[client.Interface()] = true
+			}
+		}
+	}
+	ret := make([]string, 0, len(names))
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// allowRequester tells whether to answer a request sent from ip, see
+// WithRequesterACL.
+func (a *Announce) allowRequester(ip net.IP) DropReason {
+	a.RLock()
+	defer a.RUnlock()
+	if len(a.cfg.requesterACL) == 0 {
+		return DropReasonNone
+	}
+	for _, n := range a.cfg.requesterACL {
+		if n.Contains(ip) {
+			return DropReasonNone
+		}
+	}
+	return DropReasonACL
+}
+
+// SetRequesterACL replaces the addresses allowed to resolve the announced
+// IPs, see WithRequesterACL. An empty acl allows all the hosts.
+func (a *Announce) SetRequesterACL(acl []*net.IPNet) {
+	acl = copyIPNets(acl)
+	a.Lock()
+	defer a.Unlock()
+	a.cfg.requesterACL = acl
+}
+
+// cidrAnnounce tells whether to answer for ip on intf because it belongs
+// to a CIDR registered with SetBalancerCIDR. It must be called with the
+// lock held.
+func (a *Announce) cidrAnnounce(ip net.IP, intf string) DropReason {
+	restricted := false
+	for name, cidrs := range a.cidrs {
+		for _, cidr := range cidrs {
+			if !cidr.Contains(ip) {
+				continue
+			}
+			if a.interfaceAllowedFor(name, intf) {
+				return DropReasonNone
+			}
+			restricted = true
+		}
+	}
+	if restricted {
+		return DropReasonInterfaceRestricted
+	}
+	return DropReasonAnnounceIP
+}
+
+// interfaceAllowedFor returns whether the named service may be announced
+// on intf. It must be called with the lock held.
+func (a *Announce) interfaceAllowedFor(name, intf string) bool {
+	if allowed, ok := a.svcIfaces[name]; ok && !allowed[intf] {
+		return false
+	}
+	if mac, ok := a.floatingMACs[name]; ok {
+		return bytes.Equal(a.announcedMAC(intf), mac)
+	}
+	return true
+}
+
+// announcedMAC returns the MAC address the responders of intf announce
+// the IPs at, or nil if intf has no responder. It must be called with the
+// lock held.
+func (a *Announce) announcedMAC(intf string) net.HardwareAddr {
+	var mac net.HardwareAddr
+	if r, ok := a.arps[intf]; ok {
+		mac = r.HardwareAddr()
+	} else if r, ok := a.ndps[intf]; ok {
+		mac = r.HardwareAddr()
+	} else {
+		return nil
+	}
+	if a.cfg.sourceMAC != nil {
+		return a.cfg.sourceMAC
+	}
+	return mac
+}
+
+// ipAllowedOn returns whether one of the services using ip, which must
+// be announced, may be announced on intf. It must be called with the lock
+// held.
+func (a *Announce) ipAllowedOn(ip net.IP, intf string) bool {
+	if !a.inZone(ip, intf) {
+		return false
+	}
+	if len(a.svcIfaces) == 0 {
+		// No service is restricted, avoid going through all of them.
+		return true
+	}
+	for name, ips := range a.ips {
+		for _, i := range ips {
+			if i.Equal(ip) && a.interfaceAllowedFor(name, intf) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetBalancer adds ip to the set of announced addresses. Invalid IPs are
+// logged and ignored, see SetBalancerE.
+func (a *Announce) SetBalancer(name string, ip net.IP) {
+	if err := a.SetBalancerE(name, ip); err != nil {
+		level.Error(a.logger).Log("op", "setBalancer", "service", name, "error", err, "msg", "not announcing invalid IP")
+	}
+}
+
+// SetBalancerE adds ip to the set of announced addresses, or returns an
+// error if ip can't be announced: nil, unspecified, loopback and
+// multicast IPs are rejected.
+func (a *Announce) SetBalancerE(name string, ip net.IP) error {
+	if err := validateIP(ip); err != nil {
+		return err
+	}
+	if cfg := a.config(); cfg.familyDisabled(ip) {
+		return fmt.Errorf("the family of %s is disabled", ip)
+	}
+	a.SetBalancerIPs(name, []net.IP{ip})
+	return nil
+}
+
+// validateIP returns an error if ip can't be announced. The IPv6
+// link-local addresses are rejected, they need a zone, see
+// SetBalancerIPAddr.
+func validateIP(ip net.IP) error {
+	if err := validateScopedIP(ip); err != nil {
+		return err
+	}
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("link-local IP %s has no zone", ip)
+	}
+	return nil
+}
+
+// validateScopedIP is validateIP accepting the IPv6 link-local addresses.
+func validateScopedIP(ip net.IP) error {
+	switch {
+	case ip.To16() == nil:
+		return fmt.Errorf("invalid IP %q", []byte(ip))
+	case ip.IsUnspecified():
+		return fmt.Errorf("unspecified IP %s", ip)
+	case ip.IsLoopback():
+		return fmt.Errorf("loopback IP %s", ip)
+	case ip.IsMulticast():
+		return fmt.Errorf("multicast IP %s", ip)
+	}
+	return nil
+}
+
+// SetBalancerIPs adds ips to the set of announced addresses at once, so
+// that the addresses of a dual-stack service start being announced
+// together. Invalid IPs are logged and ignored.
+func (a *Announce) SetBalancerIPs(name string, ips []net.IP) {
+	a.setBalancer(name, ips, nil, nil, nil, true)
+}
+
+// SetBalancerIPsE is SetBalancerIPs returning an error naming the IPs
+// which were ignored, being invalid or of a disabled family, and the IPv6
+// addresses whose NDP multicast groups couldn't be joined on some
+// interfaces, since these interfaces won't answer for them. The latter
+// are set all the same, and the joins are retried by the NDP re-watches, see
+// WithNDPReWatchInterval.
+func (a *Announce) SetBalancerIPsE(name string, ips []net.IP) error {
+	return a.setBalancer(name, ips, nil, nil, nil, true)
+}
+
+// SetBalancerWithInterfaces adds ip to the set of announced addresses,
+// and restricts the announcements of the named service to the interfaces
+// in ifaces. An empty ifaces lets the service be announced on all
+// interfaces. An IP shared by several services is announced on the
+// interfaces allowed for any of them. The restriction is kept when more
+// IPs are set for the service without giving interfaces, for instance
+// with SetBalancer.
+//
+// On a trunk, the VLAN sub-interfaces like eth0.100 are interfaces of
+// their own, so an IP can be bound to some VLANs by listing their
+// sub-interfaces. The sub-interfaces are not enslaved to their parent and
+// get responders like any other interface.
+func (a *Announce) SetBalancerWithInterfaces(name string, ip net.IP, ifaces []string) {
+	a.setBalancer(name, []net.IP{ip}, append([]string{}, ifaces...), nil, nil, true)
+}
+
+// SetBalancerWithFloatingMAC adds ip to the set of announced addresses,
+// and announces it only on iface, and only while iface is announced at
+// mac. It is meant for a virtual MAC moving between the nodes, carried by
+// a dedicated interface like a macvlan: the node answers for ip once the
+// MAC is on iface, and the MAC change triggers new announcements. It
+// returns an error if mac is not a unicast address or if WithSourceMAC
+// announces the IPs at another MAC.
+func (a *Announce) SetBalancerWithFloatingMAC(name string, ip net.IP, iface string, mac net.HardwareAddr) error {
+	if err := validateIP(ip); err != nil {
+		return err
+	}
+	if iface == "" {
+		return fmt.Errorf("no interface given for the floating MAC %s", mac)
+	}
+	if len(mac) == 0 || mac[0]&1 != 0 {
+		return fmt.Errorf("floating MAC %q is not a unicast address", mac)
+	}
+	cfg := a.config()
+	if cfg.familyDisabled(ip) {
+		return fmt.Errorf("the family of %s is disabled", ip)
+	}
+	if cfg.sourceMAC != nil && !bytes.Equal(cfg.sourceMAC, mac) {
+		return fmt.Errorf("the IPs are announced at the source MAC %s, not at %s", cfg.sourceMAC, mac)
+	}
+	a.setBalancer(name, []net.IP{ip}, []string{iface}, nil, mac, true)
+	return nil
+}
+
+// SetBalancerIPAddr adds addr to the set of announced addresses like
+// SetBalancerE, keeping its zone: an IPv6 link-local address is only
+// meaningful on the link of its zone, so it must have one, naming an
+// interface by name or index, and it is only answered for, watched and
+// announced on that interface. An IP can only be announced in one zone at
+// a time. Addresses without a zone are set like with SetBalancerE. The
+// address is released by DeleteBalancer and DeleteBalancerIP.
+func (a *Announce) SetBalancerIPAddr(name string, addr *net.IPAddr) error {
+	if addr.Zone == "" {
+		return a.SetBalancerE(name, addr.IP)
+	}
+	ip := normalizeIP(addr.IP)
+	if err := validateScopedIP(ip); err != nil {
+		return err
+	}
+	if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("zone %q given for %s, which is not an IPv6 link-local address", addr.Zone, ip)
+	}
+	if cfg := a.config(); cfg.familyDisabled(ip) {
+		return fmt.Errorf("the family of %s is disabled", ip)
+	}
+	intf, err := a.resolveZone(addr.Zone)
+	if err != nil {
+		return err
+	}
+	ip = copyIP(ip)
+
+	stats.BalancerSet()
+	a.Lock()
+	if zone, ok := a.zones[keyOf(ip)]; ok && zone != intf {
+		a.Unlock()
+		return fmt.Errorf("%s is already announced in zone %s", ip, zone)
+	}
+	if a.ipRefcnt[keyOf(ip)] > 0 && a.zones[keyOf(ip)] == "" {
+		a.Unlock()
+		return fmt.Errorf("%s is already announced without a zone", ip)
+	}
+	if a.zones == nil {
+		a.zones = map[ipKey]string{}
+	}
+	a.zones[keyOf(ip)] = intf
+	a.addIP(name, ip)
+	a.Unlock()
+
+	a.notifyOwnership()
+	a.doSpam(ip)
+	return nil
+}
+
+// resolveZone returns the name of the interface zone names, by name or by
+// index.
+func (a *Announce) resolveZone(zone string) (string, error) {
+	ifs, err := a.lister.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("resolving zone %q: %s", zone, err)
+	}
+	for _, ifi := range ifs {
+		if ifi.Name == zone || strconv.Itoa(ifi.Index) == zone {
+			return ifi.Name, nil
+		}
+	}
+	return "", fmt.Errorf("zone %q names no interface", zone)
+}
+
+// inZone returns whether ip may be used on intf: the zoned IPs set with
+// SetBalancerIPAddr are only used on the interface of their zone. It must
+// be called with the lock held.
+func (a *Announce) inZone(ip net.IP, intf string) bool {
+	zone, ok := a.zones[keyOf(ip)]
+	return !ok || zone == intf
+}
+
+// SetBalancerWithPolicy adds ip to the set of announced addresses, and
+// announces it following policy rather than the global settings. The
+// interval and the duration of policy only apply with the default
+// scheduler. When several services share ip, the last policy set wins,
+// until ip is no longer announced.
+func (a *Announce) SetBalancerWithPolicy(name string, ip net.IP, policy SpamPolicy) {
+	a.setBalancer(name, []net.IP{ip}, nil, &policy, nil, true)
+}
+
+// SetOpts tunes SetBalancerOpts.
+type SetOpts struct {
+	// Spam sends the gratuitous announcements of the IP right away, like
+	// SetBalancer does. Without it, the node answers the requests for
+	// the IP but doesn't advertise it until told to, for instance with
+	// AssumeLeadership once it won the election for the service.
+	Spam bool
+}
+
+// SetBalancerOpts adds ip to the set of announced addresses like
+// SetBalancer, tuned by opts. Invalid IPs are logged and ignored.
+func (a *Announce) SetBalancerOpts(name string, ip net.IP, opts SetOpts) {
+	a.setBalancer(name, []net.IP{ip}, nil, nil, nil, opts.Spam)
+}
+
+// setBalancer adds ips to the addresses of the named service, and
+// announces them unless spam is false. The interfaces of the service are
+// replaced when ifaces is not nil, along with its floating MAC, and
+// otherwise kept. The invalid IPs and the IPs of a
+// disabled family are logged and ignored, and returned in the error.
+func (a *Announce) setBalancer(name string, ips []net.IP, ifaces []string, policy *SpamPolicy, floatingMAC net.HardwareAddr, spam bool) error {
+	cfg := a.config()
+	var errs []error
+	normalized := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if err := validateIP(ip); err != nil {
+			level.Error(a.logger).Log("op", "setBalancer", "service", name, "error", err, "msg", "not announcing invalid IP")
+			errs = append(errs, err)
+			continue
+		}
+		if cfg.familyDisabled(ip) {
+			level.Error(a.logger).Log("op", "setBalancer", "service", name, "ip", ip, "msg", "not announcing IP, its family is disabled")
+			errs = append(errs, fmt.Errorf("the family of %s is disabled", ip))
+			continue
+		}
+		normalized = append(normalized, copyIP(normalizeIP(ip)))
+	}
+	ips = normalized
+	// Call doSpam at the end of the function without holding the lock,
+	// for all the IPs in a row.
+	defer func() {
+		a.notifyOwnership()
+		if !spam {
+			return
+		}
+		for _, ip := range ips {
+			a.doSpam(ip)
+		}
+	}()
+	stats.BalancerSet()
+	a.Lock()
+	defer a.Unlock()
+
+	if ifaces != nil {
+		if allowed := nameSet(ifaces); allowed != nil {
+			a.svcIfaces[name] = allowed
+		} else {
+			delete(a.svcIfaces, name)
+		}
+		delete(a.floatingMACs, name)
+	}
+	if floatingMAC != nil {
+		if a.floatingMACs == nil {
+			a.floatingMACs = map[string]net.HardwareAddr{}
+		}
+		a.floatingMACs[name] = append(net.HardwareAddr(nil), floatingMAC...)
+	}
+	for _, ip := range ips {
+		if err := a.addIP(name, ip); err != nil {
+			errs = append(errs, err)
+		}
+		if policy != nil {
+			if a.policies == nil {
+				a.policies = map[ipKey]SpamPolicy{}
+			}
+			a.policies[keyOf(ip)] = *policy
+		}
+	}
+	return joinErrors("setting "+name, errs)
+}
+
+// SetBalancerReplace sets the announced addresses of the named service to
+// ips at once, for instance when the service moves to another pool. The
+// addresses the service keeps are left alone, the ones it no longer uses
+// are released and the new ones added, under a single lock so that the
+// kept addresses are never unannounced. Only the new addresses are
+// announced again. An empty ips forgets the service, but not its CIDRs.
+// Invalid IPs are logged and ignored.
+func (a *Announce) SetBalancerReplace(name string, ips []net.IP) {
+	cfg := a.config()
+	want := map[ipKey]bool{}
+	var normalized []net.IP
+	for _, ip := range ips {
+		if err := validateIP(ip); err != nil {
+			level.Error(a.logger).Log("op", "setBalancerReplace", "service", name, "error", err, "msg", "not announcing invalid IP")
+			continue
+		}
+		if cfg.familyDisabled(ip) {
+			level.Error(a.logger).Log("op", "setBalancerReplace", "service", name, "ip", ip, "msg", "not announcing IP, its family is disabled")
+			continue
+		}
+		ip = copyIP(normalizeIP(ip))
+		want[keyOf(ip)] = true
+		normalized = append(normalized, ip)
+	}
+
+	var added []net.IP
+	defer func() {
+		a.notifyOwnership()
+		a.sendWithdrawals()
+		for _, ip := range added {
+			a.doSpam(ip)
+		}
+	}()
+	stats.BalancerSet()
+	a.Lock()
+	defer a.Unlock()
+
+	existing := map[ipKey]bool{}
+	var kept, removed []net.IP
+	for _, ip := range a.ips[name] {
+		existing[keyOf(ip)] = true
+		if want[keyOf(ip)] {
+			kept = append(kept, ip)
+		} else {
+			removed = append(removed, ip)
+		}
+	}
+	if len(kept) == 0 {
+		delete(a.ips, name)
+	} else {
+		a.ips[name] = kept
+	}
+	for _, ip := range normalized {
+		if existing[keyOf(ip)] {
+			continue
+		}
+		a.addIP(name, ip)
+		existing[keyOf(ip)] = true
+		added = append(added, ip)
+	}
+	for _, ip := range removed {
+		a.releaseIP(name, ip)
+	}
+	if len(a.ips[name]) == 0 {
+		delete(a.svcIfaces, name)
+		delete(a.floatingMACs, name)
+	}
+}
+
+// LoadState registers all the services and IPs of state at once, like
+// calls to SetBalancerIPs, then announces all the owned IPs. It is meant
+// to replay the last known assignments when the speaker starts, so that
+// the node answers for its IPs before the controller catches up. Invalid
+// IPs are logged and ignored.
+func (a *Announce) LoadState(state map[string][]net.IP) {
+	a.Lock()
+	for name, ips := range state {
+		for _, ip := range ips {
+			if err := validateIP(ip); err != nil {
+				level.Error(a.logger).Log("op", "loadState", "service", name, "error", err, "msg", "not announcing invalid IP")
+				continue
+			}
+			if a.cfg.familyDisabled(ip) {
+				level.Error(a.logger).Log("op", "loadState", "service", name, "ip", ip, "msg", "not announcing IP, its family is disabled")
+				continue
+			}
+			a.addIP(name, copyIP(normalizeIP(ip)))
+		}
+	}
+	a.Unlock()
+	a.notifyOwnership()
+	a.ReannounceAll()
+}
+
+// addIP adds ip to the addresses of the named service. It returns an
+// error naming the interfaces which failed to watch ip, which is added
+// all the same. It must be called with the lock held.
+func (a *Announce) addIP(name string, ip net.IP) error {
+	// Kubernetes may inform us that we should advertise this address multiple
+	// times, so just no-op any subsequent requests.
+	for _, existing := range a.ips[name] {
+		if existing.Equal(ip) {
+			return nil
+		}
+	}
+
+	a.ips[name] = append(a.ips[name], ip)
+	a.emitLifecycle(a.cfg.lifecycleEvents, LifecycleEvent{Type: BalancerSet, Service: name, IP: ip})
+
+	a.ipRefcnt[keyOf(ip)]++
+	if a.ipRefcnt[keyOf(ip)] > 1 {
+		// Multiple services are using this IP, so there's nothing
+		// else to do right now.
+		return nil
+	}
+	a.owned++
+	stats.AnnouncedIPs(a.owned)
+	a.ownershipChanged(ip, true)
+	if a.draining {
+		// Undrain watches the IP.
+		return nil
+	}
+
+	var failed []string
+	for _, client := range a.ndps {
+		if !a.inZone(ip, client.Interface()) {
+			continue
+		}
+		if err := client.Watch(ip); err != nil {
+			level.Error(a.logger).Log("op", "watchMulticastGroup", "error", err, "ip", ip, "msg", "failed to watch NDP multicast group for IP, NDP responder will not respond to requests for this address")
+			failed = append(failed, fmt.Sprintf("%s (%s)", client.Interface(), err))
+		}
+	}
+	return watchFailure("watching", ip, failed)
+}
+
+// watchFailure returns an error saying that op failed for ip on the
+// interfaces of failed, or nil if failed is empty.
+func watchFailure(op string, ip net.IP, failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("%s %s failed on %s", op, ip, strings.Join(failed, ", "))
+}
+
+// joinErrors returns an error made of errs prefixed with what, or nil if
+// errs is empty.
+func joinErrors(what string, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Errorf("%s: %s", what, strings.Join(msgs, "; "))
+}
+
+// DeleteBalancer deletes an address from the set of addresses we should announce.
+func (a *Announce) DeleteBalancer(name string) {
+	a.DeleteBalancerE(name)
+}
+
+// DeleteBalancerE is DeleteBalancer returning an error naming the IPv6
+// addresses whose NDP multicast groups couldn't be left on some
+// interfaces. The service is deleted all the same.
+func (a *Announce) DeleteBalancerE(name string) error {
+	stats.BalancerDeleted()
+	defer a.sendWithdrawals()
+	defer a.notifyOwnership()
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.cidrs, name)
+	ips, ok := a.ips[name]
+	if !ok {
+		delete(a.svcIfaces, name)
+		delete(a.floatingMACs, name)
+		return nil
+	}
+	delete(a.ips, name)
+	delete(a.svcIfaces, name)
+	delete(a.floatingMACs, name)
+	var errs []error
+	for _, ip := range ips {
+		if err := a.releaseIP(name, ip); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("deleting "+name, errs)
+}
+
+// SetBalancerCIDR makes the named service answer requests for all the IPs
+// in cidr, like a proxy, without registering them one by one. Since a
+// whole range can't be announced, no gratuitous packets are sent for
+// these IPs and the requests are answered regardless of routing
+// readiness. For IPv6, only the solicitations reaching the responders are
+// answered: the solicited-node multicast groups of the range are not
+// joined. DeleteBalancer removes the CIDRs along with the IPs.
+func (a *Announce) SetBalancerCIDR(name string, cidr *net.IPNet) {
+	a.Lock()
+	defer a.Unlock()
+	for _, existing := range a.cidrs[name] {
+		if existing.String() == cidr.String() {
+			return
+		}
+	}
+	if a.cidrs == nil {
+		a.cidrs = map[string][]*net.IPNet{}
+	}
+	a.cidrs[name] = append(a.cidrs[name], copyIPNets([]*net.IPNet{cidr})...)
+}
+
+// DeleteBalancerIP deletes ip from the addresses announced for the named
+// service, leaving its other addresses alone. The service is forgotten
+// along with its last address.
+func (a *Announce) DeleteBalancerIP(name string, ip net.IP) {
+	defer a.sendWithdrawals()
+	defer a.notifyOwnership()
+	a.Lock()
+	defer a.Unlock()
+
+	ips := a.ips[name]
+	for i, existing := range ips {
+		if !existing.Equal(ip) {
+			continue
+		}
+		if len(ips) == 1 {
+			delete(a.ips, name)
+			delete(a.svcIfaces, name)
+			delete(a.floatingMACs, name)
+		} else {
+			a.ips[name] = append(ips[:i:i], ips[i+1:]...)
+		}
+		a.releaseIP(name, existing)
+		return
+	}
+}
+
+// releaseIP drops the use of ip by the named service, and stops watching
+// ip once no service uses it, queueing its withdrawal on the interfaces it
+// was announced on for sendWithdrawals. It returns an error naming the
+// interfaces which failed to unwatch ip. It must be called with the lock
+// held.
+func (a *Announce) releaseIP(name string, ip net.IP) error {
+	a.emitLifecycle(a.cfg.lifecycleEvents, LifecycleEvent{Type: BalancerDeleted, Service: name, IP: ip})
+	if a.ipRefcnt[keyOf(ip)] <= 0 {
+		// The refcount is off, keep it from going negative so that
+		// the IP isn't released twice, nor still unowned when set
+		// again.
+		level.Warn(a.logger).Log("op", "releaseIP", "service", name, "ip", ip, "msg", "IP released more times than it was set, ignoring")
+		a.ipRefcnt[keyOf(ip)] = 0
+		return nil
+	}
+	var withdraw []watchingResponder
+	if a.ipRefcnt[keyOf(ip)] == 1 && ip.To4() == nil && !a.Paused() {
+		// Only withdraw ip where it is announced, before it is
+		// released.
+		for _, client := range a.ndps {
+			if a.inZone(ip, client.Interface()) && a.announceReason(ip, client.Interface()) == DropReasonNone {
+				withdraw = append(withdraw, client)
+			}
+		}
+	}
+	a.ipRefcnt[keyOf(ip)]--
+	if a.ipRefcnt[keyOf(ip)] > 0 {
+		// Another service is still using this IP, don't touch it
+		// any more.
+		return nil
+	}
+	for _, client := range withdraw {
+		a.withdrawals = append(a.withdrawals, pendingWithdrawal{client: client, ip: copyIP(ip)})
+	}
+	a.owned--
+	stats.AnnouncedIPs(a.owned)
+	defer delete(a.zones, keyOf(ip))
+	a.ownershipChanged(ip, false)
+	delete(a.handedOver, keyOf(ip))
+	delete(a.policies, keyOf(ip))
+	a.lastMu.Lock()
+	delete(a.lastAnnounced, keyOf(ip))
+	a.lastMu.Unlock()
+	a.dropsMu.Lock()
+	delete(a.recentDrops, keyOf(ip))
+	a.dropsMu.Unlock()
+	stats.DeleteLastAnnounced(ip.String())
+	if a.draining {
+		// Drain already unwatched the IP.
+		return nil
+	}
+
+	var failed []string
+	for _, client := range a.ndps {
+		if !a.inZone(ip, client.Interface()) {
+			continue
+		}
+		if err := client.Unwatch(ip); err != nil {
+			level.Error(a.logger).Log("op", "unwatchMulticastGroup", "error", err, "ip", ip, "msg", "failed to unwatch NDP multicast group for IP")
+			failed = append(failed, fmt.Sprintf("%s (%s)", client.Interface(), err))
+		}
+	}
+	return watchFailure("unwatching", ip, failed)
+}
+
+// pendingWithdrawal is a Withdraw of ip to send with client.
+type pendingWithdrawal struct {
+	client watchingResponder
+	ip     net.IP
+}
+
+// sendWithdrawals sends the withdrawals queued by releaseIP, on all the
+// interfaces at once, waiting for each for the gratuitous announcement
+// timeout at most. It must be called without the lock held.
+func (a *Announce) sendWithdrawals() {
+	a.Lock()
+	pending, timeout := a.withdrawals, a.cfg.getGratuitousTimeout()
+	a.withdrawals = nil
+	a.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	type result struct {
+		w   pendingWithdrawal
+		err error
+	}
+	results := make(chan result, len(pending))
+	for _, w := range pending {
+		w := w
+		go func() {
+			results <- result{w, w.client.Withdraw(w.ip)}
+		}()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for n := len(pending); n > 0; n-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				level.Error(a.logger).Log("op", "withdrawIP", "error", r.err, "interface", r.w.client.Interface(), "ip", r.w.ip, "msg", "failed to withdraw IP")
+			}
+		case <-timer.C:
+			level.Warn(a.logger).Log("op", "withdrawIP", "timeout", timeout, "pending", n, "msg", "withdrawals timed out, not waiting for them")
+			return
+		}
+	}
+}
+
+// ownershipChange is an IP starting or stopping being owned.
+type ownershipChange struct {
+	ip    net.IP
+	owned bool
+}
+
+// ownershipChanged queues a change of ownership of ip for
+// notifyOwnership. It must be called with the lock held.
+func (a *Announce) ownershipChanged(ip net.IP, owned bool) {
+	if a.cfg.ownershipHandler == nil {
+		return
+	}
+	a.ownershipChanges = append(a.ownershipChanges, ownershipChange{ip: copyIP(ip), owned: owned})
+}
+
+// notifyOwnership passes the queued ownership changes to the handler set
+// with WithOwnershipChangeHandler. Only one call passes changes at a time,
+// until the queue is empty, so that the handler sees them in order: the
+// other calls, including the ones made by the handler itself, return
+// right away. It must be called without the lock held.
+func (a *Announce) notifyOwnership() {
+	a.Lock()
+	if a.notifying {
+		a.Unlock()
+		return
+	}
+	a.notifying = true
+	for len(a.ownershipChanges) > 0 {
+		changes, handler := a.ownershipChanges, a.cfg.ownershipHandler
+		a.ownershipChanges = nil
+		a.Unlock()
+		if handler != nil {
+			for _, c := range changes {
+				handler(c.ip, c.owned)
+			}
+		}
+		a.Lock()
+	}
+	a.notifying = false
+	a.Unlock()
+}
+
+// OwnedIPs returns the sorted IPs this node owns, that is the IPs used by
+// at least one service. It is the same set as AnnouncedIPs, meant to be
+// used along with WithOwnershipChangeHandler.
+func (a *Announce) OwnedIPs() []net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	ret := a.ownedIPs(true, true)
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].To16(), ret[j].To16()) < 0
+	})
+	return ret
+}
+
+// ResponderStats returns a snapshot of the activity of the responders,
+// keyed by interface name. When an interface runs both an ARP and an NDP
+// responder, their counters are combined.
+func (a *Announce) ResponderStats() map[string]ResponderStat {
+	a.RLock()
+	defer a.RUnlock()
+	ret := map[string]ResponderStat{}
+	for _, client := range a.arps {
+		ret[client.Interface()] = ret[client.Interface()].merge(client.Stats())
+	}
+	for _, client := range a.ndps {
+		ret[client.Interface()] = ret[client.Interface()].merge(client.Stats())
+	}
+	return ret
+}
+
+// InterfaceInfo describes an interface the announcer has responders on,
+// see ActiveInterfaces.
+type InterfaceInfo struct {
+	// Name and Index identify the interface.
+	Name  string
+	Index int
+	// Protocols lists the responders of the interface, "arp" and/or
+	// "ndp".
+	Protocols []string
+	// MAC is the hardware address the responders were created with.
+	MAC net.HardwareAddr
+}
+
+// ActiveInterfaces returns the interfaces which currently have an ARP or
+// an NDP responder, sorted by name. Unlike InterfacesForIP, it doesn't
+// depend on the announced IPs.
+func (a *Announce) ActiveInterfaces() []InterfaceInfo {
+	a.RLock()
+	defer a.RUnlock()
+	infos := map[string]*InterfaceInfo{}
+	add := func(proto string, r responder) {
+		info, ok := infos[r.Interface()]
+		if !ok {
+			info = &InterfaceInfo{
+				Name:  r.Interface(),
+				Index: a.ifIndex[r.Interface()],
+				MAC:   append(net.HardwareAddr(nil), r.HardwareAddr()...),
+			}
+			infos[r.Interface()] = info
+		}
+		info.Protocols = append(info.Protocols, proto)
+	}
+	for _, client := range a.arps {
+		add("arp", client)
+	}
+	for _, client := range a.ndps {
+		add("ndp", client)
+	}
+	ret := make([]InterfaceInfo, 0, len(infos))
+	for _, info := range infos {
+		ret = append(ret, *info)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// Affinity is an IP the announcer answers for on an interface, see
+// AffinityReport.
+type Affinity struct {
+	IP        net.IP
+	Interface string
+	// Protocol is "arp" for an IPv4 address and "ndp" for an IPv6 one.
+	Protocol string
+}
+
+// AffinityReport returns the pairs of owned IPs and interfaces whose
+// responders would answer requests for them right now, like
+// InterfacesForIP for all the owned IPs at once, so that a coordination
+// layer can detect the IPs answered for by several nodes. The pairs are
+// sorted by IP, then by interface.
+func (a *Announce) AffinityReport() []Affinity {
+	if a.Paused() {
+		return nil
+	}
+	a.RLock()
+	defer a.RUnlock()
+	var ret []Affinity
+	add := func(ip net.IP, proto string, r responder) {
+		if a.announceReason(ip, r.Interface()) == DropReasonNone {
+			ret = append(ret, Affinity{IP: copyIP(ip), Interface: r.Interface(), Protocol: proto})
+		}
+	}
+	for _, ip := range a.ownedIPs(true, false) {
+		for _, client := range a.arps {
+			add(ip, "arp", client)
+		}
+	}
+	for _, ip := range a.ownedIPs(false, true) {
+		for _, client := range a.ndps {
+			add(ip, "ndp", client)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if c := bytes.Compare(ret[i].IP.To16(), ret[j].IP.To16()); c != 0 {
+			return c < 0
+		}
+		return ret[i].Interface < ret[j].Interface
+	})
+	return ret
+}
+
+// Ready returns an error if some announced IPs can't be answered for
+// because there is no healthy responder of their family: announced IPv4
+// addresses and no healthy ARP responder, or announced IPv6 addresses and
+// no healthy NDP responder. It is meant to back a readiness probe, see
+// ReadyHandler.
+func (a *Announce) Ready() error {
+	a.RLock()
+	defer a.RUnlock()
+	arpHealthy, ndpHealthy := false, false
+	for _, client := range a.arps {
+		arpHealthy = arpHealthy || client.Healthy()
+	}
+	for _, client := range a.ndps {
+		ndpHealthy = ndpHealthy || client.Healthy()
+	}
+	if v4 := len(a.ownedIPs(true, false)); v4 > 0 && !arpHealthy {
+		return fmt.Errorf("%d IPv4 addresses announced but no healthy ARP responder", v4)
+	}
+	if v6 := len(a.ownedIPs(false, true)); v6 > 0 && !ndpHealthy {
+		return fmt.Errorf("%d IPv6 addresses announced but no healthy NDP responder", v6)
+	}
+	return nil
+}
+
+// SelfTest makes every responder send its harmless transmit probe, an
+// ARP request for our own address or a router solicitation, and returns
+// an error naming the interfaces whose probe failed or didn't complete
+// before ctx is done. It catches the sockets which can't transmit, for
+// instance for lack of CAP_NET_RAW, before the node is marked ready, and
+// also returns an error if there is no responder at all, as when they
+// all failed to be created. The probes update the health of the
+// responders like the ones sent on creation, so it is safe to run
+// periodically.
+func (a *Announce) SelfTest(ctx context.Context) error {
+	a.RLock()
+	var clients []responder
+	for _, client := range a.arps {
+		clients = append(clients, client)
+	}
+	for _, client := range a.ndps {
+		clients = append(clients, client)
+	}
+	a.RUnlock()
+	if len(clients) == 0 {
+		return errors.New("no responder to test")
+	}
+
+	type result struct {
+		client responder
+		err    error
+	}
+	results := make(chan result, len(clients))
+	pending := map[responder]bool{}
+	for _, client := range clients {
+		client := client
+		pending[client] = true
+		go func() {
+			results <- result{client, client.Probe()}
+		}()
+	}
+	var failed []string
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.client)
+			if r.err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", r.client.Interface(), r.err))
+			}
+		case <-ctx.Done():
+			for client := range pending {
+				failed = append(failed, fmt.Sprintf("%s: %s", client.Interface(), ctx.Err()))
+			}
+			pending = nil
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("self-test failed: %s", strings.Join(failed, "; "))
+}
+
+// SetRoutingReady marks whether routing is ready for ip. It only has an
+// effect with WithRoutingReadiness. Once routing is ready for an announced
+// IP, gratuitous packets are sent for it right away.
+func (a *Announce) SetRoutingReady(ip net.IP, ready bool) {
+	a.Lock()
+	if ready {
+		a.routingReady[keyOf(ip)] = true
+	} else {
+		delete(a.routingReady, keyOf(ip))
+	}
+	owned := a.ipRefcnt[keyOf(ip)] > 0
+	a.Unlock()
+
+	if ready && owned {
+		a.doSpam(ip)
+	}
+}
+
+// AssumeLeadership announces the IPs of the named service right away on
+// all interfaces, then keeps announcing them as after a failover. It is
+// meant to be called when this node just became the leader for the
+// service, to make the failover as fast as possible. The announcements
+// are sent before it returns, bypassing WithMinGratuitousSpacing; they
+// are still charged to the rate limit, and nothing is sent for the IPs
+// that would not be announced otherwise, e.g. while paused. It does
+// nothing if the service is not known, or while draining. The returned
+// error lists the IPs whose announcement failed on every interface.
+func (a *Announce) AssumeLeadership(name string) error {
+	a.RLock()
+	ips := append([]net.IP(nil), a.ips[name]...)
+	draining := a.draining
+	a.RUnlock()
+	if len(ips) == 0 || draining {
+		return nil
+	}
+
+	// Enter the spam windows, the spacing counts from the announcements
+	// sent below so that they are not immediately repeated.
+	now := time.Now()
+	a.inSpamLoop(func(sched Scheduler, pending *spamPending) {
+		for _, ip := range ips {
+			sched.Schedule(ip, now)
+			pending.sent(ip, now)
+		}
+	})
+
+	results := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			results[i] = a.gratuitousNow(ip)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("assuming leadership of "+name, errs)
+}
+
+// gratuitousNow sends the gratuitous announcements for ip like
+// gratuitous, but charges them to the rate limit instead of being
+// refused by it.
+func (a *Announce) gratuitousNow(ip net.IP) error {
+	proto, clients, timeout, burst := a.gratuitousClients(ip)
+	if len(clients) == 0 {
+		return nil
+	}
+	a.chargeGratuitous(len(clients) * burst)
+
+	if !a.sendGratuitous(ip, proto, clients, timeout, burst) {
+		return fmt.Errorf("announcing %s failed on every interface", ip)
+	}
+	a.RLock()
+	if a.ipRefcnt[keyOf(ip)] > 0 {
+		a.setLastAnnounced(ip, time.Now())
+	}
+	a.RUnlock()
+	return nil
+}
+
+// AnnounceIP returns true when ip is announced by at least one service.
+// Different representations of the same address, like IPv4 addresses in
+// their 4 and 16 bytes forms, are considered equal.
+func (a *Announce) AnnounceIP(ip net.IP) bool {
+	a.RLock()
+	defer a.RUnlock()
+	return a.ipRefcnt[keyOf(ip)] > 0
+}
+
+// GetAnnouncements returns a copy of the announced IPs, by service name.
+func (a *Announce) GetAnnouncements() map[string][]net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	ret := make(map[string][]net.IP, len(a.ips))
+	for name, ips := range a.ips {
+		ret[name] = copyIPs(ips)
+	}
+	return ret
+}
+
+// GetIPsForName returns a copy of the IPs announced for the named
+// service, and false if the service is not known.
+func (a *Announce) GetIPsForName(name string) ([]net.IP, bool) {
+	a.RLock()
+	defer a.RUnlock()
+	ips, ok := a.ips[name]
+	if !ok {
+		return nil, false
+	}
+	return copyIPs(ips), true
+}
+
+// RefCount returns the number of services using ip. Along with NameForIP,
+// it tells why an IP is still announced after a service was deleted.
+func (a *Announce) RefCount(ip net.IP) int {
+	a.RLock()
+	defer a.RUnlock()
+	if cnt := a.ipRefcnt[keyOf(ip)]; cnt > 0 {
+		return cnt
+	}
+	return 0
+}
+
+// NameForIP returns the sorted names of the services using ip, the
+// inverse of GetIPsForName.
+func (a *Announce) NameForIP(ip net.IP) []string {
+	a.RLock()
+	defer a.RUnlock()
+	var ret []string
+	for name, ips := range a.ips {
+		for _, existing := range ips {
+			if existing.Equal(ip) {
+				ret = append(ret, name)
+				break
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AnnouncedIPs returns a copy of the announced IPs, without duplicates
+// for IPs shared by several services.
+func (a *Announce) AnnouncedIPs() []net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	seen := map[ipKey]bool{}
+	ret := []net.IP{}
+	for _, ips := range a.ips {
+		for _, ip := range ips {
+			if seen[keyOf(ip)] {
+				continue
+			}
+			seen[keyOf(ip)] = true
+			ret = append(ret, copyIP(ip))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].To16(), ret[j].To16()) < 0
+	})
+	return ret
+}
+
+// Repeat restarts the gratuitous announcements for ip, as if it had just
+// been set. It returns an error if ip is not announced by this node.
+func (a *Announce) Repeat(ip net.IP) error {
+	if !a.AnnounceIP(ip) {
+		return fmt.Errorf("%s is not announced by this node", ip)
+	}
+	a.doSpam(ip)
+	return nil
+}
+
+// RepeatCtx is Repeat, but it blocks until the announcements are queued
+// rather than dropping them when the spam channel is full. It returns
+// ctx.Err() if ctx is done first, the announcements are then not counted
+// as dropped since the caller gave up on them.
+func (a *Announce) RepeatCtx(ctx context.Context, ip net.IP) error {
+	ip = normalizeIP(ip)
+	if ip == nil {
+		return fmt.Errorf("invalid IP")
+	}
+	if !a.AnnounceIP(ip) {
+		return fmt.Errorf("%s is not announced by this node", ip)
+	}
+	select {
+	case a.spamCh <- ip:
+		return nil
+	case <-a.done:
+		return fmt.Errorf("announcer is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Probe asks the hosts on the links whether ip is already in use before
+// it is announced, with an ARP probe or an NDP neighbor solicitation sent
+// by the responders of the family of ip. It waits for a reply from
+// another host until ctx is done, so ctx should have a deadline: if it
+// expires without a reply, ip is reported as not in use. Otherwise, the
+// MAC address of the owner of ip is returned.
+func (a *Announce) Probe(ctx context.Context, ip net.IP) (inUse bool, mac net.HardwareAddr, err error) {
+	ip = normalizeIP(ip)
+	if ip == nil {
+		return false, nil, fmt.Errorf("invalid IP")
+	}
+	replies := a.awaitProbe(ip)
+	defer a.stopProbe(ip, replies)
+
+	a.RLock()
+	var clients []responder
+	if ip.To4() != nil {
+		for _, client := range a.arps {
+			clients = append(clients, client)
+		}
+	} else {
+		for _, client := range a.ndps {
+			clients = append(clients, client)
+		}
+	}
+	a.RUnlock()
+	if len(clients) == 0 {
+		return false, nil, fmt.Errorf("no interface to probe %s on", ip)
+	}
+
+	sent := 0
+	for _, client := range clients {
+		if err = client.Solicit(ip); err != nil {
+			level.Warn(a.logger).Log("op", "probe", "interface", client.Interface(), "ip", ip, "error", err, "msg", "failed to send probe")
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return false, nil, fmt.Errorf("probing %s: %s", ip, err)
+	}
+
+	select {
+	case mac := <-replies:
+		return true, mac, nil
+	case <-a.done:
+		return false, nil, fmt.Errorf("announcer is closed")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return false, nil, nil
+		}
+		return false, nil, ctx.Err()
+	}
+}
+
+// awaitProbe registers a channel getting the MAC addresses of the other
+// hosts claiming ip, until stopProbe is called.
+func (a *Announce) awaitProbe(ip net.IP) chan net.HardwareAddr {
+	a.probeMu.Lock()
+	defer a.probeMu.Unlock()
+	if a.probes == nil {
+		a.probes = map[ipKey][]chan net.HardwareAddr{}
+	}
+	ch := make(chan net.HardwareAddr, 1)
+	a.probes[keyOf(ip)] = append(a.probes[keyOf(ip)], ch)
+	return ch
+}
+
+func (a *Announce) stopProbe(ip net.IP, ch chan net.HardwareAddr) {
+	a.probeMu.Lock()
+	defer a.probeMu.Unlock()
+	k := keyOf(ip)
+	chans := a.probes[k]
+	for i, c := range chans {
+		if c == ch {
+			chans = append(chans[:i], chans[i+1:]...)
+			break
+		}
+	}
+	if len(chans) == 0 {
+		delete(a.probes, k)
+		return
+	}
+	a.probes[k] = chans
+}
+
+// probeReply passes the claim of ip by mac to the pending probes of ip.
+func (a *Announce) probeReply(ip net.IP, mac net.HardwareAddr) {
+	a.probeMu.Lock()
+	defer a.probeMu.Unlock()
+	for _, ch := range a.probes[keyOf(ip)] {
+		select {
+		case ch <- append(net.HardwareAddr(nil), mac...):
+		default:
+		}
+	}
+}
+
+// Flush forgets all the services and IPs, for instance before the
+// speaker replays its whole state with LoadState: the NDP multicast groups
+// are left, without withdrawing the IPs, and the pending gratuitous
+// announcements are dropped. Unlike Close, the responders and the
+// background goroutines keep running, and unlike Drain, nothing is kept.
+func (a *Announce) Flush() {
+	a.Lock()
+	owned := a.ownedIPs(true, true)
+	for _, ip := range owned {
+		a.ownershipChanged(ip, false)
+		stats.DeleteLastAnnounced(ip.String())
+		if a.draining || ip.To4() != nil {
+			continue
+		}
+		for _, client := range a.ndps {
+			if !a.inZone(ip, client.Interface()) {
+				continue
+			}
+			if err := client.Unwatch(ip); err != nil {
+				level.Error(a.logger).Log("op", "unwatchMulticastGroup", "error", err, "ip", ip, "msg", "failed to unwatch NDP multicast group for IP")
+			}
+		}
+	}
+	a.ips = map[string][]net.IP{}
+	a.ipRefcnt = map[ipKey]int{}
+	a.owned = 0
+	a.svcIfaces = map[string]map[string]bool{}
+	a.floatingMACs = nil
+	a.cidrs = nil
+	a.handedOver = nil
+	a.policies = nil
+	a.zones = nil
+	a.lastMu.Lock()
+	a.lastAnnounced = nil
+	a.lastMu.Unlock()
+	a.dropsMu.Lock()
+	a.recentDrops = nil
+	a.dropsMu.Unlock()
+	stats.AnnouncedIPs(0)
+	a.Unlock()
+	a.notifyOwnership()
+
+	a.inSpamLoop(func(sched Scheduler, pending *spamPending) {
+		if ws, ok := sched.(*windowScheduler); ok {
+			ws.clear()
+		}
+		pending.clear()
+		for {
+			select {
+			case <-a.spamCh:
+			default:
+				return
+			}
+		}
+	})
+	level.Info(a.logger).Log("event", "flush", "ips", len(owned), "msg", "forgot all services and IPs")
+}
+
+// Drain stops announcing all IPs, for instance before the node goes
+// into maintenance: requests are no longer answered, the NDP multicast
+// groups are left and the pending gratuitous announcements are dropped.
+// The set of IPs is kept and can still be changed, so that Undrain
+// resumes announcing the up to date set. Unlike Close, the announcer
+// keeps running.
+func (a *Announce) Drain() {
+	a.Lock()
+	defer a.Unlock()
+	if a.draining {
+		return
+	}
+	a.draining = true
+	for _, ip := range a.ownedIPs(false, true) {
+		for _, client := range a.ndps {
+			if !a.inZone(ip, client.Interface()) {
+				continue
+			}
+			if err := client.Unwatch(ip); err != nil {
+				level.Error(a.logger).Log("op", "unwatchMulticastGroup", "error", err, "ip", ip, "msg", "failed to unwatch NDP multicast group for IP")
+			}
+		}
+	}
+	level.Info(a.logger).Log("event", "drain", "msg", "stopped announcing all IPs")
+}
+
+// Undrain resumes announcing the IPs after Drain, and sends gratuitous
+// packets for them as after a failover.
+func (a *Announce) Undrain() {
+	a.Lock()
+	if !a.draining {
+		a.Unlock()
+		return
+	}
+	a.draining = false
+	for _, client := range a.ndps {
+		a.watchAnnounced(log.With(a.logger, "interface", client.Interface()), client)
+	}
+	ips := a.ownedIPs(true, true)
+	a.Unlock()
+
+	level.Info(a.logger).Log("event", "undrain", "msg", "resumed announcing all IPs")
+	for _, ip := range ips {
+		a.doSpam(ip)
+	}
+}
+
+// Draining returns true between Drain and Undrain.
+func (a *Announce) Draining() bool {
+	a.RLock()
+	defer a.RUnlock()
+	return a.draining
+}
+
+// Pause stops answering requests and sending gratuitous packets until
+// Resume is called. Unlike Drain, it keeps the NDP multicast groups and
+// the pending announcements, and is cheap enough to be toggled often, for
+// instance during a leader handoff. The announcements skipped while paused
+// are not sent again on Resume, use ReannounceAll for that.
+func (a *Announce) Pause() {
+	atomic.StoreInt32(&a.paused, 1)
+}
+
+// Resume undoes Pause.
+func (a *Announce) Resume() {
+	atomic.StoreInt32(&a.paused, 0)
+}
+
+// Paused returns true between Pause and Resume.
+func (a *Announce) Paused() bool {
+	return atomic.LoadInt32(&a.paused) == 1
+}
+
+// SetLeaderState tells whether the node holds the leader election lease,
+// see WithLeaderElection. When the node gets the lease, the announced IPs
+// are announced again right away, as after a failover.
+func (a *Announce) SetLeaderState(held bool) {
+	a.Lock()
+	acquired := held && !a.leaseHeld && a.cfg.leaderElection
+	a.leaseHeld = held
+	a.Unlock()
+
+	if !acquired {
+		return
+	}
+	level.Info(a.logger).Log("event", "leaseAcquired", "msg", "holding the leader lease, announcing all IPs")
+	a.ReannounceAll()
+}
+
+// notLeader returns whether the node must stay silent because it doesn't
+// hold the leader election lease. It must be called with the lock held.
+func (a *Announce) notLeader() bool {
+	return a.cfg.leaderElection && !a.leaseHeld
+}
+
+// ReannounceAll restarts the gratuitous announcements for all the
+// announced IPs, as if they had just been set. It is meant for events
+// which may have flushed the neighbor caches of other hosts, like a
+// gateway reboot.
+func (a *Announce) ReannounceAll() {
+	a.RLock()
+	ips := a.ownedIPs(true, true)
+	a.RUnlock()
+
+	for _, ip := range ips {
+		a.doSpam(ip)
+	}
+}
+
+// AnnounceName returns true when we have an announcement under name.
+func (a *Announce) AnnounceName(name string) bool {
+	a.RLock()
+	defer a.RUnlock()
+	_, ok := a.ips[name]
+	_, cidr := a.cidrs[name]
+	return ok || cidr
+}
+
+// ipKey is the 16 bytes form of an IP, used as map key to avoid
+// formatting IPs as strings on lookups.
+type ipKey [net.IPv6len]byte
+
+func keyOf(ip net.IP) ipKey {
+	var k ipKey
+	copy(k[:], ip.To16())
+	return k
+}
+
+// IP returns a new net.IP holding k, normalized like normalizeIP.
+func (k ipKey) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, k[:])
+	return normalizeIP(ip)
+}
+
+// normalizeIP returns ip in a single representation: the 4 bytes form for
+// IPv4 addresses, including IPv4-mapped IPv6 ones, and the 16 bytes form
+// otherwise. The IPs are normalized when they are registered, so that the
+// same address given in both forms is a single IP to the announcer.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func copyIP(ip net.IP) net.IP {
+	return append(net.IP(nil), ip...)
+}
+
+// copyIPNets returns a deep copy of nets.
+func copyIPNets(nets []*net.IPNet) []*net.IPNet {
+	if len(nets) == 0 {
+		return nil
+	}
+	ret := make([]*net.IPNet, len(nets))
+	for i, n := range nets {
+		ret[i] = &net.IPNet{IP: copyIP(n.IP), Mask: append(net.IPMask(nil), n.Mask...)}
+	}
+	return ret
+}
+
+func copyIPs(ips []net.IP) []net.IP {
+	ret := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		ret[i] = copyIP(ip)
+	}
+	return ret
+}
+
+// DropReason is the reason why a layer2 protocol packet was not
+// responded to, as passed to the handler set with WithDropHandler.
+type DropReason int
+
+// Various reasons why a packet was dropped.
+const (
+	DropReasonNone DropReason = iota
+	DropReasonClosed
+	DropReasonError
+	DropReasonARPReply
+	DropReasonMessageType
+	DropReasonNoSourceLL
+	DropReasonEthernetDestination
+	DropReasonAnnounceIP
+	DropReasonRoutingNotReady
+	DropReasonSenderOffLink
+	DropReasonInterfaceRestricted
+	DropReasonDraining
+	DropReasonPaused
+	DropReasonOffSubnet
+	DropReasonACL
+	DropReasonARPProbe
+	DropReasonHandedOver
+	DropReasonSubnetMismatch
+	DropReasonLowerPriority
+	DropReasonSuppressed
+	DropReasonBondSlave
+	DropReasonGated
+	DropReasonNotLeader
+)
+
+// allDropReasons lists every DropReason, in order.
+var allDropReasons = []DropReason{
+	DropReasonNone,
+	DropReasonClosed,
+	DropReasonError,
+	DropReasonARPReply,
+	DropReasonMessageType,
+	DropReasonNoSourceLL,
+	DropReasonEthernetDestination,
+	DropReasonAnnounceIP,
+	DropReasonRoutingNotReady,
+	DropReasonSenderOffLink,
+	DropReasonInterfaceRestricted,
+	DropReasonDraining,
+	DropReasonPaused,
+	DropReasonOffSubnet,
+	DropReasonACL,
+	DropReasonARPProbe,
+	DropReasonHandedOver,
+	DropReasonSubnetMismatch,
+	DropReasonLowerPriority,
+	DropReasonSuppressed,
+	DropReasonBondSlave,
+	DropReasonGated,
+	DropReasonNotLeader,
+}
+
+func (d DropReason) String() string {
+	switch d {
+	case DropReasonNone:
+		return "none"
+	case DropReasonClosed:
+		return "closed"
+	case DropReasonError:
+		return "error"
+	case DropReasonARPReply:
+		return "arp_reply"
+	case DropReasonMessageType:
+		return "message_type"
+	case DropReasonNoSourceLL:
+		return "no_source_ll"
+	case DropReasonEthernetDestination:
+		return "ethernet_destination"
+	case DropReasonAnnounceIP:
+		return "announce_ip"
+	case DropReasonRoutingNotReady:
+		return "routing_not_ready"
+	case DropReasonSenderOffLink:
+		return "sender_off_link"
+	case DropReasonInterfaceRestricted:
+		return "interface_restricted"
+	case DropReasonDraining:
+		return "draining"
+	case DropReasonPaused:
+		return "paused"
+	case DropReasonOffSubnet:
+		return "off_subnet"
+	case DropReasonACL:
+		return "acl"
+	case DropReasonARPProbe:
+		return "arp_probe"
+	case DropReasonHandedOver:
+		return "handed_over"
+	case DropReasonSubnetMismatch:
+		return "subnet_mismatch"
+	case DropReasonLowerPriority:
+		return "lower_priority"
+	case DropReasonSuppressed:
+		return "suppressed"
+	case DropReasonBondSlave:
+		return "bond_slave"
+	case DropReasonGated:
+		return "gated"
+	case DropReasonNotLeader:
+		return "not_leader"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(d))
+	}
+}
+
+// byResponder tells whether the responders refuse requests for d on
+// their own, rather than because answerReason told them to. The replies
+// and advertisements, ours included, are not refused requests.
+func (d DropReason) byResponder() bool {
+	switch d {
+	case DropReasonError, DropReasonNoSourceLL, DropReasonEthernetDestination,
+		DropReasonSenderOffLink, DropReasonOffSubnet, DropReasonARPProbe:
+		return true
+	}
+	return false
+}
@@ -3,14 +3,26 @@
 package layer2
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
 )
 
 func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 	announce := &Announce{
 		ips:      map[string][]net.IP{},
-		ipRefcnt: map[string]int{},
+		ipRefcnt: map[ipKey]int{},
 		spamCh:   make(chan net.IP, 1),
 	}
 
@@ -42,3 +54,2886 @@ func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 		}
 	}
 }
+
+func Test_Configure(t *testing.T) {
+	announce := &Announce{
+		rescanCh: make(chan struct{}, 1),
+	}
+
+	if err := announce.Configure(WithInterfaceRoleFile("/etc/roles")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if announce.config().roleFile != "/etc/roles" {
+		t.Fatalf("role file not applied, got %q", announce.config().roleFile)
+	}
+	select {
+	case <-announce.rescanCh:
+	default:
+		t.Fatalf("no rescan requested after reconfiguring")
+	}
+
+	static := func(c *config) { c.static("static") }
+	if err := announce.Configure(WithInterfaceRoleFile("/etc/other"), static); err == nil {
+		t.Fatalf("expected error when changing a static option at runtime")
+	}
+	if announce.config().roleFile != "/etc/roles" {
+		t.Fatalf("options applied despite error, got role file %q", announce.config().roleFile)
+	}
+}
+
+func Test_SetRoutingReady(t *testing.T) {
+	announce := &Announce{
+		cfg:          config{waitRouting: true},
+		ips:          map[string][]net.IP{},
+		ipRefcnt:     map[ipKey]int{},
+		routingReady: map[ipKey]bool{},
+		spamCh:       make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonRoutingNotReady {
+		t.Fatalf("expected DropReasonRoutingNotReady before routing is ready, got %v", reason)
+	}
+
+	announce.SetRoutingReady(ip, true)
+	select {
+	case <-announce.spamCh:
+	default:
+		t.Fatalf("expected gratuitous announcements once routing is ready")
+	}
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonNone {
+		t.Fatalf("expected DropReasonNone once routing is ready, got %v", reason)
+	}
+
+	announce.SetRoutingReady(ip, false)
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonRoutingNotReady {
+		t.Fatalf("expected DropReasonRoutingNotReady after routing is withdrawn, got %v", reason)
+	}
+}
+
+func Test_AssumeLeadership(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 2),
+		spamCtl:  make(chan spamCmd),
+		done:     make(chan struct{}),
+	}
+	// Keep the next announcements of the spam windows out of the way.
+	WithSpamInterval(time.Minute)(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancerOpts("foo", v4, SetOpts{})
+	announce.SetBalancerOpts("foo", v6, SetOpts{})
+
+	if err := announce.AssumeLeadership("bar"); err != nil {
+		t.Fatalf("assuming leadership of an unknown service: %s", err)
+	}
+	if arp.gratuitousCount() != 0 || ndp.gratuitousCount() != 0 {
+		t.Fatalf("assuming leadership of an unknown service announced something")
+	}
+
+	if err := announce.AssumeLeadership("foo"); err != nil {
+		t.Fatalf("assuming leadership: %s", err)
+	}
+	// The announcements are sent before AssumeLeadership returns.
+	if arp.gratuitousCount() != 1 || ndp.gratuitousCount() != 1 {
+		t.Fatalf("expected the announcements to be sent synchronously, got %v and %v", arp.gratuitous, ndp.gratuitous)
+	}
+	// Leave time for a second burst from the spam loop.
+	time.Sleep(100 * time.Millisecond)
+	if arp.gratuitousCount() != 1 || !arp.gratuitous[0].Equal(v4) {
+		t.Fatalf("expected one immediate gratuitous ARP for the IPv4 address, got %v", arp.gratuitous)
+	}
+	if ndp.gratuitousCount() != 1 || !ndp.gratuitous[0].Equal(v6) {
+		t.Fatalf("expected one immediate gratuitous NDP for the IPv6 address, got %v", ndp.gratuitous)
+	}
+	if diff := cmp.Diff([]net.IP{v4, v6}, announce.ActiveSpamWindows()); diff != "" {
+		t.Errorf("expected both IPs to enter the spam window (-want +got)\n%s", diff)
+	}
+
+	// The spacing does not hold the announcements back.
+	if err := announce.Configure(WithMinGratuitousSpacing(time.Minute)); err != nil {
+		t.Fatalf("configuring the spacing: %s", err)
+	}
+	if err := announce.AssumeLeadership("foo"); err != nil {
+		t.Fatalf("assuming leadership again: %s", err)
+	}
+	if arp.gratuitousCount() != 2 || ndp.gratuitousCount() != 2 {
+		t.Fatalf("expected the spacing to be bypassed, got %v and %v", arp.gratuitous, ndp.gratuitous)
+	}
+
+	// An IP failing on every interface is reported.
+	arp.Lock()
+	arp.gratuitousErr = errors.New("send failed")
+	arp.Unlock()
+	err := announce.AssumeLeadership("foo")
+	if err == nil || !strings.Contains(err.Error(), v4.String()) || strings.Contains(err.Error(), v6.String()) {
+		t.Errorf("expected only %s to be reported, got %v", v4, err)
+	}
+	if ndp.gratuitousCount() != 3 {
+		t.Errorf("expected the IPv6 address to be announced anyway, got %v", ndp.gratuitous)
+	}
+}
+
+func Test_Close(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 2),
+		done:     make(chan struct{}),
+	}
+	announce.loops.Add(1)
+	go announce.spamLoop()
+
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+
+	closed := make(chan struct{})
+	go func() {
+		announce.Close()
+		announce.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close didn't return")
+	}
+
+	if !arp.closed || !ndp.closed {
+		t.Fatalf("responders were not closed")
+	}
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("responders were not removed")
+	}
+
+	// Setting balancers after Close neither hangs nor queues anything.
+	set := make(chan struct{})
+	go func() {
+		announce.SetBalancer("bar", net.IPv4(192, 168, 1, 21))
+		announce.SetBalancer("bar", net.IPv4(192, 168, 1, 22))
+		announce.SetBalancer("bar", net.IPv4(192, 168, 1, 23))
+		close(set)
+	}()
+	select {
+	case <-set:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetBalancer hung after Close")
+	}
+	if len(announce.spamCh) != 0 {
+		t.Fatalf("expected nothing to be queued after Close, got %d", len(announce.spamCh))
+	}
+}
+
+func Test_CloseOnContextDone(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		done:     make(chan struct{}),
+	}
+	announce.loops.Add(1)
+	go announce.spamLoop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan struct{})
+	go func() {
+		announce.closeOnDone(ctx)
+		close(returned)
+	}()
+	cancel()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("announcer was not closed when the context was cancelled")
+	}
+	if !announce.closed() || !arp.closed {
+		t.Fatalf("announcer was not closed when the context was cancelled")
+	}
+}
+
+func Test_DeleteBalancer_SharedIP(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+
+	shared := net.ParseIP("1000::1")
+	fooIP := net.ParseIP("1000::2")
+	barIP := net.ParseIP("1000::3")
+	for _, svc := range []struct {
+		name string
+		ip   net.IP
+	}{{"foo", shared}, {"foo", fooIP}, {"bar", shared}, {"bar", barIP}} {
+		announce.SetBalancer(svc.name, svc.ip)
+		<-announce.spamCh
+	}
+
+	announce.DeleteBalancer("foo")
+
+	if announce.ipRefcnt[keyOf(shared)] != 1 {
+		t.Fatalf("expected shared IP refcount 1, got %d", announce.ipRefcnt[keyOf(shared)])
+	}
+	if announce.ipRefcnt[keyOf(fooIP)] != 0 {
+		t.Fatalf("expected unique IP refcount 0, got %d", announce.ipRefcnt[keyOf(fooIP)])
+	}
+	if len(ndp.unwatched) != 1 || !ndp.unwatched[0].Equal(fooIP) {
+		t.Fatalf("expected only %s to be unwatched, got %v", fooIP, ndp.unwatched)
+	}
+}
+
+func Test_SetBalancer_Idempotent(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+
+	ip := net.IPv4(192, 168, 1, 20)
+	for i := 0; i < 5; i++ {
+		announce.SetBalancer("foo", ip)
+		<-announce.spamCh
+	}
+
+	if len(announce.ips["foo"]) != 1 {
+		t.Fatalf("expected 1 IP for service, got %v", announce.ips["foo"])
+	}
+	if announce.ipRefcnt[keyOf(ip)] != 1 {
+		t.Fatalf("expected refcount 1, got %d", announce.ipRefcnt[keyOf(ip)])
+	}
+}
+
+func Test_OverDelete(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	var released []net.IP
+	WithOwnershipChangeHandler(func(ip net.IP, owned bool) {
+		if !owned {
+			released = append(released, ip)
+		}
+	})(&announce.cfg)
+	ip := net.ParseIP("1000::1")
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+	// A bookkeeping slip lets a second service hold ip without counting
+	// it.
+	announce.ips["bar"] = []net.IP{ip}
+
+	announce.DeleteBalancer("foo")
+	announce.DeleteBalancer("bar")
+	announce.DeleteBalancer("bar")
+	announce.DeleteBalancerIP("foo", ip)
+	if got := announce.ipRefcnt[keyOf(ip)]; got != 0 {
+		t.Fatalf("expected refcount 0 after over-deleting, got %d", got)
+	}
+	if announce.AnnounceIP(ip) || announce.shouldAnnounce(ip, "eth0") == DropReasonNone {
+		t.Errorf("expected %s to be no longer announced", ip)
+	}
+	if diff := cmp.Diff([]string{"unwatch 1000::1", "withdraw 1000::1"}, ndp.ops); diff != "" {
+		t.Errorf("expected %s to be released once (-want +got)\n%s", ip, diff)
+	}
+	if len(released) != 1 {
+		t.Errorf("expected one ownership loss, got %v", released)
+	}
+
+	// The IP is owned again as soon as it is set again.
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+	if announce.RefCount(ip) != 1 || announce.shouldAnnounce(ip, "eth0") != DropReasonNone {
+		t.Errorf("expected %s to be announced again, refcount %d", ip, announce.RefCount(ip))
+	}
+}
+
+func Test_NewNDPResponderWatchesAnnouncedIPs(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	v6 := net.ParseIP("1000::1")
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+	<-announce.spamCh
+	announce.SetBalancer("foo", v6)
+	<-announce.spamCh
+
+	// An interface appears after the IPs were registered.
+	ndp := &fakeResponder{intf: "eth0"}
+	announce.watchAnnounced(announce.logger, ndp)
+
+	if len(ndp.watched) != 1 || !ndp.watched[0].Equal(v6) {
+		t.Fatalf("expected new responder to watch %s, got %v", v6, ndp.watched)
+	}
+}
+
+func Test_GetAnnouncements(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	for _, svc := range []struct {
+		name string
+		ip   net.IP
+	}{
+		{"foo", net.IPv4(192, 168, 1, 20)},
+		{"foo", net.ParseIP("1000::1")},
+		{"bar", net.IPv4(192, 168, 1, 20)},
+	} {
+		announce.SetBalancer(svc.name, svc.ip)
+		<-announce.spamCh
+	}
+
+	got := announce.GetAnnouncements()
+	want := map[string][]net.IP{
+		"foo": {net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")},
+		"bar": {net.IPv4(192, 168, 1, 20)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected announcements (-want +got)\n%s", diff)
+	}
+
+	// Mutating the result must not affect the announcer.
+	got["foo"][0][len(got["foo"][0])-1] = 99
+	got["bar"] = nil
+	if diff := cmp.Diff(want, announce.GetAnnouncements()); diff != "" {
+		t.Fatalf("announcements changed by caller (-want +got)\n%s", diff)
+	}
+
+	ips := announce.AnnouncedIPs()
+	wantIPs := []net.IP{net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")}
+	if diff := cmp.Diff(wantIPs, ips); diff != "" {
+		t.Fatalf("unexpected announced IPs (-want +got)\n%s", diff)
+	}
+
+	fooIPs, ok := announce.GetIPsForName("foo")
+	if !ok {
+		t.Fatalf("expected foo to be known")
+	}
+	if diff := cmp.Diff(want["foo"], fooIPs); diff != "" {
+		t.Fatalf("unexpected IPs for foo (-want +got)\n%s", diff)
+	}
+	fooIPs[0][len(fooIPs[0])-1] = 99
+	fooIPs[1] = nil
+	if again, _ := announce.GetIPsForName("foo"); !cmp.Equal(want["foo"], again) {
+		t.Fatalf("IPs of foo changed by caller, got %v", again)
+	}
+	if ips, ok := announce.GetIPsForName("baz"); ok || ips != nil {
+		t.Fatalf("expected no IPs for an unknown service, got %v", ips)
+	}
+}
+
+func Test_AnnounceIP(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20).To4())
+	<-announce.spamCh
+	announce.SetBalancer("foo", net.ParseIP("1000::1"))
+	<-announce.spamCh
+
+	tests := []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.IPv4(192, 168, 1, 20), true},
+		{net.IPv4(192, 168, 1, 20).To4(), true},
+		{net.ParseIP("::ffff:192.168.1.20"), true},
+		{net.ParseIP("1000:0:0:0:0:0:0:1"), true},
+		{net.ParseIP("1000::2"), false},
+		{net.IPv4(192, 168, 1, 21), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := announce.AnnounceIP(tt.ip); got != tt.want {
+			t.Errorf("AnnounceIP(%s): expected %v, got %v", tt.ip, tt.want, got)
+		}
+	}
+
+	announce.DeleteBalancer("foo")
+	if announce.AnnounceIP(net.IPv4(192, 168, 1, 20)) {
+		t.Errorf("IP still announced after deleting its service")
+	}
+}
+
+func Test_SpamInterval(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		done:     make(chan struct{}),
+	}
+	WithSpamInterval(100 * time.Millisecond)(&announce.cfg)
+	WithSpamDuration(450 * time.Millisecond)(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+	time.Sleep(time.Second)
+
+	// One announcement right away, then one on each tick at 100, 200, 300
+	// and 400ms. Allow for a tick of slack on slow machines.
+	if got := arp.gratuitousCount(); got < 4 || got > 6 {
+		t.Fatalf("expected about 5 gratuitous announcements, got %d", got)
+	}
+}
+
+func Test_SpamCompleteHandler(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		done:     make(chan struct{}),
+	}
+	completed := make(chan net.IP, 10)
+	WithSpamInterval(100 * time.Millisecond)(&announce.cfg)
+	WithSpamDuration(200 * time.Millisecond)(&announce.cfg)
+	WithSpamCompleteHandler(func(ip net.IP) { completed <- ip })(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	select {
+	case got := <-completed:
+		if !got.Equal(ip) {
+			t.Fatalf("expected the announcements of %s to complete, got %s", ip, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the spam complete handler was not called")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := len(completed); n != 0 {
+		t.Errorf("expected the handler to be called once, got %d more calls", n)
+	}
+}
+
+func Test_CancelSpam(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		spamCtl:  make(chan spamCmd),
+		done:     make(chan struct{}),
+	}
+	WithSpamInterval(100 * time.Millisecond)(&announce.cfg)
+	WithSpamDuration(time.Minute)(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	deadline := time.Now().Add(5 * time.Second)
+	for arp.gratuitousCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not announced", ip)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if diff := cmp.Diff([]net.IP{ip.To4()}, announce.ActiveSpamWindows()); diff != "" {
+		t.Errorf("unexpected spam windows (-want +got)\n%s", diff)
+	}
+
+	if !announce.CancelSpam(ip) {
+		t.Errorf("expected the spam window of %s to be cancelled", ip)
+	}
+	sent := arp.gratuitousCount()
+	time.Sleep(300 * time.Millisecond)
+	if got := arp.gratuitousCount(); got != sent {
+		t.Errorf("expected the announcements to stop, got %d more", got-sent)
+	}
+	if got := announce.ActiveSpamWindows(); len(got) != 0 {
+		t.Errorf("expected no spam window, got %v", got)
+	}
+	if announce.CancelSpam(ip) {
+		t.Errorf("expected nothing to cancel")
+	}
+	if !announce.AnnounceIP(ip) {
+		t.Errorf("expected %s to stay announced", ip)
+	}
+
+	announce.Close()
+	if got := announce.ActiveSpamWindows(); got != nil {
+		t.Errorf("expected no spam window once closed, got %v", got)
+	}
+}
+
+func Test_Flush(t *testing.T) {
+	arp, ndp := &fakeResponder{intf: "eth0"}, &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		arps:      map[string]responder{"eth0": arp},
+		ndps:      map[string]watchingResponder{"eth0": ndp},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+		spamCtl:   make(chan spamCmd),
+		done:      make(chan struct{}),
+	}
+	WithSpamInterval(100 * time.Millisecond)(&announce.cfg)
+	WithSpamDuration(time.Minute)(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	announce.SetBalancer("bar", v4)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(announce.ActiveSpamWindows()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the IPs were not announced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	announce.Flush()
+	for _, ip := range []net.IP{v4, v6} {
+		if got := announce.RefCount(ip); got != 0 {
+			t.Errorf("expected no refcount for %s, got %d", ip, got)
+		}
+		if got := announce.shouldAnnounce(ip, "eth0"); got == DropReasonNone {
+			t.Errorf("expected %s not to be answered for", ip)
+		}
+	}
+	if got := announce.GetAnnouncements(); len(got) != 0 {
+		t.Errorf("expected no services, got %v", got)
+	}
+	if got := announce.ActiveSpamWindows(); len(got) != 0 {
+		t.Errorf("expected no spam window, got %v", got)
+	}
+	ndp.Lock()
+	if diff := cmp.Diff([]string{"unwatch 1000::1"}, ndp.ops); diff != "" {
+		t.Errorf("unexpected NDP operations (-want +got)\n%s", diff)
+	}
+	ndp.Unlock()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 || arp.closed || ndp.closed {
+		t.Error("expected the responders to be kept")
+	}
+
+	// The announcer keeps working.
+	announce.SetBalancer("foo", v4)
+	if got := announce.RefCount(v4); got != 1 {
+		t.Errorf("expected a refcount of 1 for %s, got %d", v4, got)
+	}
+}
+
+// onceScheduler announces IPs once, when they are scheduled.
+type onceScheduler struct{}
+
+func (onceScheduler) Schedule(net.IP, time.Time) bool { return true }
+
+func (onceScheduler) Next() (time.Time, bool) { return time.Time{}, false }
+
+func (onceScheduler) Due(time.Time) []net.IP { return nil }
+
+func Test_Keepalive(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		done:     make(chan struct{}),
+	}
+	// Only count the announcements made when the IPs are scheduled.
+	WithScheduler(onceScheduler{})(&announce.cfg)
+	announce.loops.Add(2)
+	go announce.spamLoop()
+	go announce.keepaliveLoop(200 * time.Millisecond)
+	defer announce.Close()
+
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+	time.Sleep(time.Second)
+
+	// One announcement right away, then one per keepalive at 200, 400,
+	// 600 and 800ms. Allow for a keepalive of slack on slow machines.
+	if got := arp.gratuitousCount(); got < 4 || got > 6 {
+		t.Fatalf("expected about 5 gratuitous announcements, got %d", got)
+	}
+}
+
+func Test_GratuitousRateLimit(t *testing.T) {
+	const (
+		perSecond = 200
+		burst     = 10
+		n         = 100
+	)
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, n),
+		done:     make(chan struct{}),
+		limiter:  rate.NewLimiter(perSecond, burst),
+	}
+	// Only count the announcements made when the IPs are scheduled.
+	WithScheduler(onceScheduler{})(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		announce.SetBalancer(fmt.Sprintf("svc-%d", i), net.IPv4(10, 0, 0, byte(i+1)))
+	}
+	time.Sleep(200 * time.Millisecond)
+	got := arp.gratuitousCount()
+	if max := burst + int(perSecond*time.Since(start).Seconds()) + 1; got > max {
+		t.Errorf("expected at most %d announcements after %s, got %d", max, time.Since(start), got)
+	}
+	if got == n {
+		t.Errorf("expected the announcements to be spread over time")
+	}
+
+	// The delayed announcements are sent eventually, once each.
+	deadline := time.Now().Add(5 * time.Second)
+	for arp.gratuitousCount() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := arp.gratuitousCount(); got != n {
+		t.Fatalf("expected %d announcements, got %d", n, got)
+	}
+}
+
+func Test_GratuitousRateLimitInterfaces(t *testing.T) {
+	const (
+		perSecond = 50
+		n         = 20
+	)
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, n),
+		done:     make(chan struct{}),
+		limiter:  rate.NewLimiter(perSecond, 1),
+	}
+	var arps []*fakeResponder
+	for i := 0; i < 5; i++ {
+		arp := &fakeResponder{intf: fmt.Sprintf("eth%d", i)}
+		announce.arps[arp.intf] = arp
+		arps = append(arps, arp)
+	}
+	WithScheduler(onceScheduler{})(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		announce.SetBalancer(fmt.Sprintf("svc-%d", i), net.IPv4(10, 0, 0, byte(i+1)))
+	}
+	time.Sleep(200 * time.Millisecond)
+	got := 0
+	for _, arp := range arps {
+		got += arp.gratuitousCount()
+	}
+	// Every packet counts, although the burst is smaller than the
+	// number of interfaces. One IP may be sent beyond the limit.
+	if max := len(arps) + int(perSecond*time.Since(start).Seconds()) + len(arps); got > max {
+		t.Errorf("expected at most %d packets after %s, got %d", max, time.Since(start), got)
+	}
+	if got == 0 {
+		t.Errorf("expected the first IP to be announced right away")
+	}
+}
+
+func Test_MinGratuitousSpacing(t *testing.T) {
+	const spacing = 200 * time.Millisecond
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		done:     make(chan struct{}),
+	}
+	// Only count the announcements made when the IPs are scheduled.
+	WithScheduler(onceScheduler{})(&announce.cfg)
+	WithMinGratuitousSpacing(spacing)(&announce.cfg)
+	announce.loops.Add(1)
+	go announce.spamLoop()
+	defer announce.Close()
+
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		announce.ReannounceAll()
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	// The triggers coming too early are coalesced and sent at the end of
+	// the spacing.
+	time.Sleep(2 * spacing)
+	got := arp.gratuitousCount()
+	if max := 2 + int(elapsed/spacing); got > max {
+		t.Errorf("expected at most %d announcements in %s, got %d", max, elapsed, got)
+	}
+	if got < 2 {
+		t.Errorf("expected the coalesced announcements to be sent, got %d", got)
+	}
+	time.Sleep(2 * spacing)
+	if after := arp.gratuitousCount(); after != got {
+		t.Errorf("expected no more announcements, got %d", after-got)
+	}
+}
+
+func Test_ConfigureGratuitousRateLimit(t *testing.T) {
+	announce := &Announce{
+		logger:  log.NewNopLogger(),
+		limiter: rate.NewLimiter((&config{}).rateLimit()),
+	}
+	if !announce.allowGratuitous(100) {
+		t.Fatal("expected no limit by default")
+	}
+
+	if err := announce.Configure(WithGratuitousRateLimit(1, 2)); err != nil {
+		t.Fatalf("setting the rate limit at runtime: %s", err)
+	}
+	if got, burst := announce.limiter.Limit(), announce.limiter.Burst(); got != 1 || burst != 2 {
+		t.Errorf("expected a limit of 1 with bursts of 2, got %v and %d", got, burst)
+	}
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if announce.allowGratuitous(1) {
+			allowed++
+		}
+	}
+	if allowed > 2 {
+		t.Errorf("expected at most a burst of 2 announcements, got %d", allowed)
+	}
+
+	if err := announce.Configure(WithGratuitousRateLimit(0, 0)); err != nil {
+		t.Fatalf("disabling the rate limit at runtime: %s", err)
+	}
+	if !announce.allowGratuitous(100) {
+		t.Error("expected no limit once disabled")
+	}
+}
+
+func Test_Repeat(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+
+	if err := announce.Repeat(ip); err == nil {
+		t.Fatalf("expected an error repeating an IP we don't own")
+	}
+	if len(announce.spamCh) != 0 {
+		t.Fatalf("IP we don't own was spammed")
+	}
+
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+	if err := announce.Repeat(ip); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := <-announce.spamCh; !got.Equal(ip) {
+		t.Fatalf("expected %s to be spammed, got %s", ip, got)
+	}
+}
+
+func Test_RepeatCtx(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+
+	if err := announce.RepeatCtx(context.Background(), ip); err == nil {
+		t.Fatalf("expected an error repeating an IP we don't own")
+	}
+
+	// The spam channel is full after SetBalancer.
+	announce.SetBalancer("foo", ip)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	dropped := ptu.ToFloat64(stats.spamDropped)
+	if err := announce.RepeatCtx(ctx, ip); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if v := ptu.ToFloat64(stats.spamDropped); v != dropped {
+		t.Errorf("expected the canceled announcements not to be counted as dropped, got %v more", v-dropped)
+	}
+
+	go func() {
+		<-announce.spamCh
+	}()
+	if err := announce.RepeatCtx(context.Background(), ip); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := <-announce.spamCh; !got.Equal(ip) || len(got) != net.IPv4len {
+		t.Fatalf("expected %s to be spammed in its 4-byte form, got %#v", ip, got)
+	}
+
+	if err := announce.RepeatCtx(context.Background(), net.IP{1, 2, 3}); err == nil {
+		t.Errorf("expected an error repeating an invalid IP")
+	}
+}
+
+func Test_Probe(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	announce.updateInterfaces()
+	ip := net.IPv4(192, 168, 1, 20)
+
+	// Nobody answers.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	inUse, mac, err := announce.Probe(ctx, ip)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if inUse || mac != nil {
+		t.Fatalf("expected %s not to be in use, got %s", ip, mac)
+	}
+
+	// Another host answers the probe.
+	owner := net.HardwareAddr{2, 0, 0, 0, 0, 0x42}
+	factory.arps[0].Lock()
+	factory.arps[0].onSolicit = func(ip net.IP) {
+		announce.conflict(ip, owner, "eth0")
+	}
+	factory.arps[0].Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inUse, mac, err = announce.Probe(ctx, ip)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !inUse {
+		t.Fatalf("expected %s to be in use", ip)
+	}
+	if diff := cmp.Diff(owner, mac); diff != "" {
+		t.Fatalf("unexpected owner (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]net.IP{ip.To4(), ip.To4()}, factory.arps[0].solicited); diff != "" {
+		t.Fatalf("unexpected probes (-want +got)\n%s", diff)
+	}
+	if len(factory.ndps[0].solicited) != 0 {
+		t.Fatalf("expected no NDP probe, got %v", factory.ndps[0].solicited)
+	}
+	if len(announce.probes) != 0 {
+		t.Fatalf("expected the pending probes to be cleaned up, got %v", announce.probes)
+	}
+}
+
+func Test_SetBalancerReplace(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	a, b, c := net.ParseIP("1000::a"), net.ParseIP("1000::b"), net.ParseIP("1000::c")
+	announce.SetBalancerIPs("foo", []net.IP{a, b})
+	for len(announce.spamCh) > 0 {
+		<-announce.spamCh
+	}
+	ndp.watched = nil
+
+	announce.SetBalancerReplace("foo", []net.IP{b, c})
+	for ip, want := range map[string]int{"1000::a": 0, "1000::b": 1, "1000::c": 1} {
+		if got := announce.RefCount(net.ParseIP(ip)); got != want {
+			t.Errorf("expected a refcount of %d for %s, got %d", want, ip, got)
+		}
+	}
+	if diff := cmp.Diff([]net.IP{b, c}, announce.ips["foo"]); diff != "" {
+		t.Errorf("unexpected IPs (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]net.IP{c}, ndp.watched); diff != "" {
+		t.Errorf("unexpected watches (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]net.IP{a}, ndp.unwatched); diff != "" {
+		t.Errorf("unexpected unwatches (-want +got)\n%s", diff)
+	}
+	if n := len(announce.spamCh); n != 1 {
+		t.Fatalf("expected only the added IP to be announced, got %d IPs", n)
+	}
+	if got := <-announce.spamCh; !got.Equal(c) {
+		t.Errorf("expected %s to be announced, got %s", c, got)
+	}
+
+	// An empty set forgets the service.
+	announce.SetBalancerReplace("foo", nil)
+	if _, ok := announce.ips["foo"]; ok {
+		t.Errorf("expected the service to be forgotten, got %v", announce.ips["foo"])
+	}
+	if announce.RefCount(b) != 0 || announce.RefCount(c) != 0 {
+		t.Errorf("expected all the IPs to be released")
+	}
+}
+
+func Test_NameForIP(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	shared, own := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancer("foo", shared)
+	announce.SetBalancerIPs("bar", []net.IP{own, shared})
+
+	tests := []struct {
+		ip   net.IP
+		want []string
+	}{
+		{shared, []string{"bar", "foo"}},
+		{shared.To4(), []string{"bar", "foo"}},
+		{own, []string{"bar"}},
+		{net.IPv4(192, 168, 1, 21), nil},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, announce.NameForIP(test.ip)); diff != "" {
+			t.Errorf("unexpected names for %s (-want +got)\n%s", test.ip, diff)
+		}
+	}
+}
+
+func Test_RefCount(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+	if got := announce.RefCount(ip); got != 0 {
+		t.Fatalf("expected no reference to an unknown IP, got %d", got)
+	}
+
+	announce.SetBalancer("foo", ip)
+	announce.SetBalancer("bar", ip.To4())
+	if got := announce.RefCount(ip); got != 2 {
+		t.Fatalf("expected 2 references, got %d", got)
+	}
+
+	announce.DeleteBalancer("foo")
+	if got := announce.RefCount(ip); got != 1 {
+		t.Fatalf("expected 1 reference after deleting foo, got %d", got)
+	}
+	if diff := cmp.Diff([]string{"bar"}, announce.NameForIP(ip)); diff != "" {
+		t.Errorf("unexpected names (-want +got)\n%s", diff)
+	}
+}
+
+func Test_DisabledFamilies(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	WithDisabledFamilies(true, false)(&announce.cfg)
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+
+	if err := announce.SetBalancerE("foo", v4); err == nil {
+		t.Errorf("expected an error registering an IPv4 address")
+	}
+	announce.SetBalancerIPs("bar", []net.IP{v4, v6})
+	announce.LoadState(map[string][]net.IP{"baz": {v4}})
+
+	if diff := cmp.Diff([]net.IP{v6}, announce.OwnedIPs()); diff != "" {
+		t.Errorf("unexpected owned IPs (-want +got)\n%s", diff)
+	}
+	if announce.AnnounceIP(v4) {
+		t.Errorf("expected %s not to be announced", v4)
+	}
+
+	// The registered IPs would stay announced if IPv6 was turned off.
+	if err := announce.Configure(WithDisabledFamilies(false, true)); err == nil {
+		t.Errorf("expected an error changing the disabled families at runtime")
+	}
+	if cfg := announce.config(); !cfg.disableV4 || cfg.disableV6 {
+		t.Errorf("expected the disabled families to be kept, got v4 %v and v6 %v", cfg.disableV4, cfg.disableV6)
+	}
+}
+
+func Test_OwnedIPs(t *testing.T) {
+	announce := &Announce{
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	for _, ip := range []net.IP{v4, v6, net.ParseIP("1000::2")} {
+		announce.SetBalancer("foo", ip)
+		<-announce.spamCh
+	}
+	announce.SetBalancer("bar", net.IPv4(192, 168, 1, 21))
+	<-announce.spamCh
+	announce.DeleteBalancer("bar")
+
+	if got := announce.ownedIPs(false, false); len(got) != 0 {
+		t.Errorf("expected no IPs when no family is new, got %v", got)
+	}
+	if got := announce.ownedIPs(true, false); len(got) != 1 || !got[0].Equal(v4) {
+		t.Errorf("expected only %s for a new ARP responder, got %v", v4, got)
+	}
+	if got := announce.ownedIPs(false, true); len(got) != 2 {
+		t.Errorf("expected both IPv6 addresses for a new NDP responder, got %v", got)
+	}
+	if got := announce.ownedIPs(true, true); len(got) != 3 {
+		t.Errorf("expected all owned IPs, got %v", got)
+	}
+}
+
+func Test_SetBalancerWithInterfaces(t *testing.T) {
+	eth0 := &fakeResponder{intf: "eth0"}
+	eth1 := &fakeResponder{intf: "eth1"}
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		arps:      map[string]responder{"eth0": eth0, "eth1": eth1},
+		ndps:      map[string]watchingResponder{},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+
+	announce.SetBalancerWithInterfaces("foo", ip, []string{"eth1"})
+	<-announce.spamCh
+	announce.gratuitous(ip)
+	if eth0.gratuitousCount() != 0 || eth1.gratuitousCount() != 1 {
+		t.Fatalf("expected announcements on eth1 only, got eth0=%d eth1=%d", eth0.gratuitousCount(), eth1.gratuitousCount())
+	}
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonInterfaceRestricted {
+		t.Errorf("expected DropReasonInterfaceRestricted on eth0, got %v", reason)
+	}
+	if reason := announce.shouldAnnounce(ip, "eth1"); reason != DropReasonNone {
+		t.Errorf("expected DropReasonNone on eth1, got %v", reason)
+	}
+
+	// A second, unrestricted service sharing the IP opens all interfaces.
+	announce.SetBalancer("bar", ip)
+	<-announce.spamCh
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonNone {
+		t.Errorf("expected DropReasonNone on eth0 with a shared unrestricted service, got %v", reason)
+	}
+	announce.DeleteBalancer("bar")
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonInterfaceRestricted {
+		t.Errorf("expected DropReasonInterfaceRestricted on eth0 once bar is gone, got %v", reason)
+	}
+
+	// An empty list lifts the restriction.
+	announce.SetBalancerWithInterfaces("foo", ip, nil)
+	<-announce.spamCh
+	if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonNone {
+		t.Errorf("expected DropReasonNone on eth0 without restriction, got %v", reason)
+	}
+	announce.DeleteBalancer("foo")
+	if len(announce.svcIfaces) != 0 {
+		t.Errorf("expected interface restrictions to be dropped with the service, got %v", announce.svcIfaces)
+	}
+}
+
+func Test_Drain(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 2),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancer("foo", v4)
+	announce.SetBalancer("foo", v6)
+	<-announce.spamCh
+	<-announce.spamCh
+
+	announce.Drain()
+	if !announce.Draining() {
+		t.Fatalf("expected the announcer to be draining")
+	}
+	if len(ndp.unwatched) != 1 || !ndp.unwatched[0].Equal(v6) {
+		t.Fatalf("expected %s to be unwatched, got %v", v6, ndp.unwatched)
+	}
+	if reason := announce.shouldAnnounce(v4, "eth0"); reason != DropReasonDraining {
+		t.Errorf("expected DropReasonDraining, got %v", reason)
+	}
+	announce.gratuitous(v4)
+	announce.AssumeLeadership("foo")
+	if arp.gratuitousCount() != 0 || ndp.gratuitousCount() != 0 || len(announce.spamCh) != 0 {
+		t.Errorf("expected no gratuitous announcements while draining")
+	}
+	if !announce.AnnounceName("foo") {
+		t.Errorf("expected the services to be kept while draining")
+	}
+
+	announce.Undrain()
+	if announce.Draining() {
+		t.Fatalf("expected the announcer to stop draining")
+	}
+	if n := len(ndp.watched); n != 3 || !ndp.watched[n-1].Equal(v6) {
+		t.Errorf("expected %s to be watched again, got %v", v6, ndp.watched)
+	}
+	if reason := announce.shouldAnnounce(v4, "eth0"); reason != DropReasonNone {
+		t.Errorf("expected DropReasonNone, got %v", reason)
+	}
+	if len(announce.spamCh) != 2 {
+		t.Errorf("expected both IPs to be announced again, got %d", len(announce.spamCh))
+	}
+}
+
+func Test_Pause(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 2),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancer("foo", v4)
+	announce.SetBalancer("foo", v6)
+	<-announce.spamCh
+	<-announce.spamCh
+
+	announce.Pause()
+	if !announce.Paused() {
+		t.Fatalf("expected the announcer to be paused")
+	}
+	if reason := announce.shouldAnnounce(v4, "eth0"); reason != DropReasonPaused {
+		t.Errorf("expected DropReasonPaused, got %v", reason)
+	}
+	announce.gratuitous(v4)
+	announce.gratuitous(v6)
+	if arp.gratuitousCount() != 0 || ndp.gratuitousCount() != 0 {
+		t.Errorf("expected no gratuitous announcements while paused")
+	}
+	if len(ndp.unwatched) != 0 {
+		t.Errorf("expected the multicast groups to be kept while paused, got %v", ndp.unwatched)
+	}
+
+	announce.Resume()
+	if announce.Paused() {
+		t.Fatalf("expected the announcer to be resumed")
+	}
+	if reason := announce.shouldAnnounce(v4, "eth0"); reason != DropReasonNone {
+		t.Errorf("expected DropReasonNone, got %v", reason)
+	}
+	announce.gratuitous(v4)
+	if arp.gratuitousCount() != 1 {
+		t.Errorf("expected 1 gratuitous announcement after resuming, got %d", arp.gratuitousCount())
+	}
+}
+
+func Test_RequesterACL(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+	}
+	inside, outside := net.IPv4(10, 0, 1, 5), net.IPv4(192, 168, 1, 5)
+	v6 := net.ParseIP("2001:db8::5")
+
+	// An empty ACL allows all.
+	for _, ip := range []net.IP{inside, outside, v6} {
+		if got := announce.allowRequester(ip); got != DropReasonNone {
+			t.Errorf("expected %s to be allowed without ACL, got %v", ip, got)
+		}
+	}
+
+	acl := []*net.IPNet{mustCIDR("10.0.1.0/24"), mustCIDR("2001:db8::/64")}
+	WithRequesterACL(acl)(&announce.cfg)
+	// The ACL is a snapshot.
+	acl[0].IP = net.IPv4(192, 168, 1, 0)
+	for ip, want := range map[string]DropReason{
+		inside.String():  DropReasonNone,
+		v6.String():      DropReasonNone,
+		outside.String(): DropReasonACL,
+		"2001:db9::5":    DropReasonACL,
+	} {
+		if got := announce.allowRequester(net.ParseIP(ip)); got != want {
+			t.Errorf("expected %v for %s, got %v", want, ip, got)
+		}
+	}
+
+	announce.SetRequesterACL([]*net.IPNet{mustCIDR("192.168.1.0/24")})
+	if got := announce.allowRequester(outside); got != DropReasonNone {
+		t.Errorf("expected %s to be allowed by the new ACL, got %v", outside, got)
+	}
+	if got := announce.allowRequester(inside); got != DropReasonACL {
+		t.Errorf("expected %s to be denied by the new ACL, got %v", inside, got)
+	}
+
+	announce.SetRequesterACL(nil)
+	if got := announce.allowRequester(inside); got != DropReasonNone {
+		t.Errorf("expected %s to be allowed after clearing the ACL, got %v", inside, got)
+	}
+}
+
+func Test_AnswerReason(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	lister := announce.lister.(*fakeLister)
+	lister.ifs = append(lister.ifs, net.Interface{
+		Index:        2,
+		Name:         "eth1",
+		Flags:        net.FlagUp | net.FlagBroadcast,
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2},
+	})
+	lister.addrs["eth1"] = []net.Addr{mustCIDR("192.168.1.3/24")}
+	announce.updateInterfaces()
+	ip, offSubnet := net.IPv4(192, 168, 1, 20), net.IPv4(10, 0, 0, 20)
+	announce.SetBalancer("foo", ip)
+	announce.SetBalancer("bar", offSubnet)
+	requester := net.IPv4(192, 168, 1, 1)
+
+	tests := []struct {
+		desc  string
+		setup func()
+		ip    net.IP
+		// probe makes the request come without a requester.
+		probe bool
+		want  DropReason
+	}{
+		{
+			desc: "answered",
+			want: DropReasonNone,
+		},
+		{
+			desc: "not announced",
+			ip:   net.IPv4(192, 168, 1, 99),
+			want: DropReasonAnnounceIP,
+		},
+		{
+			desc:  "paused",
+			setup: announce.Pause,
+			want:  DropReasonPaused,
+		},
+		{
+			desc:  "draining",
+			setup: announce.Drain,
+			want:  DropReasonDraining,
+		},
+		{
+			desc:  "interface restricted",
+			setup: func() { announce.SetBalancerWithInterfaces("foo", ip, []string{"eth1"}) },
+			want:  DropReasonInterfaceRestricted,
+		},
+		{
+			desc:  "subnet mismatch",
+			setup: func() { announce.Configure(WithOnlyMatchingSubnet(true)) },
+			ip:    offSubnet,
+			want:  DropReasonSubnetMismatch,
+		},
+		{
+			desc:  "lower priority",
+			setup: func() { announce.Configure(WithInterfacePriority(map[string]int{"eth1": 10})) },
+			want:  DropReasonLowerPriority,
+		},
+		{
+			desc:  "requester denied",
+			setup: func() { announce.SetRequesterACL([]*net.IPNet{mustCIDR("10.0.0.0/8")}) },
+			want:  DropReasonACL,
+		},
+		{
+			desc:  "no requester to filter",
+			setup: func() { announce.SetRequesterACL([]*net.IPNet{mustCIDR("10.0.0.0/8")}) },
+			probe: true,
+			want:  DropReasonNone,
+		},
+	}
+	for _, test := range tests {
+		announce.Resume()
+		announce.Undrain()
+		announce.SetBalancerWithInterfaces("foo", ip, nil)
+		announce.Configure(WithOnlyMatchingSubnet(false), WithInterfacePriority(nil))
+		announce.SetRequesterACL(nil)
+		if test.setup != nil {
+			test.setup()
+		}
+		if test.ip == nil {
+			test.ip = ip
+		}
+		from := requester
+		if test.probe {
+			from = nil
+		}
+		if got := announce.answerReason(test.ip, "eth0", from); got != test.want {
+			t.Errorf("%s: want %s, got %s", test.desc, test.want, got)
+		}
+	}
+}
+
+func Test_RecentDrops(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	WithRecentDrops(3)(&announce.cfg)
+	ip, other := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21)
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+	announce.SetRequesterACL([]*net.IPNet{mustCIDR("192.168.1.0/24")})
+	requester, outsider := net.IPv4(192, 168, 1, 1), net.IPv4(10, 0, 0, 1)
+
+	before := time.Now()
+	// Answered requests and the requests for other IPs are not kept.
+	announce.answerReason(ip, "eth0", requester)
+	announce.answerReason(other, "eth0", requester)
+	announce.answerReason(ip, "eth0", outsider)
+	announce.Pause()
+	announce.answerReason(ip, "eth1", requester)
+	announce.answerReason(ip, "eth0", nil)
+	announce.Resume()
+	announce.Suppress(ip)
+	announce.answerReason(ip, "eth1", requester)
+
+	got := announce.RecentDrops(ip)
+	for i, ev := range got {
+		if ev.Time.Before(before) || i > 0 && ev.Time.Before(got[i-1].Time) {
+			t.Errorf("unexpected time for drop %d: %s", i, ev.Time)
+		}
+		got[i].Time = time.Time{}
+	}
+	// The oldest drop was evicted.
+	want := []DropEvent{
+		{Interface: "eth1", Reason: DropReasonPaused, Requester: requester},
+		{Interface: "eth0", Reason: DropReasonPaused},
+		{Interface: "eth1", Reason: DropReasonSuppressed, Requester: requester},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected drops (-want +got)\n%s", diff)
+	}
+	if got := announce.RecentDrops(other); got != nil {
+		t.Errorf("expected no drops for %s, got %v", other, got)
+	}
+
+	// The requests refused by the responders are kept too, the others
+	// were kept by answerReason already.
+	announce.dropped(ip, "eth0", requester, DropReasonSenderOffLink)
+	announce.dropped(ip, "eth1", requester, DropReasonSuppressed)
+	// The replies for the IP, like our own gratuitous ones, aren't
+	// refused requests.
+	announce.dropped(ip, "eth0", nil, DropReasonARPReply)
+	announce.dropped(ip, "eth0", nil, DropReasonMessageType)
+	got = announce.RecentDrops(ip)
+	for i := range got {
+		got[i].Time = time.Time{}
+	}
+	want = []DropEvent{
+		{Interface: "eth0", Reason: DropReasonPaused},
+		{Interface: "eth1", Reason: DropReasonSuppressed, Requester: requester},
+		{Interface: "eth0", Reason: DropReasonSenderOffLink, Requester: requester},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected drops after the responder drops (-want +got)\n%s", diff)
+	}
+
+	// The drops are forgotten along with the IP.
+	announce.DeleteBalancer("foo")
+	if got := announce.RecentDrops(ip); got != nil {
+		t.Errorf("expected no drops after the IP was released, got %v", got)
+	}
+}
+
+func Test_LoadState(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	v4, v6, shared := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1"), net.ParseIP("1000::2")
+	announce.LoadState(map[string][]net.IP{
+		"foo": {v4, shared},
+		"bar": {v6, shared, v6},
+		"baz": {net.IPv4zero},
+	})
+
+	want := map[ipKey]int{keyOf(v4): 1, keyOf(v6): 1, keyOf(shared): 2}
+	if diff := cmp.Diff(want, announce.ipRefcnt); diff != "" {
+		t.Errorf("unexpected refcounts (-want +got)\n%s", diff)
+	}
+	if announce.AnnounceName("baz") {
+		t.Errorf("expected the service with an invalid IP to be ignored")
+	}
+	watched := map[string]int{}
+	for _, ip := range ndp.watched {
+		watched[ip.String()]++
+	}
+	// The fake records IPv4 addresses too, ndpResponder ignores them.
+	if diff := cmp.Diff(map[string]int{"192.168.1.20": 1, "1000::1": 1, "1000::2": 1}, watched); diff != "" {
+		t.Errorf("unexpected NDP watches (-want +got)\n%s", diff)
+	}
+	if len(announce.spamCh) != 3 {
+		t.Errorf("expected the 3 owned IPs to be announced, got %d", len(announce.spamCh))
+	}
+}
+
+func Test_InterfacesForIP(t *testing.T) {
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		arps: map[string]responder{
+			"eth1": &fakeResponder{intf: "eth1"},
+			"eth0": &fakeResponder{intf: "eth0"},
+			"eth2": &fakeResponder{intf: "eth2"},
+		},
+		ndps: map[string]watchingResponder{
+			"eth0": &fakeResponder{intf: "eth0"},
+		},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	v4, restricted, v6 := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	announce.SetBalancerWithInterfaces("bar", restricted, []string{"eth2", "eth1", "eth3"})
+
+	tests := []struct {
+		ip   net.IP
+		want []string
+	}{
+		{v4, []string{"eth0", "eth1", "eth2"}},
+		{restricted, []string{"eth1", "eth2"}},
+		{v6, []string{"eth0"}},
+		{net.IPv4(192, 168, 1, 22), []string{}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, announce.InterfacesForIP(test.ip)); diff != "" {
+			t.Errorf("unexpected interfaces for %s (-want +got)\n%s", test.ip, diff)
+		}
+	}
+
+	announce.Pause()
+	if got := announce.InterfacesForIP(v4); len(got) != 0 {
+		t.Errorf("expected no interfaces while paused, got %v", got)
+	}
+}
+
+func Test_AffinityReport(t *testing.T) {
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		arps: map[string]responder{
+			"eth1": &fakeResponder{intf: "eth1"},
+			"eth0": &fakeResponder{intf: "eth0"},
+		},
+		ndps: map[string]watchingResponder{
+			"eth1": &fakeResponder{intf: "eth1"},
+			"eth0": &fakeResponder{intf: "eth0"},
+		},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	v4, restricted, v6 := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 10), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v6, v4})
+	announce.SetBalancerWithInterfaces("bar", restricted, []string{"eth1"})
+
+	want := []Affinity{
+		{IP: restricted.To4(), Interface: "eth1", Protocol: "arp"},
+		{IP: v4.To4(), Interface: "eth0", Protocol: "arp"},
+		{IP: v4.To4(), Interface: "eth1", Protocol: "arp"},
+		{IP: v6, Interface: "eth0", Protocol: "ndp"},
+		{IP: v6, Interface: "eth1", Protocol: "ndp"},
+	}
+	if diff := cmp.Diff(want, announce.AffinityReport()); diff != "" {
+		t.Errorf("unexpected affinities (-want +got)\n%s", diff)
+	}
+
+	announce.Pause()
+	if got := announce.AffinityReport(); len(got) != 0 {
+		t.Errorf("expected no affinities while paused, got %v", got)
+	}
+}
+
+func Test_SetBalancerKeepsInterfaces(t *testing.T) {
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		arps: map[string]responder{
+			"eth0": &fakeResponder{intf: "eth0"},
+			"eth1": &fakeResponder{intf: "eth1"},
+		},
+		ndps:      map[string]watchingResponder{},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	first, second, third := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21), net.IPv4(192, 168, 1, 22)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 9}
+
+	announce.SetBalancerWithInterfaces("foo", first, []string{"eth1"})
+	announce.SetBalancer("foo", second)
+	announce.SetBalancerWithPolicy("foo", third, SpamPolicy{Burst: 2})
+	for _, ip := range []net.IP{first, second, third} {
+		if diff := cmp.Diff([]string{"eth1"}, announce.InterfacesForIP(ip)); diff != "" {
+			t.Errorf("expected the restriction to be kept for %s (-want +got)\n%s", ip, diff)
+		}
+	}
+
+	if err := announce.SetBalancerWithFloatingMAC("bar", net.IPv4(192, 168, 1, 30), "eth0", mac); err != nil {
+		t.Fatalf("setting floating MAC: %s", err)
+	}
+	announce.SetBalancer("bar", net.IPv4(192, 168, 1, 31))
+	if got := announce.floatingMACs["bar"]; !bytes.Equal(got, mac) {
+		t.Errorf("expected the floating MAC to be kept, got %s", got)
+	}
+
+	// Giving no interfaces explicitly lifts the restriction.
+	announce.SetBalancerWithInterfaces("foo", first, nil)
+	if diff := cmp.Diff([]string{"eth0", "eth1"}, announce.InterfacesForIP(second)); diff != "" {
+		t.Errorf("expected the restriction to be lifted (-want +got)\n%s", diff)
+	}
+}
+
+func Test_OnlyMatchingSubnet(t *testing.T) {
+	announce := newFakeAnnounce(&fakeFactory{})
+	lister := announce.lister.(*fakeLister)
+	lister.ifs = append(lister.ifs, net.Interface{
+		Index:        2,
+		Name:         "eth1",
+		Flags:        net.FlagUp | net.FlagBroadcast,
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2},
+	})
+	lister.addrs["eth1"] = []net.Addr{mustCIDR("10.0.0.2/24"), mustCIDR("fe80::2/64"), mustCIDR("2001:db8::2/64")}
+	announce.updateInterfaces()
+
+	onSubnet, offSubnet, v6 := net.IPv4(192, 168, 1, 20), net.IPv4(172, 16, 0, 20), net.ParseIP("2001:db8::20")
+	announce.SetBalancerIPs("foo", []net.IP{onSubnet, offSubnet, v6})
+
+	tests := []struct {
+		desc    string
+		enabled bool
+		ip      net.IP
+		want    []string
+	}{
+		{"disabled, on subnet", false, onSubnet, []string{"eth0", "eth1"}},
+		{"disabled, off subnet", false, offSubnet, []string{"eth0", "eth1"}},
+		{"enabled, on subnet", true, onSubnet, []string{"eth0"}},
+		{"enabled, off subnet", true, offSubnet, []string{}},
+		{"enabled, IPv6", true, v6, []string{"eth1"}},
+	}
+	for _, test := range tests {
+		announce.Configure(WithOnlyMatchingSubnet(test.enabled))
+		if diff := cmp.Diff(test.want, announce.InterfacesForIP(test.ip)); diff != "" {
+			t.Errorf("%s: unexpected interfaces (-want +got)\n%s", test.desc, diff)
+		}
+	}
+
+	if got := announce.shouldAnnounce(onSubnet, "eth1"); got != DropReasonSubnetMismatch {
+		t.Errorf("expected DropReasonSubnetMismatch, got %v", got)
+	}
+	if _, clients := announce.familyClients(onSubnet); len(clients) != 1 || clients[0].Interface() != "eth0" {
+		t.Errorf("expected gratuitous announcements on eth0 only, got %v", clients)
+	}
+}
+
+func Test_SetBalancerWithFloatingMAC(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	lister := announce.lister.(*fakeLister)
+	floating := net.HardwareAddr{2, 0, 0, 0, 0, 0xaa}
+	lister.ifs = append(lister.ifs, net.Interface{
+		Index:        2,
+		Name:         "vmac0",
+		Flags:        net.FlagUp | net.FlagBroadcast,
+		HardwareAddr: floating,
+	})
+	lister.addrs["vmac0"] = []net.Addr{mustCIDR("192.168.1.3/24")}
+	announce.updateInterfaces()
+	ip := net.IPv4(192, 168, 1, 20)
+
+	for _, mac := range []net.HardwareAddr{nil, {1, 0, 0x5e, 0, 0, 1}} {
+		if err := announce.SetBalancerWithFloatingMAC("foo", ip, "vmac0", mac); err == nil {
+			t.Errorf("expected an error with the floating MAC %q", mac)
+		}
+	}
+	if err := announce.SetBalancerWithFloatingMAC("foo", ip, "", floating); err == nil {
+		t.Errorf("expected an error without an interface")
+	}
+	if err := announce.SetBalancerWithFloatingMAC("foo", ip, "vmac0", floating); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if diff := cmp.Diff([]string{"vmac0"}, announce.InterfacesForIP(ip)); diff != "" {
+		t.Errorf("unexpected interfaces (-want +got)\n%s", diff)
+	}
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonInterfaceRestricted {
+		t.Errorf("expected the IP not to be answered on eth0, got %v", got)
+	}
+	announce.gratuitous(ip)
+	for _, arp := range factory.arps {
+		want := 0
+		if arp.intf == "vmac0" {
+			want = 1
+		}
+		if got := arp.gratuitousCount(); got != want {
+			t.Errorf("expected %d announcements on %s, got %d", want, arp.intf, got)
+		}
+		if arp.intf == "vmac0" && !bytes.Equal(arp.HardwareAddr(), floating) {
+			t.Errorf("expected the IP to be announced at %s, got %s", floating, arp.HardwareAddr())
+		}
+	}
+
+	// The floating MAC moves to another node.
+	lister.ifs[1].HardwareAddr = net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	announce.updateInterfaces()
+	if got := announce.InterfacesForIP(ip); len(got) != 0 {
+		t.Errorf("expected the IP not to be announced without the floating MAC, got %v", got)
+	}
+
+	// Setting the service again keeps the floating MAC, setting its
+	// interfaces lifts it.
+	announce.SetBalancer("foo", ip)
+	if got := announce.InterfacesForIP(ip); len(got) != 0 {
+		t.Errorf("expected the floating MAC to be kept, got %v", got)
+	}
+	announce.SetBalancerWithInterfaces("foo", ip, nil)
+	if diff := cmp.Diff([]string{"eth0", "vmac0"}, announce.InterfacesForIP(ip)); diff != "" {
+		t.Errorf("unexpected interfaces (-want +got)\n%s", diff)
+	}
+}
+
+func Test_InterfacePriority(t *testing.T) {
+	announce := newFakeAnnounce(&fakeFactory{})
+	lister := announce.lister.(*fakeLister)
+	for i, addr := range []string{"192.168.1.3/24", "10.0.0.2/24"} {
+		name := fmt.Sprintf("eth%d", i+1)
+		lister.ifs = append(lister.ifs, net.Interface{
+			Index:        i + 2,
+			Name:         name,
+			Flags:        net.FlagUp | net.FlagBroadcast,
+			HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 2)},
+		})
+		lister.addrs[name] = []net.Addr{mustCIDR(addr)}
+	}
+	announce.updateInterfaces()
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+
+	tests := []struct {
+		desc       string
+		priorities map[string]int
+		want       []string
+	}{
+		{"no priorities", nil, []string{"eth0", "eth1", "eth2"}},
+		// eth2 is on another subnet, it is not in the contest.
+		{"eth1 wins", map[string]int{"eth1": 10}, []string{"eth1", "eth2"}},
+		{"eth0 wins", map[string]int{"eth0": 10, "eth1": 5}, []string{"eth0", "eth2"}},
+		{"tie", map[string]int{"eth0": 10, "eth1": 10}, []string{"eth0", "eth1", "eth2"}},
+	}
+	for _, test := range tests {
+		announce.Configure(WithInterfacePriority(test.priorities))
+		if diff := cmp.Diff(test.want, announce.InterfacesForIP(ip)); diff != "" {
+			t.Errorf("%s: unexpected interfaces (-want +got)\n%s", test.desc, diff)
+		}
+	}
+
+	announce.Configure(WithInterfacePriority(map[string]int{"eth1": 10}))
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonLowerPriority {
+		t.Errorf("expected DropReasonLowerPriority, got %v", got)
+	}
+	_, clients := announce.familyClients(ip)
+	var got []string
+	for _, client := range clients {
+		got = append(got, client.Interface())
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"eth1", "eth2"}, got); diff != "" {
+		t.Errorf("unexpected gratuitous interfaces (-want +got)\n%s", diff)
+	}
+}
+
+func Test_SegmentGroups(t *testing.T) {
+	eth0, eth1, eth2 := &fakeResponder{intf: "eth0"}, &fakeResponder{intf: "eth1"}, &fakeResponder{intf: "eth2"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": eth0, "eth1": eth1, "eth2": eth2},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+		ifSubnets: map[string][]*net.IPNet{
+			"eth1": {mustCIDR("192.168.1.0/24")},
+			"eth2": {mustCIDR("192.168.1.0/24")},
+		},
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+
+	check := func(desc string, want map[string]int) {
+		t.Helper()
+		for _, r := range []*fakeResponder{eth0, eth1, eth2} {
+			if got := r.gratuitousCount(); got != want[r.intf] {
+				t.Errorf("%s: expected %d announcements on %s, got %d", desc, want[r.intf], r.intf, got)
+			}
+		}
+	}
+
+	// By default, the IP is announced on all interfaces.
+	announce.gratuitous(ip)
+	check("default", map[string]int{"eth0": 1, "eth1": 1, "eth2": 1})
+
+	// eth0 and eth1 are bridged, the IP is announced once on them.
+	WithSegmentGroups(map[string]string{"eth0": "lan", "eth1": "lan"})(&announce.cfg)
+	announce.gratuitous(ip)
+	check("groups", map[string]int{"eth0": 2, "eth1": 1, "eth2": 2})
+	// Replies are unaffected.
+	if got := announce.shouldAnnounce(ip, "eth1"); got != DropReasonNone {
+		t.Errorf("expected eth1 to keep answering, got %v", got)
+	}
+
+	// eth1 and eth2 share the subnet of the IP.
+	WithSegmentGroups(nil)(&announce.cfg)
+	WithSegmentsBySubnet(true)(&announce.cfg)
+	announce.gratuitous(ip)
+	check("subnets", map[string]int{"eth0": 3, "eth1": 2, "eth2": 2})
+}
+
+func Test_ZonedIP(t *testing.T) {
+	eth0, eth1 := &fakeResponder{intf: "eth0"}, &fakeResponder{intf: "eth1"}
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		lister: &fakeLister{ifs: []net.Interface{
+			{Index: 1, Name: "eth0"},
+			{Index: 2, Name: "eth1"},
+		}},
+		arps:      map[string]responder{},
+		ndps:      map[string]watchingResponder{"eth0": eth0, "eth1": eth1},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	ip := net.ParseIP("fe80::10")
+
+	if err := announce.SetBalancerE("foo", ip); err == nil {
+		t.Error("expected an error for a link-local IP without a zone")
+	}
+	if err := announce.SetBalancerIPAddr("foo", &net.IPAddr{IP: ip, Zone: "eth9"}); err == nil {
+		t.Error("expected an error for an unknown zone")
+	}
+	if err := announce.SetBalancerIPAddr("foo", &net.IPAddr{IP: net.ParseIP("1000::1"), Zone: "eth1"}); err == nil {
+		t.Error("expected an error for a zoned global IP")
+	}
+	if len(announce.ipRefcnt) != 0 {
+		t.Fatal("expected the failed calls to announce nothing")
+	}
+
+	// The zone can be given by index.
+	if err := announce.SetBalancerIPAddr("foo", &net.IPAddr{IP: ip, Zone: "2"}); err != nil {
+		t.Fatalf("setting zoned IP: %s", err)
+	}
+	<-announce.spamCh
+	if diff := cmp.Diff([]net.IP(nil), eth0.watched); diff != "" {
+		t.Errorf("unexpected watches on eth0 (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]net.IP{ip}, eth1.watched); diff != "" {
+		t.Errorf("unexpected watches on eth1 (-want +got)\n%s", diff)
+	}
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonInterfaceRestricted {
+		t.Errorf("expected eth0 to be restricted, got %v", got)
+	}
+	if got := announce.shouldAnnounce(ip, "eth1"); got != DropReasonNone {
+		t.Errorf("expected eth1 to answer, got %v", got)
+	}
+	if err := announce.SetBalancerIPAddr("bar", &net.IPAddr{IP: ip, Zone: "eth0"}); err == nil {
+		t.Error("expected an error for an IP announced in another zone")
+	}
+
+	announce.DeleteBalancer("foo")
+	if diff := cmp.Diff([]net.IP(nil), eth0.unwatched); diff != "" {
+		t.Errorf("unexpected unwatches on eth0 (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]net.IP{ip}, eth1.unwatched); diff != "" {
+		t.Errorf("unexpected unwatches on eth1 (-want +got)\n%s", diff)
+	}
+	// The zone goes away with the IP.
+	if err := announce.SetBalancerIPAddr("bar", &net.IPAddr{IP: ip, Zone: "eth0"}); err != nil {
+		t.Errorf("setting IP in a new zone: %s", err)
+	}
+}
+
+func Test_NDPReWatch(t *testing.T) {
+	eth0 := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		arps:      map[string]responder{},
+		ndps:      map[string]watchingResponder{"eth0": eth0},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	ip := net.ParseIP("1000::1")
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+
+	// The kernel drops the membership.
+	eth0.Lock()
+	delete(eth0.joined, ip.String())
+	eth0.Unlock()
+
+	announce.rewatchNDP()
+	eth0.Lock()
+	defer eth0.Unlock()
+	if !eth0.joined[ip.String()] {
+		t.Error("expected the re-watch to restore the membership")
+	}
+	if len(eth0.watched) != 1 {
+		t.Errorf("expected the re-watch not to count as a watch, got %d watches", len(eth0.watched))
+	}
+
+	for _, tc := range []struct {
+		opts []Option
+		want time.Duration
+	}{
+		{nil, time.Minute},
+		{[]Option{WithNDPReWatchInterval(time.Hour)}, time.Hour},
+		{[]Option{WithNDPReWatchInterval(0)}, 0},
+	} {
+		var cfg config
+		for _, o := range tc.opts {
+			o(&cfg)
+		}
+		if got := cfg.getNDPReWatchInterval(); got != tc.want {
+			t.Errorf("expected an interval of %s, got %s", tc.want, got)
+		}
+	}
+}
+
+func Test_WatchErrors(t *testing.T) {
+	eth0 := &fakeResponder{intf: "eth0"}
+	eth1 := &fakeResponder{
+		intf:        "eth1",
+		watchErrs:   map[string]error{"1000::2": errors.New("join failed")},
+		unwatchErrs: map[string]error{"1000::1": errors.New("leave failed")},
+	}
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		arps:      map[string]responder{},
+		ndps:      map[string]watchingResponder{"eth0": eth0, "eth1": eth1},
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	v4, ok6, bad6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1"), net.ParseIP("1000::2")
+
+	err := announce.SetBalancerIPsE("foo", []net.IP{v4, ok6, bad6})
+	if err == nil {
+		t.Fatal("expected an error for the failed watch")
+	}
+	if want := "setting foo: watching 1000::2 failed on eth1 (join failed)"; err.Error() != want {
+		t.Errorf("expected error %q, got %q", want, err)
+	}
+	// The IPs are set all the same.
+	if got := announce.RefCount(bad6); got != 1 {
+		t.Errorf("expected %s to be set, got a refcount of %d", bad6, got)
+	}
+	if err := announce.SetBalancerIPsE("bar", []net.IP{ok6}); err != nil {
+		t.Errorf("expected no error for a shared IP, got %s", err)
+	}
+
+	err = announce.DeleteBalancerE("foo")
+	if err != nil {
+		t.Errorf("expected no error while %s is still used, got %s", ok6, err)
+	}
+	err = announce.DeleteBalancerE("bar")
+	if want := "deleting bar: unwatching 1000::1 failed on eth1 (leave failed)"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+	if announce.AnnounceIP(ok6) {
+		t.Errorf("expected %s to be deleted all the same", ok6)
+	}
+}
+
+func Test_OwnershipChangeHandler(t *testing.T) {
+	var got []string
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	WithOwnershipChangeHandler(func(ip net.IP, owned bool) {
+		// The handler may call the announcer.
+		got = append(got, fmt.Sprintf("%s %v %d", ip, owned, len(announce.OwnedIPs())))
+	})(&announce.cfg)
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	announce.SetBalancer("bar", v4)
+	announce.DeleteBalancer("foo")
+	if diff := cmp.Diff([]net.IP{v4.To16()}, announce.OwnedIPs()); diff != "" {
+		t.Errorf("unexpected owned IPs (-want +got)\n%s", diff)
+	}
+	announce.DeleteBalancerIP("bar", v4)
+	announce.LoadState(map[string][]net.IP{"baz": {v6}})
+
+	want := []string{
+		"192.168.1.20 true 2",
+		"1000::1 true 2",
+		"1000::1 false 1",
+		"192.168.1.20 false 0",
+		"1000::1 true 1",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected ownership changes (-want +got)\n%s", diff)
+	}
+}
+
+func Test_OwnershipChangeHandlerReentrant(t *testing.T) {
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	var got []string
+	WithOwnershipChangeHandler(func(ip net.IP, owned bool) {
+		got = append(got, fmt.Sprintf("%s %v", ip, owned))
+		// Follow foo with bar, which must not deadlock.
+		switch {
+		case ip.Equal(v4) && owned:
+			announce.SetBalancer("bar", v6)
+		case ip.Equal(v4):
+			announce.DeleteBalancer("bar")
+		}
+	})(&announce.cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		announce.SetBalancer("foo", v4)
+		announce.DeleteBalancer("foo")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler calling the announcer deadlocked")
+	}
+
+	want := []string{
+		"192.168.1.20 true",
+		"1000::1 true",
+		"192.168.1.20 false",
+		"1000::1 false",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected ownership changes (-want +got)\n%s", diff)
+	}
+}
+
+func Test_SetBalancerValidates(t *testing.T) {
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+	ips := []net.IP{nil, net.IPv4zero, net.IPv4(127, 0, 0, 1), net.IPv4(224, 0, 0, 1), ip}
+
+	err := announce.SetBalancerIPsE("foo", ips)
+	if err == nil {
+		t.Fatal("expected an error for the invalid IPs")
+	}
+	for _, want := range []string{"unspecified", "loopback", "multicast"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention the %s IP, got %q", want, err)
+		}
+	}
+	announce.SetBalancerWithInterfaces("bar", net.IPv4(127, 0, 0, 2), []string{"eth0"})
+	announce.SetBalancerWithPolicy("baz", net.IPv6loopback, SpamPolicy{Burst: 2})
+	if diff := cmp.Diff(map[string][]net.IP{"foo": {ip.To4()}}, announce.GetAnnouncements()); diff != "" {
+		t.Errorf("expected only the valid IP to be set (-want +got)\n%s", diff)
+	}
+
+	// The caller's IPs are copied.
+	ips[4][15] = 99
+	if want := net.IPv4(192, 168, 1, 20); !announce.AnnounceIP(want) {
+		t.Errorf("expected %s to stay announced after the caller changed its slice", want)
+	}
+}
+
+func Test_NormalizeIP(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	short := net.IP{192, 168, 1, 20}
+	mapped := net.IPv4(192, 168, 1, 20)
+	if len(short) == len(mapped) {
+		t.Fatalf("expected two representations of the IP")
+	}
+
+	announce.SetBalancer("foo", short)
+	announce.SetBalancer("foo", mapped)
+	announce.SetBalancer("bar", mapped)
+	if diff := cmp.Diff(map[ipKey]int{keyOf(short): 2}, announce.ipRefcnt); diff != "" {
+		t.Fatalf("unexpected refcounts (-want +got)\n%s", diff)
+	}
+	for _, name := range []string{"foo", "bar"} {
+		ips, _ := announce.GetIPsForName(name)
+		if len(ips) != 1 || len(ips[0]) != net.IPv4len {
+			t.Errorf("expected %s to hold a single 4 bytes IP, got %#v", name, ips)
+		}
+	}
+	for len(announce.spamCh) > 0 {
+		if ip := <-announce.spamCh; len(ip) != net.IPv4len {
+			t.Errorf("expected a 4 bytes IP to be spammed, got %#v", ip)
+		}
+	}
+	if got := announce.shouldAnnounce(short, "eth0"); got != DropReasonNone {
+		t.Errorf("expected the short IP to be announced, got %v", got)
+	}
+
+	announce.DeleteBalancerIP("foo", short)
+	announce.DeleteBalancer("bar")
+	if announce.AnnounceIP(mapped) || len(announce.ipRefcnt) != 1 || announce.ipRefcnt[keyOf(short)] != 0 {
+		t.Errorf("expected the IP to be released, got %v", announce.ipRefcnt)
+	}
+}
+
+func Test_Handover(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+
+	if err := announce.Handover(ip); err == nil {
+		t.Fatalf("expected an error handing over an IP we don't own")
+	}
+
+	announce.SetBalancer("foo", ip)
+	if err := announce.Handover(ip); err != nil {
+		t.Fatalf("handover failed: %s", err)
+	}
+	if got := arp.gratuitousCount(); got != handoverBurst {
+		t.Errorf("expected a final burst of %d announcements, got %d", handoverBurst, got)
+	}
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonHandedOver {
+		t.Errorf("expected DropReasonHandedOver, got %v", got)
+	}
+	// The announcements still scheduled are skipped.
+	announce.gratuitous(<-announce.spamCh)
+	if got := arp.gratuitousCount(); got != handoverBurst {
+		t.Errorf("expected no announcement after the handover, got %d", got-handoverBurst)
+	}
+
+	// Once released, the IP can be announced again.
+	announce.DeleteBalancer("foo")
+	announce.SetBalancer("foo", ip)
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonNone {
+		t.Errorf("expected DropReasonNone after announcing the IP again, got %v", got)
+	}
+}
+
+func Test_Suppress(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	v4, v6, other := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1"), net.IPv4(192, 168, 1, 21)
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	announce.SetBalancer("bar", other)
+	for len(announce.spamCh) > 0 {
+		<-announce.spamCh
+	}
+
+	announce.Suppress(v6)
+	announce.Suppress(v4)
+	if diff := cmp.Diff([]net.IP{v4.To4(), v6}, announce.SuppressedIPs()); diff != "" {
+		t.Errorf("unexpected suppressed IPs (-want +got)\n%s", diff)
+	}
+	for _, ip := range []net.IP{v4, v6} {
+		if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonSuppressed {
+			t.Errorf("expected %s to be suppressed, got %v", ip, got)
+		}
+		announce.gratuitous(ip)
+	}
+	if arp.gratuitousCount() != 0 || ndp.gratuitousCount() != 0 {
+		t.Errorf("expected no announcement of the suppressed IPs")
+	}
+	// The other IPs, the refcounts and the watches are left alone.
+	if got := announce.shouldAnnounce(other, "eth0"); got != DropReasonNone {
+		t.Errorf("expected %s to be answered, got %v", other, got)
+	}
+	if announce.RefCount(v6) != 1 || len(ndp.unwatched) != 0 {
+		t.Errorf("expected %s to stay owned and watched", v6)
+	}
+
+	announce.Unsuppress(v4)
+	if got := announce.shouldAnnounce(v4, "eth0"); got != DropReasonNone {
+		t.Errorf("expected %s to be answered after Unsuppress, got %v", v4, got)
+	}
+	if got := <-announce.spamCh; !got.Equal(v4) {
+		t.Errorf("expected %s to be announced again, got %s", v4, got)
+	}
+	announce.gratuitous(v4)
+	if arp.gratuitousCount() != 1 {
+		t.Errorf("expected %s to be announced after Unsuppress", v4)
+	}
+	if diff := cmp.Diff([]net.IP{v6}, announce.SuppressedIPs()); diff != "" {
+		t.Errorf("unexpected suppressed IPs (-want +got)\n%s", diff)
+	}
+}
+
+func Test_AnnounceGate(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	gated, other := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21)
+	healthy := true
+	WithAnnounceGate(func(ip net.IP) bool {
+		return healthy || !ip.Equal(gated)
+	})(&announce.cfg)
+	announce.SetBalancer("foo", gated)
+	announce.SetBalancer("bar", other)
+	for len(announce.spamCh) > 0 {
+		<-announce.spamCh
+	}
+
+	for _, test := range []struct {
+		healthy bool
+		want    DropReason
+		sent    int
+	}{
+		{true, DropReasonNone, 1},
+		{false, DropReasonGated, 1},
+		{true, DropReasonNone, 2},
+	} {
+		healthy = test.healthy
+		if got := announce.shouldAnnounce(gated, "eth0"); got != test.want {
+			t.Errorf("healthy=%v: expected %v, got %v", test.healthy, test.want, got)
+		}
+		announce.gratuitous(gated)
+		if got := arp.gratuitousCount(); got != test.sent {
+			t.Errorf("healthy=%v: expected %d announcements, got %d", test.healthy, test.sent, got)
+		}
+		// The gate is per IP.
+		if got := announce.shouldAnnounce(other, "eth0"); got != DropReasonNone {
+			t.Errorf("healthy=%v: expected %s to be answered, got %v", test.healthy, other, got)
+		}
+	}
+	if announce.RefCount(gated) != 1 {
+		t.Errorf("expected the gate to leave %s owned", gated)
+	}
+}
+
+func Test_LeaderState(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	WithLeaderElection(true)(&announce.cfg)
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	announce.gratuitous(<-announce.spamCh)
+
+	// The node starts without the lease.
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonNotLeader {
+		t.Errorf("expected no answer without the lease, got %v", got)
+	}
+	if arp.gratuitousCount() != 0 {
+		t.Errorf("expected no announcement without the lease")
+	}
+
+	announce.SetLeaderState(true)
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonNone {
+		t.Errorf("expected an answer with the lease, got %v", got)
+	}
+	select {
+	case got := <-announce.spamCh:
+		announce.gratuitous(got)
+	default:
+		t.Fatalf("expected the IPs to be announced again on getting the lease")
+	}
+	if arp.gratuitousCount() != 1 {
+		t.Errorf("expected one announcement with the lease, got %d", arp.gratuitousCount())
+	}
+	// Holding the lease again doesn't re-announce.
+	announce.SetLeaderState(true)
+	if len(announce.spamCh) != 0 {
+		t.Errorf("expected no announcement while keeping the lease")
+	}
+
+	announce.SetLeaderState(false)
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonNotLeader {
+		t.Errorf("expected no answer after losing the lease, got %v", got)
+	}
+	announce.gratuitous(ip)
+	if arp.gratuitousCount() != 1 {
+		t.Errorf("expected no announcement after losing the lease")
+	}
+	if announce.RefCount(ip) != 1 {
+		t.Errorf("expected %s to stay owned without the lease", ip)
+	}
+}
+
+func Test_SetBalancerOpts(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	quiet, loud := net.ParseIP("1000::1"), net.ParseIP("1000::2")
+
+	announce.SetBalancerOpts("foo", quiet, SetOpts{})
+	if len(announce.spamCh) != 0 {
+		t.Fatalf("expected no announcement of %s without Spam", quiet)
+	}
+	// The solicitations are still answered.
+	if got := announce.shouldAnnounce(quiet, "eth0"); got != DropReasonNone {
+		t.Errorf("expected %s to be answered, got %v", quiet, got)
+	}
+	if len(ndp.watched) != 1 {
+		t.Errorf("expected the multicast group of %s to be joined", quiet)
+	}
+
+	// The node announces it once ready.
+	announce.ReannounceAll()
+	if got := <-announce.spamCh; !got.Equal(quiet) {
+		t.Errorf("expected %s to be announced by ReannounceAll, got %s", quiet, got)
+	}
+
+	announce.SetBalancerOpts("bar", loud, SetOpts{Spam: true})
+	if got := <-announce.spamCh; !got.Equal(loud) {
+		t.Errorf("expected %s to be announced with Spam, got %s", loud, got)
+	}
+
+	announce.SetBalancerOpts("baz", nil, SetOpts{Spam: true})
+	if announce.AnnounceName("baz") {
+		t.Errorf("expected an invalid IP to be ignored")
+	}
+}
+
+func Test_SelfTest(t *testing.T) {
+	eth0, eth1 := &fakeResponder{intf: "eth0"}, &fakeResponder{intf: "eth1"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		arps:   map[string]responder{},
+		ndps:   map[string]watchingResponder{},
+	}
+	if err := announce.SelfTest(context.Background()); err == nil {
+		t.Errorf("expected an error without responders")
+	}
+
+	announce.arps = map[string]responder{"eth0": eth0, "eth1": eth1}
+	announce.ndps = map[string]watchingResponder{"eth0": ndp}
+	if err := announce.SelfTest(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if eth0.probes != 1 || eth1.probes != 1 || ndp.probes != 1 {
+		t.Errorf("expected every responder to be probed once, got %d, %d and %d", eth0.probes, eth1.probes, ndp.probes)
+	}
+
+	eth1.probeErr = errors.New("operation not permitted")
+	err := announce.SelfTest(context.Background())
+	if err == nil {
+		t.Fatalf("expected an error when eth1 can't transmit")
+	}
+	if !strings.Contains(err.Error(), "eth1: operation not permitted") || strings.Contains(err.Error(), "eth0") {
+		t.Errorf("expected the error to name eth1 only, got %q", err)
+	}
+}
+
+func Test_WithdrawOnDelete(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	ip := net.ParseIP("1000::1")
+	announce.SetBalancer("foo", ip)
+	announce.SetBalancer("bar", ip)
+
+	// The IP is still used by bar.
+	announce.DeleteBalancer("foo")
+	if len(ndp.ops) != 0 {
+		t.Fatalf("expected the IP to be kept, got %v", ndp.ops)
+	}
+
+	// The withdrawal is sent once the lock is released.
+	ndp.onWithdraw = func(ip net.IP) {
+		done := make(chan struct{})
+		go func() {
+			announce.AnnounceIP(ip)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("expected %s to be withdrawn without the lock held", ip)
+		}
+	}
+	announce.DeleteBalancer("bar")
+	if diff := cmp.Diff([]string{"unwatch 1000::1", "withdraw 1000::1"}, ndp.ops); diff != "" {
+		t.Errorf("unexpected calls (-want +got)\n%s", diff)
+	}
+
+	// Nothing is withdrawn where the IP wasn't announced.
+	ndp.ops = nil
+	announce.SetBalancer("baz", ip)
+	announce.Suppress(ip)
+	announce.DeleteBalancer("baz")
+	if diff := cmp.Diff([]string{"unwatch 1000::1"}, ndp.ops); diff != "" {
+		t.Errorf("unexpected calls for a suppressed IP (-want +got)\n%s", diff)
+	}
+}
+
+func Test_SetBalancerWithPolicy(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 10),
+	}
+	bursty, plain := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21)
+	policy := SpamPolicy{Interval: time.Second, Burst: 3}
+	announce.SetBalancerWithPolicy("foo", bursty, policy)
+	announce.SetBalancer("bar", plain)
+
+	if got, ok := announce.spamPolicy(bursty); !ok || got != policy {
+		t.Errorf("expected policy %+v, got %+v (%v)", policy, got, ok)
+	}
+	if _, ok := announce.spamPolicy(plain); ok {
+		t.Errorf("unexpected policy for %s", plain)
+	}
+
+	announce.gratuitous(bursty)
+	announce.gratuitous(plain)
+	if got := arp.gratuitousCount(); got != 3+1 {
+		t.Errorf("expected a burst of 3 packets and a single one, got %d packets", got)
+	}
+
+	// The policy is forgotten with the IP.
+	announce.DeleteBalancer("foo")
+	if _, ok := announce.spamPolicy(bursty); ok {
+		t.Errorf("expected the policy of %s to be forgotten", bursty)
+	}
+}
+
+func Test_ReannounceAll(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 6),
+	}
+	ips := []net.IP{
+		net.IPv4(192, 168, 1, 20),
+		net.IPv4(192, 168, 1, 21),
+		net.ParseIP("1000::1"),
+		net.ParseIP("1000::2"),
+		net.ParseIP("1000::3"),
+	}
+	for _, ip := range ips {
+		announce.SetBalancer("foo", ip)
+	}
+	// Shared IPs are announced once.
+	announce.SetBalancer("bar", ips[0])
+	for len(announce.spamCh) > 0 {
+		<-announce.spamCh
+	}
+
+	announce.ReannounceAll()
+	if len(announce.spamCh) != len(ips) {
+		t.Fatalf("expected %d IPs to be announced again, got %d", len(ips), len(announce.spamCh))
+	}
+	for len(announce.spamCh) > 0 {
+		announce.gratuitous(<-announce.spamCh)
+	}
+	if arp.gratuitousCount() != 2 {
+		t.Errorf("expected 2 gratuitous ARP announcements, got %d", arp.gratuitousCount())
+	}
+	if ndp.gratuitousCount() != 3 {
+		t.Errorf("expected 3 gratuitous NDP announcements, got %d", ndp.gratuitousCount())
+	}
+}
+
+func Test_DeleteBalancerIP(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 3),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancer("foo", v4)
+	announce.SetBalancer("foo", v6)
+	announce.SetBalancer("bar", v6)
+
+	// Unknown service or IP.
+	announce.DeleteBalancerIP("baz", v4)
+	announce.DeleteBalancerIP("foo", net.IPv4(192, 168, 1, 21))
+	if diff := cmp.Diff(map[ipKey]int{keyOf(v4): 1, keyOf(v6): 2}, announce.ipRefcnt); diff != "" {
+		t.Fatalf("unexpected refcounts (-want +got)\n%s", diff)
+	}
+
+	// Partial removal of an IP shared with another service.
+	announce.DeleteBalancerIP("foo", v6)
+	if got := announce.ips["foo"]; len(got) != 1 || !got[0].Equal(v4) {
+		t.Fatalf("expected foo to keep %s only, got %v", v4, got)
+	}
+	if announce.ipRefcnt[keyOf(v6)] != 1 || len(ndp.unwatched) != 0 {
+		t.Fatalf("expected %s to stay watched for bar", v6)
+	}
+
+	// Last IP of a service.
+	announce.DeleteBalancerIP("bar", v6)
+	if announce.AnnounceName("bar") {
+		t.Errorf("expected bar to be forgotten with its last IP")
+	}
+	if announce.AnnounceIP(v6) {
+		t.Errorf("expected %s not to be announced any more", v6)
+	}
+	if len(ndp.unwatched) != 1 || !ndp.unwatched[0].Equal(v6) {
+		t.Errorf("expected %s to be unwatched, got %v", v6, ndp.unwatched)
+	}
+	if !announce.AnnounceIP(v4) {
+		t.Errorf("expected %s to still be announced", v4)
+	}
+}
+
+func Test_SetBalancerCIDR(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	_, cidr, _ := net.ParseCIDR("192.168.10.0/24")
+	announce.SetBalancerCIDR("foo", cidr)
+	announce.SetBalancerCIDR("foo", cidr)
+	if len(announce.cidrs["foo"]) != 1 {
+		t.Fatalf("expected the CIDR to be registered once, got %v", announce.cidrs["foo"])
+	}
+	if !announce.AnnounceName("foo") {
+		t.Errorf("expected foo to be announced")
+	}
+
+	tests := []struct {
+		ip   net.IP
+		want DropReason
+	}{
+		{net.IPv4(192, 168, 10, 1), DropReasonNone},
+		{net.IPv4(192, 168, 10, 254), DropReasonNone},
+		{net.IPv4(192, 168, 11, 1), DropReasonAnnounceIP},
+		{net.ParseIP("1000::1"), DropReasonAnnounceIP},
+	}
+	for _, test := range tests {
+		if got := announce.shouldAnnounce(test.ip, "eth0"); got != test.want {
+			t.Errorf("shouldAnnounce(%s): want %s, got %s", test.ip, test.want, got)
+		}
+	}
+
+	// No gratuitous packets for a range.
+	announce.gratuitous(net.IPv4(192, 168, 10, 1))
+	if len(arp.gratuitous) != 0 || len(announce.spamCh) != 0 {
+		t.Errorf("expected no announcement for a CIDR, got %v", arp.gratuitous)
+	}
+
+	announce.DeleteBalancer("foo")
+	if announce.AnnounceName("foo") {
+		t.Errorf("expected foo to be forgotten")
+	}
+	if got := announce.shouldAnnounce(net.IPv4(192, 168, 10, 1), "eth0"); got != DropReasonAnnounceIP {
+		t.Errorf("expected the range not to be answered after deletion, got %s", got)
+	}
+}
+
+func Test_SetBalancerIPs(t *testing.T) {
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 4),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	if len(announce.spamCh) != 2 {
+		t.Fatalf("expected both IPs to be announced, got %d", len(announce.spamCh))
+	}
+	if ip := <-announce.spamCh; !ip.Equal(v4) {
+		t.Errorf("expected %s to be announced first, got %s", v4, ip)
+	}
+	if ip := <-announce.spamCh; !ip.Equal(v6) {
+		t.Errorf("expected %s to be announced second, got %s", v6, ip)
+	}
+	if diff := cmp.Diff(map[ipKey]int{keyOf(v4): 1, keyOf(v6): 1}, announce.ipRefcnt); diff != "" {
+		t.Errorf("unexpected refcounts (-want +got)\n%s", diff)
+	}
+	if len(ndp.watched) != 2 {
+		t.Errorf("expected both IPs to be watched, got %v", ndp.watched)
+	}
+
+	// Setting the same IPs again is a no-op besides the announcements.
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	<-announce.spamCh
+	<-announce.spamCh
+	if len(announce.ips["foo"]) != 2 || announce.ipRefcnt[keyOf(v4)] != 1 || announce.ipRefcnt[keyOf(v6)] != 1 {
+		t.Errorf("expected the IPs to be registered once, got %v %v", announce.ips, announce.ipRefcnt)
+	}
+}
+
+func Test_DoSpamFullChannel(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	before := ptu.ToFloat64(stats.spamDropped)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+		announce.SetBalancer("foo", net.IPv4(192, 168, 1, 21))
+		announce.SetBalancer("foo", net.IPv4(192, 168, 1, 22))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("SetBalancer blocked on a full spam channel")
+	}
+
+	if len(announce.spamCh) != 1 {
+		t.Errorf("expected the first IP to be queued, got %d queued", len(announce.spamCh))
+	}
+	if got := ptu.ToFloat64(stats.spamDropped) - before; got != 2 {
+		t.Errorf("expected 2 dropped IPs, got %v", got)
+	}
+	if len(announce.ips["foo"]) != 3 {
+		t.Errorf("expected all IPs to be registered, got %v", announce.ips["foo"])
+	}
+}
+
+func Test_LastAnnounced(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+
+	if _, ok := announce.LastAnnounced(v4); ok {
+		t.Fatalf("expected no announcement before gratuitous")
+	}
+	before := time.Now()
+	announce.gratuitous(v4)
+	announce.gratuitous(v6)
+	last, ok := announce.LastAnnounced(v4)
+	if !ok || last.Before(before) {
+		t.Fatalf("expected %s to be announced after %v, got %v %v", v4, before, last, ok)
+	}
+	if _, ok := announce.LastAnnounced(v6); ok {
+		t.Errorf("expected no announcement for %s without NDP responders", v6)
+	}
+	if v := ptu.ToFloat64(stats.lastAnnounced.WithLabelValues(v4.String())); v < float64(before.Unix()) {
+		t.Errorf("expected the last announcement gauge to be set, got %v", v)
+	}
+
+	announce.DeleteBalancer("foo")
+	if _, ok := announce.LastAnnounced(v4); ok {
+		t.Errorf("expected the last announcement to be forgotten with the IP")
+	}
+}
+
+func BenchmarkShouldAnnounce(b *testing.B) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	for i := 0; i < 5000; i++ {
+		announce.SetBalancer(fmt.Sprintf("svc-%d", i), net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	ip := net.IPv4(10, 0, 19, 135)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reason := announce.shouldAnnounce(ip, "eth0"); reason != DropReasonNone {
+			b.Fatalf("expected DropReasonNone, got %v", reason)
+		}
+	}
+}
+
+func BenchmarkSetDeleteBalancer(b *testing.B) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	ip := net.IPv4(10, 0, 0, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		announce.SetBalancer("foo", ip)
+		<-announce.spamCh
+		announce.DeleteBalancer("foo")
+	}
+}
+
+func Test_SetBalancerE(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      net.IP
+		wantErr bool
+	}{
+		{name: "nil", ip: nil, wantErr: true},
+		{name: "malformed", ip: net.IP{1, 2, 3}, wantErr: true},
+		{name: "unspecified", ip: net.IPv4zero, wantErr: true},
+		{name: "unspecified v6", ip: net.IPv6unspecified, wantErr: true},
+		{name: "loopback", ip: net.IPv4(127, 0, 0, 1), wantErr: true},
+		{name: "multicast", ip: net.IPv4(224, 0, 0, 1), wantErr: true},
+		{name: "valid", ip: net.IPv4(192, 168, 1, 20)},
+		{name: "valid v6", ip: net.ParseIP("1000::1")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			announce := &Announce{
+				logger:   log.NewNopLogger(),
+				ips:      map[string][]net.IP{},
+				ipRefcnt: map[ipKey]int{},
+				spamCh:   make(chan net.IP, 1),
+			}
+			err := announce.SetBalancerE("foo", tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if announce.AnnounceName("foo") == tt.wantErr {
+				t.Fatalf("expected the service to be registered only for valid IPs")
+			}
+		})
+	}
+}
+
+func Test_GratuitousTimeout(t *testing.T) {
+	slow := &fakeResponder{intf: "eth0", delay: 500 * time.Millisecond}
+	fast := &fakeResponder{intf: "eth1"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		cfg:      config{gratuitousTimeout: 50 * time.Millisecond},
+		arps:     map[string]responder{"eth0": slow, "eth1": fast},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 2),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	before := ptu.ToFloat64(stats.announcementErrors.WithLabelValues("arp", "eth0"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		announce.gratuitous(ip)
+	}()
+
+	// The lock is not held while the responders send.
+	time.Sleep(10 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		announce.SetBalancer("bar", net.IPv4(192, 168, 1, 21))
+	}()
+	select {
+	case <-locked:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatalf("SetBalancer blocked on a hung gratuitous announcement")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(300 * time.Millisecond):
+		t.Fatalf("gratuitous did not time out")
+	}
+	if fast.gratuitousCount() != 1 {
+		t.Errorf("expected the fast responder to announce, got %d", fast.gratuitousCount())
+	}
+	if _, ok := announce.LastAnnounced(ip); !ok {
+		t.Errorf("expected %s to be recorded as announced", ip)
+	}
+	if got := ptu.ToFloat64(stats.announcementErrors.WithLabelValues("arp", "eth0")) - before; got != 1 {
+		t.Errorf("expected the timeout to be counted as an error, got %v", got)
+	}
+}
+
+func Test_GratuitousBurst(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		cfg:      config{gratuitousBurst: 3},
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 2),
+	}
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+
+	announce.gratuitous(v4)
+	if arp.gratuitousCount() != 3 || ndp.gratuitousCount() != 0 {
+		t.Fatalf("expected a burst of 3 ARP packets, got %d ARP and %d NDP", arp.gratuitousCount(), ndp.gratuitousCount())
+	}
+	announce.gratuitous(v6)
+	if arp.gratuitousCount() != 3 || ndp.gratuitousCount() != 3 {
+		t.Fatalf("expected a burst of 3 NDP packets, got %d ARP and %d NDP", arp.gratuitousCount(), ndp.gratuitousCount())
+	}
+
+	announce.cfg.gratuitousBurst = 0
+	announce.gratuitous(v4)
+	if arp.gratuitousCount() != 4 {
+		t.Fatalf("expected a single packet by default, got %d", arp.gratuitousCount()-3)
+	}
+}
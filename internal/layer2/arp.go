@@ -12,50 +12,182 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/mdlayher/arp"
 	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/packet"
 )
 
-type announceFunc func(net.IP) dropReason
+// announceFunc tells whether to answer a request for an IP received on an
+// interface from requester, which is nil when the request has no sender
+// address, like the probes.
+type announceFunc func(ip net.IP, intf string, requester net.IP) DropReason
+
+// conflictFunc is told about another host claiming an IP, with the MAC
+// address it claims it with and the interface it was seen on.
+type conflictFunc func(ip net.IP, mac net.HardwareAddr, intf string)
+
+// dropFunc is told about a packet for ip dropped on an interface, sent by
+// requester if it is a request with a sender address.
+type dropFunc func(ip net.IP, intf string, requester net.IP, reason DropReason)
 
 type arpResponder struct {
 	logger       log.Logger
 	intf         string
 	hardwareAddr net.HardwareAddr
+	ip           net.IP
 	conn         *arp.Client
 	closed       chan struct{}
 	announce     announceFunc
+	conflict     conflictFunc
+	dropped      dropFunc
+	counters     responderCounters
+	// subnets are the IPv4 subnets of the interface.
+	subnets []*net.IPNet
+	// senderOnLink is set by WithSenderOnLinkOnly.
+	senderOnLink bool
+	// defendOnProbe is set by WithDefendOnProbe.
+	defendOnProbe bool
+	// subnetOnly is set by WithRespondOnSubnetOnly.
+	subnetOnly bool
+	// sourceMAC is the MAC address we announce, which is hardwareAddr
+	// unless overridden with WithSourceMAC.
+	sourceMAC net.HardwareAddr
+	// hook is set by WithGratuitousHook.
+	hook GratuitousHook
+	// mode is set by WithGratuitousMode.
+	mode GratuitousMode
+	// sendOnly is set for the active slaves of the bonds, see
+	// WithBondActiveSlave: they only send the gratuitous announcements of
+	// their bond, and have no IPv4 address to probe with.
+	sendOnly bool
 }
 
-func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*arpResponder, error) {
-	client, err := arp.Dial(ifi)
+func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc, conflict conflictFunc, dropped dropFunc, cfg config) (*arpResponder, error) {
+	// This is arp.Dial, which leaks the socket when arp.New fails.
+	p, err := packet.Listen(ifi, packet.Raw, int(ethernet.EtherTypeARP), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating ARP responder for %q: %s", ifi.Name, err)
+	}
+	client, err := arp.New(ifi, p)
 	if err != nil {
+		p.Close()
 		return nil, fmt.Errorf("creating ARP responder for %q: %s", ifi.Name, err)
 	}
 
 	ret := &arpResponder{
+		logger:        logger,
+		intf:          ifi.Name,
+		hardwareAddr:  ifi.HardwareAddr,
+		ip:            firstIPv4(ifi),
+		conn:          client,
+		closed:        make(chan struct{}),
+		announce:      ann,
+		conflict:      conflict,
+		dropped:       dropped,
+		subnets:       ipv4Subnets(ifi),
+		senderOnLink:  cfg.senderOnLink,
+		subnetOnly:    cfg.subnetOnly,
+		defendOnProbe: cfg.defendOnProbe,
+		sourceMAC:     cfg.announcedMAC(ifi),
+		hook:          cfg.gratuitousHook,
+		mode:          cfg.gratuitousMode,
+	}
+	go ret.run()
+	return ret, nil
+}
+
+// newSlaveARPResponder creates the responder of ifi, the active slave of
+// a bond, which only sends the gratuitous announcements of the bond. Its
+// socket is bound to no protocol, so that it receives nothing.
+func newSlaveARPResponder(logger log.Logger, ifi *net.Interface, cfg config) (*arpResponder, error) {
+	p, err := packet.Listen(ifi, packet.Raw, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating ARP sender for %q: %s", ifi.Name, err)
+	}
+	ret, err := newSendOnlyARPResponder(logger, ifi, p, cfg)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// newSendOnlyARPResponder returns a responder sending its gratuitous
+// announcements on p, which doesn't need an IPv4 address on ifi.
+func newSendOnlyARPResponder(logger log.Logger, ifi *net.Interface, p net.PacketConn, cfg config) (*arpResponder, error) {
+	client, err := arp.New(ifi, p)
+	if err != nil {
+		return nil, fmt.Errorf("creating ARP sender for %q: %s", ifi.Name, err)
+	}
+	return &arpResponder{
 		logger:       logger,
 		intf:         ifi.Name,
 		hardwareAddr: ifi.HardwareAddr,
 		conn:         client,
 		closed:       make(chan struct{}),
-		announce:     ann,
-	}
-	go ret.run()
-	return ret, nil
+		sourceMAC:    cfg.announcedMAC(ifi),
+		hook:         cfg.gratuitousHook,
+		mode:         cfg.gratuitousMode,
+		sendOnly:     true,
+	}, nil
 }
 
 func (a *arpResponder) Interface() string { return a.intf }
 
+func (a *arpResponder) HardwareAddr() net.HardwareAddr { return a.hardwareAddr }
+
 func (a *arpResponder) Close() error {
 	close(a.closed)
 	return a.conn.Close()
 }
 
+// Stats returns a snapshot of the responder's activity.
+func (a *arpResponder) Stats() ResponderStat { return a.counters.snapshot() }
+
 func (a *arpResponder) Gratuitous(ip net.IP) error {
-	for _, op := range []arp.Operation{arp.OperationRequest, arp.OperationReply} {
-		pkt, err := arp.NewPacket(op, a.hardwareAddr, ip, ethernet.Broadcast, ip)
+	err := a.gratuitous(ip)
+	a.counters.sentGratuitous(err)
+	return err
+}
+
+// Probe checks that the responder is able to transmit, by sending an ARP
+// request for the interface's own address. Peers already map that
+// address to us, so the request is harmless. The send-only responders
+// have no address to ask for, they are not probed.
+func (a *arpResponder) Probe() error {
+	if a.sendOnly {
+		a.counters.probed(nil)
+		return nil
+	}
+	err := a.probe()
+	a.counters.probed(err)
+	return err
+}
+
+// Healthy returns whether the last probe succeeded.
+func (a *arpResponder) Healthy() bool { return a.counters.healthy() }
+
+func (a *arpResponder) probe() error {
+	if a.ip == nil {
+		return fmt.Errorf("no IPv4 address to probe with on %q", a.intf)
+	}
+	if err := a.conn.Request(a.ip); err != nil {
+		return fmt.Errorf("writing probe packet on %q: %s", a.intf, err)
+	}
+	return nil
+}
+
+func (a *arpResponder) gratuitous(ip net.IP) error {
+	for _, op := range a.mode.operations() {
+		pkt, err := arp.NewPacket(op, a.sourceMAC, ip, ethernet.Broadcast, ip)
 		if err != nil {
 			return fmt.Errorf("assembling %q gratuitous packet for %q: %s", op, ip, err)
 		}
+		send := true
+		if pkt, send, err = a.applyHook(ip, pkt); err != nil {
+			return fmt.Errorf("rewriting %q gratuitous packet for %q: %s", op, ip, err)
+		}
+		if !send {
+			continue
+		}
 		if err = a.conn.WriteTo(pkt, ethernet.Broadcast); err != nil {
 			return fmt.Errorf("writing %q gratuitous packet for %q: %s", op, ip, err)
 		}
@@ -64,12 +196,71 @@ func (a *arpResponder) Gratuitous(ip net.IP) error {
 	return nil
 }
 
+// Solicit sends an RFC 5227 ARP probe for ip, with an unspecified sender
+// IP so that the neighbors don't update their caches.
+func (a *arpResponder) Solicit(ip net.IP) error {
+	pkt, err := arp.NewPacket(arp.OperationRequest, a.hardwareAddr, net.IPv4zero, make(net.HardwareAddr, len(a.hardwareAddr)), ip)
+	if err != nil {
+		return fmt.Errorf("assembling probe packet for %q: %s", ip, err)
+	}
+	if err = a.conn.WriteTo(pkt, ethernet.Broadcast); err != nil {
+		return fmt.Errorf("writing probe packet for %q on %q: %s", ip, a.intf, err)
+	}
+	return nil
+}
+
+// operations returns the ARP operations sent in mode m.
+func (m GratuitousMode) operations() []arp.Operation {
+	switch m {
+	case GratuitousRequest:
+		return []arp.Operation{arp.OperationRequest}
+	case GratuitousReply:
+		return []arp.Operation{arp.OperationReply}
+	default:
+		return []arp.Operation{arp.OperationRequest, arp.OperationReply}
+	}
+}
+
+// applyHook passes pkt through the GratuitousHook, if any. It returns the
+// packet to send, or false if the send is suppressed.
+func (a *arpResponder) applyHook(ip net.IP, pkt *arp.Packet) (*arp.Packet, bool, error) {
+	if a.hook == nil {
+		return pkt, true, nil
+	}
+	b, err := pkt.MarshalBinary()
+	if err != nil {
+		return nil, false, err
+	}
+	b, send := a.hook(a.intf, ip, b)
+	if !send {
+		return nil, false, nil
+	}
+	ret := &arp.Packet{}
+	if err := ret.UnmarshalBinary(b); err != nil {
+		return nil, false, err
+	}
+	return ret, true, nil
+}
+
 func (a *arpResponder) run() {
-	for a.processRequest() != dropReasonClosed {
+	for {
+		reason, ip, requester := a.processRequest()
+		if reason == DropReasonClosed {
+			return
+		}
+		if reason != DropReasonNone {
+			stats.Dropped("arp", a.intf, reason)
+			if a.dropped != nil {
+				a.dropped(ip, a.intf, requester, reason)
+			}
+		}
 	}
 }
 
-func (a *arpResponder) processRequest() dropReason {
+// processRequest reads a packet and answers it if needed. It returns why
+// the packet was dropped, the IP it was about: the target IP of a request
+// or the sender IP of a reply, and the sender IP of a request.
+func (a *arpResponder) processRequest() (DropReason, net.IP, net.IP) {
 	pkt, eth, err := a.conn.Read()
 	if err != nil {
 		// ARP listener doesn't cleanly return EOF when closed, so we
@@ -77,37 +268,110 @@ func (a *arpResponder) processRequest() dropReason {
 		// independently.
 		select {
 		case <-a.closed:
-			return dropReasonClosed
+			return DropReasonClosed, nil, nil
 		default:
 		}
 		if err == io.EOF {
-			return dropReasonClosed
+			return DropReasonClosed, nil, nil
 		}
-		return dropReasonError
+		return DropReasonError, nil, nil
 	}
 
-	// Ignore ARP replies.
+	// Ignore ARP replies, after checking that no one else claims one of
+	// our IPs.
 	if pkt.Operation != arp.OperationRequest {
-		return dropReasonARPReply
+		if a.conflict != nil && !bytes.Equal(pkt.SenderHardwareAddr, a.hardwareAddr) && !bytes.Equal(pkt.SenderHardwareAddr, a.sourceMAC) {
+			a.conflict(pkt.SenderIP, pkt.SenderHardwareAddr, a.intf)
+		}
+		return DropReasonARPReply, pkt.SenderIP, nil
+	}
+
+	stats.ResponderRequest("arp", a.intf)
+
+	// An RFC 5227 probe has no sender IP.
+	requester := pkt.SenderIP
+	if requester.IsUnspecified() {
+		requester = nil
 	}
 
 	// Ignore ARP requests which are not broadcast or bound directly for this machine.
 	if !bytes.Equal(eth.Destination, ethernet.Broadcast) && !bytes.Equal(eth.Destination, a.hardwareAddr) {
-		return dropReasonEthernetDestination
+		return DropReasonEthernetDestination, pkt.TargetIP, requester
 	}
 
 	// Ignore ARP requests that the announcer tells us to ignore.
-	if reason := a.announce(pkt.TargetIP); reason != dropReasonNone {
-		return reason
+	if reason := a.announce(pkt.TargetIP, a.intf, requester); reason != DropReasonNone {
+		return reason, pkt.TargetIP, requester
+	}
+
+	if requester == nil {
+		if !a.defendOnProbe {
+			return DropReasonARPProbe, pkt.TargetIP, nil
+		}
+	} else {
+		if a.senderOnLink && !sameSubnet(a.subnets, pkt.SenderIP, pkt.TargetIP) {
+			return DropReasonSenderOffLink, pkt.TargetIP, requester
+		}
+		if a.subnetOnly && !inSubnets(a.subnets, pkt.SenderIP) {
+			return DropReasonOffSubnet, pkt.TargetIP, requester
+		}
 	}
 
 	stats.GotRequest(pkt.TargetIP.String())
-	level.Debug(a.logger).Log("interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.hardwareAddr, "msg", "got ARP request for service IP, sending response")
+	level.Debug(a.logger).Log("interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.sourceMAC, "msg", "got ARP request for service IP, sending response")
 
-	if err := a.conn.Reply(pkt, a.hardwareAddr, pkt.TargetIP); err != nil {
-		level.Error(a.logger).Log("op", "arpReply", "interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
+	if err := a.conn.Reply(pkt, a.sourceMAC, pkt.TargetIP); err != nil {
+		level.Error(a.logger).Log("op", "arpReply", "interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.sourceMAC, "error", err, "msg", "failed to send ARP reply")
 	} else {
 		stats.SentResponse(pkt.TargetIP.String())
+		stats.ResponderResponse("arp", a.intf)
+	}
+	return DropReasonNone, pkt.TargetIP, requester
+}
+
+// firstIPv4 returns the first IPv4 address of ifi, or nil if it has none.
+func firstIPv4(ifi *net.Interface) net.IP {
+	subnets := ipv4Subnets(ifi)
+	if len(subnets) == 0 {
+		return nil
+	}
+	return subnets[0].IP
+}
+
+// ipv4Subnets returns the IPv4 addresses of ifi along with their subnet
+// masks.
+func ipv4Subnets(ifi *net.Interface) []*net.IPNet {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ret []*net.IPNet
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		ret = append(ret, &net.IPNet{IP: ipnet.IP.To4(), Mask: ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]})
+	}
+	return ret
+}
+
+// sameSubnet returns true if a and b are both in one of subnets.
+func sameSubnet(subnets []*net.IPNet, a, b net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(a) && subnet.Contains(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// inSubnets returns true if ip is in one of subnets.
+func inSubnets(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
 	}
-	return dropReasonNone
+	return false
 }
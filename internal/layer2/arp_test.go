@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/google/go-cmp/cmp"
 	"github.com/mdlayher/arp"
 	"github.com/mdlayher/ethernet"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestARPResponder(t *testing.T) {
@@ -20,48 +22,126 @@ func TestARPResponder(t *testing.T) {
 		dstMAC         net.HardwareAddr
 		arpTgt         net.IP
 		arpOp          arp.Operation
+		senderIP       net.IP
+		senderOnLink   bool
+		subnetOnly     bool
 		shouldAnnounce announceFunc
-		reason         dropReason
+		defendOnProbe  bool
+		reason         DropReason
+		conflict       bool
 	}{
 		{
-			name:   "ARP reply",
-			arpOp:  arp.OperationReply,
-			reason: dropReasonARPReply,
+			name:     "ARP reply",
+			arpOp:    arp.OperationReply,
+			reason:   DropReasonARPReply,
+			conflict: true,
 		},
 		{
 			name:   "bad Ethernet destination",
 			dstMAC: net.HardwareAddr{6, 5, 4, 3, 2, 1},
-			reason: dropReasonEthernetDestination,
+			reason: DropReasonEthernetDestination,
 		},
 		{
 			name:   "OK (unicast)",
-			reason: dropReasonNone,
+			reason: DropReasonNone,
 		},
 		{
 			name:   "OK (broadcast)",
 			dstMAC: ethernet.Broadcast,
-			reason: dropReasonNone,
+			reason: DropReasonNone,
 		},
 		{
 			name: "shouldAnnounce denies request",
-			shouldAnnounce: func(ip net.IP) dropReason {
+			shouldAnnounce: func(ip net.IP, intf string, requester net.IP) DropReason {
 				if net.IPv4(192, 168, 1, 20).Equal(ip) {
-					return dropReasonNone
+					return DropReasonNone
 				}
-				return dropReasonError
+				return DropReasonError
 			},
-			reason: dropReasonError,
+			reason: DropReasonError,
 		},
 		{
 			name:   "shouldAnnounce allows request",
 			arpTgt: net.IPv4(192, 168, 1, 20),
-			shouldAnnounce: func(ip net.IP) dropReason {
+			shouldAnnounce: func(ip net.IP, intf string, requester net.IP) DropReason {
 				if net.IPv4(192, 168, 1, 20).Equal(ip) {
-					return dropReasonNone
+					return DropReasonNone
 				}
-				return dropReasonError
+				return DropReasonError
 			},
-			reason: dropReasonNone,
+			reason: DropReasonNone,
+		},
+		{
+			name:         "sender on link",
+			senderOnLink: true,
+			reason:       DropReasonNone,
+		},
+		{
+			name:         "sender off link",
+			senderIP:     net.IPv4(10, 0, 0, 1),
+			senderOnLink: true,
+			reason:       DropReasonSenderOffLink,
+		},
+		{
+			name:         "requested IP off link",
+			arpTgt:       net.IPv4(192, 168, 2, 10),
+			senderOnLink: true,
+			reason:       DropReasonSenderOffLink,
+		},
+		{
+			name:       "sender on subnet",
+			arpTgt:     net.IPv4(10, 96, 0, 10),
+			subnetOnly: true,
+			reason:     DropReasonNone,
+		},
+		{
+			name:       "sender off subnet",
+			senderIP:   net.IPv4(10, 0, 0, 1),
+			subnetOnly: true,
+			reason:     DropReasonOffSubnet,
+		},
+		{
+			name: "requester denied",
+			shouldAnnounce: func(ip net.IP, intf string, requester net.IP) DropReason {
+				if requester.Equal(net.IPv4(192, 168, 1, 1)) {
+					return DropReasonACL
+				}
+				return DropReasonNone
+			},
+			reason: DropReasonACL,
+		},
+		{
+			name:     "ARP probe",
+			senderIP: net.IPv4zero,
+			reason:   DropReasonARPProbe,
+		},
+		{
+			name:          "ARP probe defended",
+			senderIP:      net.IPv4zero,
+			defendOnProbe: true,
+			subnetOnly:    true,
+			reason:        DropReasonNone,
+		},
+		{
+			name:     "ARP probe has no requester",
+			senderIP: net.IPv4zero,
+			shouldAnnounce: func(ip net.IP, intf string, requester net.IP) DropReason {
+				if requester != nil {
+					return DropReasonACL
+				}
+				return DropReasonNone
+			},
+			defendOnProbe: true,
+			reason:        DropReasonNone,
+		},
+		{
+			name:     "ARP probe for an IP we don't own",
+			senderIP: net.IPv4zero,
+			shouldAnnounce: func(ip net.IP, intf string, requester net.IP) DropReason {
+				return DropReasonAnnounceIP
+			},
+			defendOnProbe: true,
+			reason:        DropReasonAnnounceIP,
 		},
 	}
 
@@ -69,12 +149,18 @@ func TestARPResponder(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			shouldAnnounce := tt.shouldAnnounce
 			if shouldAnnounce == nil {
-				shouldAnnounce = func(net.IP) dropReason {
-					return dropReasonNone
+				shouldAnnounce = func(net.IP, string, net.IP) DropReason {
+					return DropReasonNone
 				}
 			}
 			a, conn, done := newTestARP(t, shouldAnnounce)
 			defer done()
+			conflicts := 0
+			a.conflict = func(net.IP, net.HardwareAddr, string) { conflicts++ }
+			a.senderOnLink = tt.senderOnLink
+			a.subnetOnly = tt.subnetOnly
+			a.defendOnProbe = tt.defendOnProbe
+			a.subnets = []*net.IPNet{{IP: net.IPv4(192, 168, 1, 0).To4(), Mask: net.CIDRMask(24, 32)}}
 
 			// Defaults for test params
 			if tt.dstMAC == nil {
@@ -86,13 +172,16 @@ func TestARPResponder(t *testing.T) {
 			if tt.arpOp == 0 {
 				tt.arpOp = arp.OperationRequest
 			}
+			if tt.senderIP == nil {
+				tt.senderIP = net.IPv4(192, 168, 1, 1)
+			}
 
 			eth := &ethernet.Frame{
 				Destination: tt.dstMAC,
 				Source:      net.HardwareAddr{1, 2, 3, 4, 5, 6},
 				EtherType:   ethernet.EtherTypeARP,
 			}
-			pkt, err := arp.NewPacket(tt.arpOp, eth.Source, net.IPv4(192, 168, 1, 1), tt.dstMAC, tt.arpTgt)
+			pkt, err := arp.NewPacket(tt.arpOp, eth.Source, tt.senderIP, tt.dstMAC, tt.arpTgt)
 			if err != nil {
 				t.Fatalf("failed to make ARP packet: %s", err)
 			}
@@ -100,9 +189,10 @@ func TestARPResponder(t *testing.T) {
 			eth.Payload = mustMarshal(pkt)
 			b := mustMarshal(eth)
 
-			dropC := make(chan dropReason)
+			dropC := make(chan DropReason)
 			go func() {
-				dropC <- a.processRequest()
+				reason, _, _ := a.processRequest()
+				dropC <- reason
 			}()
 
 			// Send a packet to receiver goroutine.
@@ -114,10 +204,63 @@ func TestARPResponder(t *testing.T) {
 			if diff := cmp.Diff(tt.reason, reason); diff != "" {
 				t.Fatalf("unexpected drop reason (-want +got)\n%s", diff)
 			}
+			if tt.conflict != (conflicts > 0) {
+				t.Fatalf("expected conflict %v, got %d conflicts", tt.conflict, conflicts)
+			}
 		})
 	}
 }
 
+func TestARPDropHandler(t *testing.T) {
+	type drop struct {
+		ip     string
+		intf   string
+		reason DropReason
+	}
+	drops := make(chan drop, 1)
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+	if err := announce.Configure(WithDropHandler(func(ip net.IP, intf string, reason DropReason) {
+		drops <- drop{ip.String(), intf, reason}
+	})); err != nil {
+		t.Fatalf("failed to configure: %s", err)
+	}
+
+	a, conn, done := newTestARP(t, announce.answerReason)
+	defer done()
+	a.intf = "eth0"
+	a.dropped = announce.dropped
+	go a.run()
+
+	eth := &ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		EtherType:   ethernet.EtherTypeARP,
+	}
+	pkt, err := arp.NewPacket(arp.OperationRequest, eth.Source, net.IPv4(192, 168, 1, 1), ethernet.Broadcast, net.IPv4(192, 168, 1, 99))
+	if err != nil {
+		t.Fatalf("failed to make ARP packet: %s", err)
+	}
+	eth.Payload = mustMarshal(pkt)
+	if _, err := conn.Write(mustMarshal(eth)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	select {
+	case got := <-drops:
+		if diff := cmp.Diff(drop{"192.168.1.99", "eth0", DropReasonAnnounceIP}, got, cmp.AllowUnexported(drop{})); diff != "" {
+			t.Fatalf("unexpected drop (-want +got)\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the drop handler was not called")
+	}
+}
+
 func mustMarshal(m encoding.BinaryMarshaler) []byte {
 	b, err := m.MarshalBinary()
 	if err != nil {
@@ -160,6 +303,7 @@ func newTestARP(t *testing.T, shouldAnnounce announceFunc) (*arpResponder, *net.
 		a = &arpResponder{
 			logger:       log.NewNopLogger(),
 			hardwareAddr: intf.HardwareAddr,
+			sourceMAC:    intf.HardwareAddr,
 			conn:         c,
 			closed:       make(chan struct{}),
 			announce:     shouldAnnounce,
@@ -177,3 +321,289 @@ func newTestARP(t *testing.T, shouldAnnounce announceFunc) (*arpResponder, *net.
 		pc.Close()
 	}
 }
+
+// capturePacketConn is a net.PacketConn recording the packets written to
+// it.
+type capturePacketConn struct {
+	net.PacketConn
+	written [][]byte
+}
+
+func (c *capturePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestARPGratuitousSourceMAC(t *testing.T) {
+	ifMAC := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	virtualMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0xaa}
+	ifi := &net.Interface{Index: 1, Name: "bond0", HardwareAddr: ifMAC}
+
+	for _, tt := range []struct {
+		name string
+		cfg  config
+		want net.HardwareAddr
+	}{
+		{name: "interface MAC", want: ifMAC},
+		{name: "overridden MAC", cfg: config{sourceMAC: virtualMAC}, want: virtualMAC},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := &capturePacketConn{}
+			c, err := arp.New(ifi, pc)
+			if err != nil {
+				t.Fatalf("failed to create ARP client: %s", err)
+			}
+			a := &arpResponder{
+				logger:       log.NewNopLogger(),
+				intf:         ifi.Name,
+				hardwareAddr: ifMAC,
+				sourceMAC:    tt.cfg.announcedMAC(ifi),
+				conn:         c,
+				closed:       make(chan struct{}),
+			}
+			if err := a.Gratuitous(net.IPv4(192, 168, 1, 20)); err != nil {
+				t.Fatalf("gratuitous failed: %s", err)
+			}
+
+			if len(pc.written) != 2 {
+				t.Fatalf("expected 2 gratuitous packets, got %d", len(pc.written))
+			}
+			for _, b := range pc.written {
+				var eth ethernet.Frame
+				if err := eth.UnmarshalBinary(b); err != nil {
+					t.Fatalf("failed to parse frame: %s", err)
+				}
+				var pkt arp.Packet
+				if err := pkt.UnmarshalBinary(eth.Payload); err != nil {
+					t.Fatalf("failed to parse ARP packet: %s", err)
+				}
+				if diff := cmp.Diff(tt.want, pkt.SenderHardwareAddr); diff != "" {
+					t.Errorf("unexpected sender MAC (-want +got)\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestARPGratuitousHook(t *testing.T) {
+	rewrittenMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0xbb}
+	var seen []string
+	hook := func(iface string, ip net.IP, frame []byte) ([]byte, bool) {
+		seen = append(seen, iface)
+		if iface == "eth1" {
+			return nil, false
+		}
+		var pkt arp.Packet
+		if err := pkt.UnmarshalBinary(frame); err != nil {
+			t.Fatalf("hook got an invalid ARP packet: %s", err)
+		}
+		pkt.SenderHardwareAddr = rewrittenMAC
+		return mustMarshal(&pkt), true
+	}
+
+	written := map[string]*capturePacketConn{}
+	for i, name := range []string{"eth0", "eth1"} {
+		ifi := &net.Interface{Index: i + 1, Name: name, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)}}
+		pc := &capturePacketConn{}
+		c, err := arp.New(ifi, pc)
+		if err != nil {
+			t.Fatalf("failed to create ARP client: %s", err)
+		}
+		a := &arpResponder{
+			logger:       log.NewNopLogger(),
+			intf:         name,
+			hardwareAddr: ifi.HardwareAddr,
+			sourceMAC:    ifi.HardwareAddr,
+			conn:         c,
+			closed:       make(chan struct{}),
+			hook:         hook,
+		}
+		if err := a.Gratuitous(net.IPv4(192, 168, 1, 20)); err != nil {
+			t.Fatalf("gratuitous on %s failed: %s", name, err)
+		}
+		written[name] = pc
+	}
+
+	if diff := cmp.Diff([]string{"eth0", "eth0", "eth1", "eth1"}, seen); diff != "" {
+		t.Errorf("unexpected hook calls (-want +got)\n%s", diff)
+	}
+	if n := len(written["eth1"].written); n != 0 {
+		t.Errorf("expected no packet on eth1, got %d", n)
+	}
+	if n := len(written["eth0"].written); n != 2 {
+		t.Fatalf("expected 2 packets on eth0, got %d", n)
+	}
+	for _, b := range written["eth0"].written {
+		var eth ethernet.Frame
+		if err := eth.UnmarshalBinary(b); err != nil {
+			t.Fatalf("failed to parse frame: %s", err)
+		}
+		var pkt arp.Packet
+		if err := pkt.UnmarshalBinary(eth.Payload); err != nil {
+			t.Fatalf("failed to parse ARP packet: %s", err)
+		}
+		if diff := cmp.Diff(rewrittenMAC, pkt.SenderHardwareAddr); diff != "" {
+			t.Errorf("expected the rewritten packet to be sent (-want +got)\n%s", diff)
+		}
+	}
+}
+
+func TestARPGratuitousMode(t *testing.T) {
+	ip := net.IPv4(192, 168, 1, 20)
+	tests := []struct {
+		mode GratuitousMode
+		want []arp.Operation
+	}{
+		{GratuitousRequestAndReply, []arp.Operation{arp.OperationRequest, arp.OperationReply}},
+		{GratuitousRequest, []arp.Operation{arp.OperationRequest}},
+		{GratuitousReply, []arp.Operation{arp.OperationReply}},
+	}
+	for _, test := range tests {
+		ifi := &net.Interface{Index: 1, Name: "eth0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+		pc := &capturePacketConn{}
+		c, err := arp.New(ifi, pc)
+		if err != nil {
+			t.Fatalf("failed to create ARP client: %s", err)
+		}
+		a := &arpResponder{
+			logger:       log.NewNopLogger(),
+			intf:         ifi.Name,
+			hardwareAddr: ifi.HardwareAddr,
+			sourceMAC:    ifi.HardwareAddr,
+			conn:         c,
+			closed:       make(chan struct{}),
+			mode:         test.mode,
+		}
+		if err := a.Gratuitous(ip); err != nil {
+			t.Fatalf("mode %d: gratuitous failed: %s", test.mode, err)
+		}
+
+		var ops []arp.Operation
+		for _, b := range pc.written {
+			var eth ethernet.Frame
+			if err := eth.UnmarshalBinary(b); err != nil {
+				t.Fatalf("mode %d: failed to parse frame: %s", test.mode, err)
+			}
+			var pkt arp.Packet
+			if err := pkt.UnmarshalBinary(eth.Payload); err != nil {
+				t.Fatalf("mode %d: failed to parse ARP packet: %s", test.mode, err)
+			}
+			ops = append(ops, pkt.Operation)
+			if !pkt.TargetIP.Equal(ip) || !pkt.SenderIP.Equal(ip) {
+				t.Errorf("mode %d: expected sender and target IP %s, got %s and %s", test.mode, ip, pkt.SenderIP, pkt.TargetIP)
+			}
+			if diff := cmp.Diff(ethernet.Broadcast, pkt.TargetHardwareAddr); diff != "" {
+				t.Errorf("mode %d: unexpected target MAC (-want +got)\n%s", test.mode, diff)
+			}
+		}
+		if diff := cmp.Diff(test.want, ops); diff != "" {
+			t.Errorf("mode %d: unexpected operations (-want +got)\n%s", test.mode, diff)
+		}
+	}
+}
+
+func TestARPResponderCounters(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen UDP: %s", err)
+	}
+	defer pc.Close()
+	uc, err := net.DialUDP("udp", nil, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial UDP: %s", err)
+	}
+	defer uc.Close()
+
+	ifMAC := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ifi := &net.Interface{Index: 1, Name: "arpcnt0", HardwareAddr: ifMAC}
+	cpc := &capturePacketConn{PacketConn: pc}
+	c, err := arp.New(ifi, cpc)
+	if err != nil {
+		t.Fatalf("failed to create ARP client: %s", err)
+	}
+	owned := net.IPv4(192, 168, 1, 20)
+	a := &arpResponder{
+		logger:       log.NewNopLogger(),
+		intf:         ifi.Name,
+		hardwareAddr: ifMAC,
+		sourceMAC:    ifMAC,
+		conn:         c,
+		closed:       make(chan struct{}),
+		announce: func(ip net.IP, intf string, requester net.IP) DropReason {
+			if ip.Equal(owned) {
+				return DropReasonNone
+			}
+			return DropReasonAnnounceIP
+		},
+	}
+	defer stats.ResponderDeleted("arp", ifi.Name, "")
+
+	sender := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	for _, tgt := range []net.IP{owned, net.IPv4(192, 168, 1, 21)} {
+		pkt, err := arp.NewPacket(arp.OperationRequest, sender, net.IPv4(192, 168, 1, 1), ethernet.Broadcast, tgt)
+		if err != nil {
+			t.Fatalf("failed to make ARP packet: %s", err)
+		}
+		eth := &ethernet.Frame{
+			Destination: ethernet.Broadcast,
+			Source:      sender,
+			EtherType:   ethernet.EtherTypeARP,
+			Payload:     mustMarshal(pkt),
+		}
+		if _, err := uc.Write(mustMarshal(eth)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		a.processRequest()
+	}
+
+	if v := ptu.ToFloat64(stats.responderRequests.WithLabelValues("arp", ifi.Name)); v != 2 {
+		t.Errorf("expected 2 requests received, got %v", v)
+	}
+	if v := ptu.ToFloat64(stats.responderResponses.WithLabelValues("arp", ifi.Name)); v != 1 {
+		t.Errorf("expected 1 response sent, got %v", v)
+	}
+	if len(cpc.written) != 1 {
+		t.Errorf("expected 1 reply to be written, got %d", len(cpc.written))
+	}
+}
+
+func TestSendOnlyARPResponder(t *testing.T) {
+	// No interface has this index, so it has no IPv4 address, like the
+	// slaves of a bond.
+	ifi := &net.Interface{Index: 1 << 20, Name: "eth0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	pc := &capturePacketConn{}
+	a, err := newSendOnlyARPResponder(log.NewNopLogger(), ifi, pc, config{})
+	if err != nil {
+		t.Fatalf("failed to create the responder of an interface without IPv4 address: %s", err)
+	}
+
+	// It is not probed, which would need an IPv4 address, and stays
+	// healthy.
+	if err := a.Probe(); err != nil || !a.Healthy() {
+		t.Fatalf("expected the responder to be healthy, got %v", err)
+	}
+	if len(pc.written) != 0 {
+		t.Fatalf("expected no probe to be sent, got %d packets", len(pc.written))
+	}
+
+	ip := net.IPv4(192, 168, 1, 10)
+	if err := a.Gratuitous(ip); err != nil {
+		t.Fatalf("failed to send the gratuitous announcement: %s", err)
+	}
+	if len(pc.written) != 2 {
+		t.Fatalf("expected 2 gratuitous packets, got %d", len(pc.written))
+	}
+	for _, b := range pc.written {
+		var eth ethernet.Frame
+		if err := eth.UnmarshalBinary(b); err != nil {
+			t.Fatalf("invalid frame: %s", err)
+		}
+		var pkt arp.Packet
+		if err := pkt.UnmarshalBinary(eth.Payload); err != nil {
+			t.Fatalf("invalid ARP packet: %s", err)
+		}
+		if !pkt.SenderIP.Equal(ip) || pkt.SenderHardwareAddr.String() != ifi.HardwareAddr.String() {
+			t.Errorf("expected %s announced at %s, got %s at %s", ip, ifi.HardwareAddr, pkt.SenderIP, pkt.SenderHardwareAddr)
+		}
+	}
+}
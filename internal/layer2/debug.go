@@ -0,0 +1,124 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// State is a snapshot of the internal state of an Announce, for
+// troubleshooting.
+type State struct {
+	// ARPResponders and NDPResponders map the names of the interfaces
+	// with responders to the interface indices.
+	ARPResponders map[string]int `json:"arpResponders"`
+	NDPResponders map[string]int `json:"ndpResponders"`
+	// Services maps service names to their IPs.
+	Services map[string][]string `json:"services"`
+	// RefCounts maps IPs to the number of services using them.
+	RefCounts map[string]int `json:"refCounts"`
+	// Draining is set between Drain and Undrain.
+	Draining bool `json:"draining"`
+}
+
+// DumpState returns a snapshot of the internal state of the announcer.
+func (a *Announce) DumpState() State {
+	a.RLock()
+	defer a.RUnlock()
+	ret := State{
+		ARPResponders: make(map[string]int, len(a.arps)),
+		NDPResponders: make(map[string]int, len(a.ndps)),
+		Services:      make(map[string][]string, len(a.ips)),
+		RefCounts:     make(map[string]int, len(a.ipRefcnt)),
+		Draining:      a.draining,
+	}
+	for name := range a.arps {
+		ret.ARPResponders[name] = a.ifIndex[name]
+	}
+	for name := range a.ndps {
+		ret.NDPResponders[name] = a.ifIndex[name]
+	}
+	for name, ips := range a.ips {
+		strs := make([]string, len(ips))
+		for i, ip := range ips {
+			strs[i] = ip.String()
+		}
+		sort.Strings(strs)
+		ret.Services[name] = strs
+	}
+	for k, cnt := range a.ipRefcnt {
+		ret.RefCounts[k.IP().String()] = cnt
+	}
+	return ret
+}
+
+// AnnounceStats is a summary of the state of an Announce, see Stats.
+type AnnounceStats struct {
+	// IPv4 and IPv6 are the numbers of owned IPs of each family.
+	IPv4, IPv6 int
+	// ARPInterfaces and NDPInterfaces are the sorted names of the
+	// interfaces with responders.
+	ARPInterfaces, NDPInterfaces []string
+	// SpamWindow is how long an IP keeps being announced after it was
+	// last scheduled.
+	SpamWindow time.Duration
+	// LastScan is the end of the last interface scan, zero until the
+	// first one.
+	LastScan time.Time
+}
+
+// Stats returns a summary of the state of the announcer, for status
+// endpoints or periodic logging.
+func (a *Announce) Stats() AnnounceStats {
+	a.RLock()
+	defer a.RUnlock()
+	ret := AnnounceStats{
+		IPv4:          len(a.ownedIPs(true, false)),
+		IPv6:          len(a.ownedIPs(false, true)),
+		ARPInterfaces: make([]string, 0, len(a.arps)),
+		NDPInterfaces: make([]string, 0, len(a.ndps)),
+		SpamWindow:    a.cfg.getSpamDuration(),
+		LastScan:      a.lastScan,
+	}
+	for name := range a.arps {
+		ret.ARPInterfaces = append(ret.ARPInterfaces, name)
+	}
+	for name := range a.ndps {
+		ret.NDPInterfaces = append(ret.NDPInterfaces, name)
+	}
+	sort.Strings(ret.ARPInterfaces)
+	sort.Strings(ret.NDPInterfaces)
+	return ret
+}
+
+// Handler returns an HTTP handler serving the state of the announcer as
+// JSON, meant to be mounted under a debug path like /debug/layer2.
+func (a *Announce) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// DumpState copies the state, the lock is not held while writing.
+		state := a.DumpState()
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// ReadyHandler returns an HTTP handler answering 200 when Ready returns
+// nil and 503 with the error otherwise, meant to back a Kubernetes
+// readiness probe.
+func (a *Announce) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := a.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
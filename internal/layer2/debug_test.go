@@ -0,0 +1,169 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandler(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": &fakeResponder{intf: "eth0"}},
+		ndps:     map[string]watchingResponder{"eth0": &fakeResponder{intf: "eth0"}, "eth1": &fakeResponder{intf: "eth1"}},
+		ifIndex:  map[string]int{"eth0": 2, "eth1": 3},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 3),
+	}
+	announce.SetBalancer("foo", net.ParseIP("1000::1"))
+	announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+	announce.SetBalancer("bar", net.IPv4(192, 168, 1, 20))
+
+	rec := httptest.NewRecorder()
+	announce.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/layer2", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	var got State
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding state: %s", err)
+	}
+	want := State{
+		ARPResponders: map[string]int{"eth0": 2},
+		NDPResponders: map[string]int{"eth0": 2, "eth1": 3},
+		Services: map[string][]string{
+			"foo": {"1000::1", "192.168.1.20"},
+			"bar": {"192.168.1.20"},
+		},
+		RefCounts: map[string]int{
+			"1000::1":      1,
+			"192.168.1.20": 2,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected state (-want +got)\n%s", diff)
+	}
+}
+
+func TestStats(t *testing.T) {
+	announce := newFakeAnnounce(&fakeFactory{})
+	WithSpamDuration(3 * time.Second)(&announce.cfg)
+	if got := announce.Stats(); !got.LastScan.IsZero() {
+		t.Errorf("expected no scan yet, got %v", got.LastScan)
+	}
+
+	before := time.Now()
+	announce.updateInterfaces()
+	announce.SetBalancerIPs("foo", []net.IP{net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")})
+	announce.SetBalancer("bar", net.IPv4(192, 168, 1, 20))
+	announce.SetBalancer("baz", net.IPv4(192, 168, 1, 21))
+
+	got := announce.Stats()
+	if got.LastScan.Before(before) {
+		t.Errorf("expected the last scan after %v, got %v", before, got.LastScan)
+	}
+	got.LastScan = time.Time{}
+	want := AnnounceStats{
+		IPv4:          2,
+		IPv6:          1,
+		ARPInterfaces: []string{"eth0"},
+		NDPInterfaces: []string{"eth0"},
+		SpamWindow:    3 * time.Second,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected stats (-want +got)\n%s", diff)
+	}
+}
+
+func TestReady(t *testing.T) {
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	unhealthy := errors.New("can't transmit")
+
+	tests := []struct {
+		name    string
+		arps    map[string]responder
+		ndps    map[string]watchingResponder
+		ips     []net.IP
+		wantErr bool
+	}{
+		{
+			name: "nothing announced",
+		},
+		{
+			name: "dual stack",
+			arps: map[string]responder{"eth0": &fakeResponder{intf: "eth0"}},
+			ndps: map[string]watchingResponder{"eth0": &fakeResponder{intf: "eth0"}},
+			ips:  []net.IP{v4, v6},
+		},
+		{
+			name:    "IPv4 without ARP responder",
+			ndps:    map[string]watchingResponder{"eth0": &fakeResponder{intf: "eth0"}},
+			ips:     []net.IP{v4, v6},
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 without NDP responder",
+			arps:    map[string]responder{"eth0": &fakeResponder{intf: "eth0"}},
+			ips:     []net.IP{v4, v6},
+			wantErr: true,
+		},
+		{
+			name: "IPv4 only without NDP responder",
+			arps: map[string]responder{"eth0": &fakeResponder{intf: "eth0"}},
+			ips:  []net.IP{v4},
+		},
+		{
+			name:    "unhealthy ARP responder",
+			arps:    map[string]responder{"eth0": &fakeResponder{intf: "eth0", probeErr: unhealthy}},
+			ips:     []net.IP{v4},
+			wantErr: true,
+		},
+		{
+			name: "one healthy ARP responder",
+			arps: map[string]responder{
+				"eth0": &fakeResponder{intf: "eth0", probeErr: unhealthy},
+				"eth1": &fakeResponder{intf: "eth1"},
+			},
+			ips: []net.IP{v4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			announce := &Announce{
+				logger:   log.NewNopLogger(),
+				arps:     tt.arps,
+				ndps:     tt.ndps,
+				ips:      map[string][]net.IP{},
+				ipRefcnt: map[ipKey]int{},
+				spamCh:   make(chan net.IP, 2),
+			}
+			announce.SetBalancerIPs("foo", tt.ips)
+
+			err := announce.Ready()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			rec := httptest.NewRecorder()
+			announce.ReadyHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+			want := http.StatusOK
+			if tt.wantErr {
+				want = http.StatusServiceUnavailable
+			}
+			if rec.Code != want {
+				t.Errorf("expected status %d, got %d", want, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// InterfaceEventType tells what happened to the responder of an
+// InterfaceEvent.
+type InterfaceEventType int
+
+const (
+	// InterfaceAdded is sent when a responder was created.
+	InterfaceAdded InterfaceEventType = iota
+	// InterfaceRemoved is sent when a responder was closed.
+	InterfaceRemoved
+)
+
+func (t InterfaceEventType) String() string {
+	switch t {
+	case InterfaceAdded:
+		return "added"
+	case InterfaceRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// InterfaceEvent describes the creation or removal of a responder, see
+// WithEventChannel.
+type InterfaceEvent struct {
+	// Name and Index identify the interface of the responder.
+	Name  string
+	Index int
+	// Protocol is "arp" or "ndp".
+	Protocol string
+	Type     InterfaceEventType
+}
+
+// emit sends ev to the channel set with WithEventChannel, if any, and the
+// matching lifecycle event to the channel set with WithLifecycleEvents. It
+// never blocks: the event is dropped if the channel is full. It must be
+// called with the lock held.
+func (a *Announce) emit(ev InterfaceEvent) {
+	typ := ResponderCreated
+	if ev.Type == InterfaceRemoved {
+		typ = ResponderDeleted
+	}
+	a.emitLifecycle(a.cfg.lifecycleEvents, LifecycleEvent{Type: typ, Interface: ev.Name, Protocol: ev.Protocol})
+	if a.cfg.events == nil {
+		return
+	}
+	select {
+	case a.cfg.events <- ev:
+	default:
+		level.Warn(a.logger).Log("interface", ev.Name, "protocol", ev.Protocol, "event", ev.Type, "msg", "event channel full, dropping interface event")
+	}
+}
+
+// LifecycleEventType tells which action a LifecycleEvent describes.
+type LifecycleEventType int
+
+const (
+	// BalancerSet is sent when an IP is added to a service.
+	BalancerSet LifecycleEventType = iota
+	// BalancerDeleted is sent when an IP is removed from a service.
+	BalancerDeleted
+	// ResponderCreated is sent when a responder was created.
+	ResponderCreated
+	// ResponderDeleted is sent when a responder was closed.
+	ResponderDeleted
+	// GratuitousSent is sent when an interface sent the gratuitous
+	// announcements of an IP.
+	GratuitousSent
+)
+
+func (t LifecycleEventType) String() string {
+	switch t {
+	case BalancerSet:
+		return "balancer-set"
+	case BalancerDeleted:
+		return "balancer-delete"
+	case ResponderCreated:
+		return "responder-created"
+	case ResponderDeleted:
+		return "responder-deleted"
+	case GratuitousSent:
+		return "gratuitous-sent"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the type as its name, so that the events marshal
+// to readable JSON.
+func (t LifecycleEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// LifecycleEvent describes an action of the announcer, see
+// WithLifecycleEvents. The fields which don't apply to the type of the
+// event are left empty.
+type LifecycleEvent struct {
+	Type LifecycleEventType `json:"type"`
+	Time time.Time          `json:"time"`
+	// Service and IP are set for the balancer events, IP for the
+	// gratuitous ones.
+	Service string `json:"service,omitempty"`
+	IP      net.IP `json:"ip,omitempty"`
+	// Interface and Protocol, "arp" or "ndp", are set for the responder
+	// and the gratuitous events.
+	Interface string `json:"interface,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+}
+
+// emitLifecycle stamps ev and sends it to ch, the channel set with
+// WithLifecycleEvents, if any. It never blocks: the event is dropped if ch
+// is full.
+func (a *Announce) emitLifecycle(ch chan<- LifecycleEvent, ev LifecycleEvent) {
+	if ch == nil {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case ch <- ev:
+	default:
+		level.Warn(a.logger).Log("event", ev.Type, "ip", ev.IP, "interface", ev.Interface, "msg", "lifecycle event channel full, dropping event")
+	}
+}
+
+// DropEvent describes a request for an announced IP which was dropped
+// rather than answered, see Announce.RecentDrops.
+type DropEvent struct {
+	Time time.Time
+	// Interface is the interface the request was received on.
+	Interface string
+	Reason    DropReason
+	// Requester is the sender of the request, nil for the ARP probes and
+	// the duplicate address detection solicitations.
+	Requester net.IP
+}
+
+// recordDrop keeps ev among the last drops of ip if ip is announced. It
+// takes the read lock.
+func (a *Announce) recordDrop(ip net.IP, ev DropEvent) {
+	a.RLock()
+	defer a.RUnlock()
+	size := a.cfg.getRecentDrops()
+	if size == 0 || a.ipRefcnt[keyOf(ip)] <= 0 {
+		// The requests for the IPs we don't announce are dropped all
+		// the time, only keep the ones about ours.
+		return
+	}
+	ev.Time = time.Now()
+
+	a.dropsMu.Lock()
+	defer a.dropsMu.Unlock()
+	if a.recentDrops == nil {
+		a.recentDrops = map[ipKey][]DropEvent{}
+	}
+	drops := a.recentDrops[keyOf(ip)]
+	if len(drops) >= size {
+		// Evict the oldest drops, reusing the slice.
+		n := copy(drops, drops[len(drops)-size+1:])
+		drops = drops[:n]
+	}
+	a.recentDrops[keyOf(ip)] = append(drops, ev)
+}
+
+// RecentDrops returns the last requests for ip which were dropped rather
+// than answered, oldest first, to find out why a node sometimes doesn't
+// answer for an IP. Only the drops of the IPs announced at the time are
+// kept, as many per IP as set with WithRecentDrops, and they are
+// forgotten along with the IP.
+func (a *Announce) RecentDrops(ip net.IP) []DropEvent {
+	a.dropsMu.Lock()
+	defer a.dropsMu.Unlock()
+	drops := a.recentDrops[keyOf(ip)]
+	if len(drops) == 0 {
+		return nil
+	}
+	ret := make([]DropEvent, len(drops))
+	for i, ev := range drops {
+		ev.Requester = copyIP(ev.Requester)
+		ret[i] = ev
+	}
+	return ret
+}
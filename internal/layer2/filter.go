@@ -0,0 +1,21 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+// interfaceAllowed returns whether the interface called name may be used
+// for announcements according to the configured name filters.
+func (c *config) interfaceAllowed(name string) bool {
+	if c.denylist[name] {
+		return false
+	}
+	if c.allowlist != nil && !c.allowlist[name] {
+		return false
+	}
+	if c.exclude != nil && c.exclude.MatchString(name) {
+		return false
+	}
+	if c.include != nil && !c.include.MatchString(name) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestInterfaceAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		allowed map[string]bool
+	}{
+		{
+			name: "no filter",
+			allowed: map[string]bool{
+				"eth0":  true,
+				"bond0": true,
+			},
+		},
+		{
+			name: "allowlist",
+			opts: []Option{WithInterfaceAllowlist([]string{"bond0", "eth1"})},
+			allowed: map[string]bool{
+				"eth0":  false,
+				"eth1":  true,
+				"bond0": true,
+			},
+		},
+		{
+			name: "denylist",
+			opts: []Option{WithInterfaceDenylist([]string{"eth0"})},
+			allowed: map[string]bool{
+				"eth0":  false,
+				"eth1":  true,
+				"bond0": true,
+			},
+		},
+		{
+			name: "denylist takes precedence",
+			opts: []Option{
+				WithInterfaceAllowlist([]string{"bond0", "eth1"}),
+				WithInterfaceDenylist([]string{"eth1"}),
+			},
+			allowed: map[string]bool{
+				"eth0":  false,
+				"eth1":  false,
+				"bond0": true,
+			},
+		},
+		{
+			name: "include regex",
+			opts: []Option{WithInterfaceRegex(regexp.MustCompile(`^eth[0-9]+$`), nil)},
+			allowed: map[string]bool{
+				"eth0":     true,
+				"eth12":    true,
+				"eth0.100": false,
+				"cali1234": false,
+			},
+		},
+		{
+			name: "exclude regex",
+			opts: []Option{WithInterfaceRegex(nil, regexp.MustCompile(`^cali.*`))},
+			allowed: map[string]bool{
+				"eth0":     true,
+				"cali1234": false,
+			},
+		},
+		{
+			name: "regexes and lists",
+			opts: []Option{
+				WithInterfaceDenylist([]string{"eth1"}),
+				WithInterfaceRegex(regexp.MustCompile(`^eth[0-9]+$`), regexp.MustCompile(`^eth2$`)),
+			},
+			allowed: map[string]bool{
+				"eth0":     true,
+				"eth1":     false,
+				"eth2":     false,
+				"cali1234": false,
+			},
+		},
+		{
+			name: "empty allowlist",
+			opts: []Option{WithInterfaceAllowlist([]string{})},
+			allowed: map[string]bool{
+				"eth0": true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c config
+			for _, o := range tt.opts {
+				o(&c)
+			}
+			for intf, want := range tt.allowed {
+				if got := c.interfaceAllowed(intf); got != want {
+					t.Errorf("interface %q: expected allowed=%v, got %v", intf, want, got)
+				}
+			}
+		})
+	}
+}
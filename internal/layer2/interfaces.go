@@ -0,0 +1,320 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// interfaceLister lists the network interfaces of the node and their
+// addresses.
+type interfaceLister interface {
+	Interfaces() ([]net.Interface, error)
+	Addrs(ifi *net.Interface) ([]net.Addr, error)
+}
+
+// netInterfaces is the interfaceLister backed by the net package.
+type netInterfaces struct{}
+
+func (netInterfaces) Interfaces() ([]net.Interface, error) { return net.Interfaces() }
+
+func (netInterfaces) Addrs(ifi *net.Interface) ([]net.Addr, error) { return ifi.Addrs() }
+
+// discoveredInterfaces is the interfaceLister listing the interfaces with
+// the function set with WithInterfaceDiscovery, and their addresses with
+// the embedded lister.
+type discoveredInterfaces struct {
+	interfaceLister
+	discover func() ([]net.Interface, error)
+}
+
+func (d discoveredInterfaces) Interfaces() ([]net.Interface, error) { return d.discover() }
+
+// sysfs gives access to the link attributes exposed under /sys/class/net.
+type sysfs interface {
+	// HasMaster returns true if the interface is enslaved to another one,
+	// like a bond.
+	HasMaster(name string) bool
+	// Master returns the name of the interface the interface is enslaved
+	// to.
+	Master(name string) (string, error)
+	// Flags returns the IFF_* flags of the interface.
+	Flags(name string) (uint64, error)
+	// Kind returns the kind of the interface, like "dummy" or "vlan".
+	Kind(name string) (string, error)
+	// Parent returns the name of the interface the interface is stacked
+	// on, like the parent of a macvlan interface.
+	Parent(name string) (string, error)
+	// ActiveSlave returns the name of the active slave of a bond, or an
+	// empty string if the interface is not a bond or has no active slave.
+	ActiveSlave(name string) (string, error)
+}
+
+// noARPFlag is IFF_NOARP.
+const noARPFlag = 0x80
+
+// sysClassNet is where the kernel exposes the link attributes.
+const sysClassNet = "/sys/class/net"
+
+// realSysfs is the sysfs backed by the files under root, or under
+// sysClassNet when root is empty.
+type realSysfs struct {
+	root string
+}
+
+// path returns the path of the attribute attr of the interface name.
+func (s realSysfs) path(name, attr string) string {
+	root := s.root
+	if root == "" {
+		root = sysClassNet
+	}
+	return filepath.Join(root, name, attr)
+}
+
+func (s realSysfs) HasMaster(name string) bool {
+	_, err := os.Stat(s.path(name, "master"))
+	return !os.IsNotExist(err)
+}
+
+func (s realSysfs) Master(name string) (string, error) {
+	link, err := os.Readlink(s.path(name, "master"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+func (s realSysfs) Flags(name string) (uint64, error) {
+	b, err := os.ReadFile(s.path(name, "flags"))
+	if err != nil {
+		return 0, err
+	}
+	return parseFlags(string(b))
+}
+
+// parseFlags parses the contents of a flags file, a number written in hex
+// with a 0x prefix by the kernel, or in decimal.
+func parseFlags(s string) (uint64, error) {
+	flags, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parsing interface flags %q: %s", s, err)
+	}
+	return flags, nil
+}
+
+func (s realSysfs) ActiveSlave(name string) (string, error) {
+	b, err := os.ReadFile(s.path(name, "bonding/active_slave"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (realSysfs) Kind(name string) (string, error) { return linkKind(name) }
+
+func (realSysfs) Parent(name string) (string, error) { return linkParent(name) }
+
+// eligible returns whether ifi may get responders with the settings of
+// cfg, regardless of its addresses.
+func eligible(cfg config, sys sysfs, ifi *net.Interface) bool {
+	if ifi.Flags&net.FlagUp == 0 {
+		return false
+	}
+	if ifi.MTU < cfg.minMTU {
+		return false
+	}
+	if !cfg.announceOnEnslaved && sys.HasMaster(ifi.Name) && !inVRF(cfg, sys, ifi) {
+		return false
+	}
+	if !cfg.announceOnNoARP && !optedIn(cfg, sys, ifi) {
+		// Interfaces whose flags can't be read are not skipped.
+		if flags, err := sys.Flags(ifi.Name); err == nil && flags&noARPFlag != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// inVRF returns whether ifi is enslaved to the VRF opted into responders
+// with WithVRF.
+func inVRF(cfg config, sys sysfs, ifi *net.Interface) bool {
+	if cfg.vrf == "" {
+		return false
+	}
+	master, err := sys.Master(ifi.Name)
+	if err != nil || master != cfg.vrf {
+		return false
+	}
+	kind, err := sys.Kind(master)
+	return err == nil && kind == "vrf"
+}
+
+// optedIn returns whether ifi is of one of the types opted into ARP
+// responders with WithAllowedInterfaceTypes.
+func optedIn(cfg config, sys sysfs, ifi *net.Interface) bool {
+	if len(cfg.interfaceTypes) == 0 {
+		return false
+	}
+	if ifi.Flags&net.FlagLoopback != 0 {
+		return cfg.interfaceTypes[InterfaceTypeLoopback]
+	}
+	if !cfg.interfaceTypes[InterfaceTypeDummy] {
+		return false
+	}
+	kind, err := sys.Kind(ifi.Name)
+	return err == nil && kind == InterfaceTypeDummy
+}
+
+// skippedVirtualLinks returns the names of the interfaces among ifs which
+// get no responders because of cfg.virtualLinkPolicy: the macvlan and
+// ipvlan interfaces, or their parents.
+func skippedVirtualLinks(cfg config, sys sysfs, ifs []net.Interface) map[string]bool {
+	if cfg.virtualLinkPolicy == AnnounceOnParentAndChild {
+		return nil
+	}
+	ret := map[string]bool{}
+	for _, ifi := range ifs {
+		kind, err := sys.Kind(ifi.Name)
+		if err != nil || (kind != "macvlan" && kind != "ipvlan") {
+			continue
+		}
+		switch cfg.virtualLinkPolicy {
+		case AnnounceOnParent:
+			ret[ifi.Name] = true
+		case AnnounceOnChild:
+			if parent, err := sys.Parent(ifi.Name); err == nil {
+				ret[parent] = true
+			}
+		}
+	}
+	return ret
+}
+
+// activeSlaves returns the active slaves among ifs of the bonds among
+// ifs, which send the gratuitous ARP announcements of their bond when
+// cfg.bondActiveSlave is set, mapped to the name of their bond.
+func activeSlaves(cfg config, sys sysfs, ifs []net.Interface) map[string]string {
+	if !cfg.bondActiveSlave {
+		return nil
+	}
+	present := map[string]bool{}
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagUp != 0 {
+			present[ifi.Name] = true
+		}
+	}
+	ret := map[string]string{}
+	for _, ifi := range ifs {
+		if !eligible(cfg, sys, &ifi) {
+			continue
+		}
+		slave, err := sys.ActiveSlave(ifi.Name)
+		if err != nil || !present[slave] {
+			continue
+		}
+		ret[slave] = ifi.Name
+	}
+	return ret
+}
+
+// wantResponders returns whether ifi, which has the given addresses,
+// should get an ARP responder and an NDP responder with the settings of
+// cfg.
+func wantResponders(cfg config, sys sysfs, ifi *net.Interface, addrs []net.Addr) (arp, ndp bool) {
+	if !eligible(cfg, sys, ifi) {
+		return false, false
+	}
+
+	broadcast := ifi.Flags&net.FlagBroadcast != 0 || optedIn(cfg, sys, ifi)
+	for _, a := range addrs {
+		ipaddr, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipaddr.IP.To4() != nil && broadcast {
+			arp = true
+		}
+		if ipaddr.IP.IsLinkLocalUnicast() {
+			ndp = true
+		}
+	}
+	if set, ok := cfg.interfaceProtocols[ifi.Name]; ok {
+		arp = arp && set&ProtocolARP != 0
+		ndp = ndp && set&ProtocolNDP != 0
+	}
+	return arp && !cfg.disableV4, ndp && !cfg.disableV6
+}
+
+// lacksLinkLocal returns true if addrs holds IPv6 addresses but no
+// link-local one, in which case no NDP responder can be created for the
+// interface: NDP packets must be sent from a link-local address.
+func lacksLinkLocal(addrs []net.Addr) bool {
+	v6 := false
+	for _, a := range addrs {
+		ipaddr, ok := a.(*net.IPNet)
+		if !ok || ipaddr.IP.To4() != nil {
+			continue
+		}
+		if ipaddr.IP.IsLinkLocalUnicast() {
+			return false
+		}
+		v6 = true
+	}
+	return v6
+}
+
+// interfaceSubnets returns the subnets of the IP addresses in addrs.
+func interfaceSubnets(addrs []net.Addr) []*net.IPNet {
+	var ret []*net.IPNet
+	for _, a := range addrs {
+		ipaddr, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ret = append(ret, &net.IPNet{IP: ipaddr.IP.Mask(ipaddr.Mask), Mask: ipaddr.Mask})
+	}
+	return ret
+}
+
+// responderAddrs returns a key of the addresses in addrs the responders
+// depend on: the IPv4 addresses and their masks, and the IPv6 link-local
+// addresses.
+func responderAddrs(addrs []net.Addr) string {
+	var keep []string
+	for _, a := range addrs {
+		ipaddr, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipaddr.IP.To4() != nil || ipaddr.IP.IsLinkLocalUnicast() {
+			keep = append(keep, ipaddr.String())
+		}
+	}
+	sort.Strings(keep)
+	return strings.Join(keep, ",")
+}
+
+// eui64LinkLocal returns the link-local address derived from mac with the
+// modified EUI-64 format of RFC 4291, or nil if mac is not a 48-bit MAC
+// address.
+func eui64LinkLocal(mac net.HardwareAddr) net.IP {
+	if len(mac) != 6 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip
+}
@@ -0,0 +1,750 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSysfs is a sysfs with fixed contents.
+type fakeSysfs struct {
+	masters map[string]bool
+	flags   map[string]uint64
+	kinds   map[string]string
+	parents map[string]string
+
+	// masterNames names the masters of the interfaces in masters.
+	masterNames map[string]string
+	// activeSlaves maps the bonds to their active slave.
+	activeSlaves map[string]string
+}
+
+func (f fakeSysfs) HasMaster(name string) bool { return f.masters[name] }
+
+func (f fakeSysfs) Master(name string) (string, error) {
+	master, ok := f.masterNames[name]
+	if !ok {
+		return "", errors.New("no master")
+	}
+	return master, nil
+}
+
+func (f fakeSysfs) Flags(name string) (uint64, error) {
+	flags, ok := f.flags[name]
+	if !ok {
+		return 0, errors.New("no such file")
+	}
+	return flags, nil
+}
+
+func (f fakeSysfs) Parent(name string) (string, error) {
+	parent, ok := f.parents[name]
+	if !ok {
+		return "", errors.New("no parent")
+	}
+	return parent, nil
+}
+
+func (f fakeSysfs) ActiveSlave(name string) (string, error) {
+	return f.activeSlaves[name], nil
+}
+
+func (f fakeSysfs) Kind(name string) (string, error) {
+	kind, ok := f.kinds[name]
+	if !ok {
+		return "", errors.New("no such link")
+	}
+	return kind, nil
+}
+
+// fakeLister is an interfaceLister returning synthetic interfaces.
+type fakeLister struct {
+	ifs   []net.Interface
+	addrs map[string][]net.Addr
+	err   error
+	// addrErrs makes Addrs fail for some interfaces.
+	addrErrs map[string]error
+}
+
+func (f *fakeLister) Interfaces() ([]net.Interface, error) { return f.ifs, f.err }
+
+func (f *fakeLister) Addrs(ifi *net.Interface) ([]net.Addr, error) {
+	if err := f.addrErrs[ifi.Name]; err != nil {
+		return nil, err
+	}
+	return f.addrs[ifi.Name], nil
+}
+
+func mustCIDR(s string) *net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	n.IP = ip
+	return n
+}
+
+func TestWantResponders(t *testing.T) {
+	v4 := mustCIDR("192.168.1.2/24")
+	v6LL := mustCIDR("fe80::1/64")
+	v6Global := mustCIDR("2001:db8::1/64")
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+
+	tests := []struct {
+		name    string
+		flags   net.Flags
+		addrs   []net.Addr
+		master  bool
+		sysfs   uint64
+		noFlags bool
+		kind    string
+		mtu     int
+		cfg     config
+		arp     bool
+		ndp     bool
+
+		// masterName and masterKind describe the master, if set.
+		masterName string
+		masterKind string
+	}{
+		{
+			name:  "dual stack",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			arp:   true,
+			ndp:   true,
+		},
+		{
+			name:  "down",
+			flags: net.FlagBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+		},
+		{
+			name:  "no broadcast",
+			flags: net.FlagUp,
+			addrs: []net.Addr{v4, v6LL},
+			ndp:   true,
+		},
+		{
+			name:  "no link-local",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6Global},
+			arp:   true,
+		},
+		{
+			name:  "NOARP",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			sysfs: noARPFlag,
+		},
+		{
+			name:  "NOARP announced",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			sysfs: noARPFlag,
+			cfg:   config{announceOnNoARP: true},
+			arp:   true,
+			ndp:   true,
+		},
+		{
+			name:    "unreadable flags",
+			flags:   upBroadcast,
+			addrs:   []net.Addr{v4},
+			noFlags: true,
+			arp:     true,
+		},
+		{
+			name:    "unreadable flags, NOARP announced",
+			flags:   upBroadcast,
+			addrs:   []net.Addr{v4},
+			noFlags: true,
+			cfg:     config{announceOnNoARP: true},
+			arp:     true,
+		},
+		{
+			name:   "bonded",
+			flags:  upBroadcast,
+			addrs:  []net.Addr{v4, v6LL},
+			master: true,
+		},
+		{
+			name:   "enslaved announced",
+			flags:  upBroadcast,
+			addrs:  []net.Addr{v4, v6LL},
+			master: true,
+			cfg:    config{announceOnEnslaved: true},
+			arp:    true,
+			ndp:    true,
+		},
+		{
+			name:  "no master, enslaved announced",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			cfg:   config{announceOnEnslaved: true},
+			arp:   true,
+			ndp:   true,
+		},
+		{
+			name:  "loopback",
+			flags: net.FlagUp | net.FlagLoopback,
+			addrs: []net.Addr{v4},
+		},
+		{
+			name:  "loopback opted in",
+			flags: net.FlagUp | net.FlagLoopback,
+			addrs: []net.Addr{v4},
+			cfg:   config{interfaceTypes: map[string]bool{InterfaceTypeLoopback: true}},
+			arp:   true,
+		},
+		{
+			name:  "loopback, dummy opted in",
+			flags: net.FlagUp | net.FlagLoopback,
+			addrs: []net.Addr{v4},
+			cfg:   config{interfaceTypes: map[string]bool{InterfaceTypeDummy: true}},
+		},
+		{
+			name:  "dummy",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			sysfs: noARPFlag,
+			kind:  "dummy",
+		},
+		{
+			name:  "dummy opted in",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			sysfs: noARPFlag,
+			kind:  "dummy",
+			cfg:   config{interfaceTypes: map[string]bool{InterfaceTypeDummy: true}},
+			arp:   true,
+			ndp:   true,
+		},
+		{
+			name:  "NOARP vlan, dummy opted in",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			sysfs: noARPFlag,
+			kind:  "vlan",
+			cfg:   config{interfaceTypes: map[string]bool{InterfaceTypeDummy: true}},
+		},
+		{
+			name:  "MTU above minimum",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			mtu:   1500,
+			cfg:   config{minMTU: 1280},
+			arp:   true,
+			ndp:   true,
+		},
+		{
+			name:  "MTU at minimum",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			mtu:   1280,
+			cfg:   config{minMTU: 1280},
+			arp:   true,
+			ndp:   true,
+		},
+		{
+			name:  "MTU below minimum",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			mtu:   576,
+			cfg:   config{minMTU: 1280},
+		},
+		{
+			name:  "IPv4 disabled",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			cfg:   config{disableV4: true},
+			ndp:   true,
+		},
+		{
+			name:  "IPv6 disabled",
+			flags: upBroadcast,
+			addrs: []net.Addr{v4, v6LL},
+			cfg:   config{disableV6: true},
+			arp:   true,
+		},
+		{
+			name:       "VRF member",
+			flags:      upBroadcast,
+			addrs:      []net.Addr{v4, v6LL},
+			master:     true,
+			masterName: "vrf-blue",
+			masterKind: "vrf",
+		},
+		{
+			name:       "VRF member, VRF opted in",
+			flags:      upBroadcast,
+			addrs:      []net.Addr{v4, v6LL},
+			master:     true,
+			masterName: "vrf-blue",
+			masterKind: "vrf",
+			cfg:        config{vrf: "vrf-blue"},
+			arp:        true,
+			ndp:        true,
+		},
+		{
+			name:       "VRF member, other VRF opted in",
+			flags:      upBroadcast,
+			addrs:      []net.Addr{v4, v6LL},
+			master:     true,
+			masterName: "vrf-red",
+			masterKind: "vrf",
+			cfg:        config{vrf: "vrf-blue"},
+		},
+		{
+			name:       "bond member, VRF opted in",
+			flags:      upBroadcast,
+			addrs:      []net.Addr{v4, v6LL},
+			master:     true,
+			masterName: "bond0",
+			masterKind: "bond",
+			cfg:        config{vrf: "bond0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sys := fakeSysfs{
+				masters: map[string]bool{"eth0": tt.master},
+				flags:   map[string]uint64{"eth0": tt.sysfs},
+				kinds:   map[string]string{"eth0": tt.kind},
+			}
+			if tt.masterName != "" {
+				sys.masterNames = map[string]string{"eth0": tt.masterName}
+				sys.kinds[tt.masterName] = tt.masterKind
+			}
+			if tt.noFlags {
+				sys.flags = nil
+			}
+			ifi := &net.Interface{Index: 1, Name: "eth0", Flags: tt.flags, MTU: tt.mtu}
+			arp, ndp := wantResponders(tt.cfg, sys, ifi, tt.addrs)
+			if arp != tt.arp || ndp != tt.ndp {
+				t.Fatalf("expected arp=%v ndp=%v, got arp=%v ndp=%v", tt.arp, tt.ndp, arp, ndp)
+			}
+		})
+	}
+}
+
+func TestUpdateInterfacesDeletesResponders(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	ndp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		lister: &fakeLister{
+			ifs: []net.Interface{{Index: 1, Name: "eth0", Flags: net.FlagBroadcast}},
+			addrs: map[string][]net.Addr{
+				"eth0": {mustCIDR("192.168.1.2/24"), mustCIDR("fe80::1/64")},
+			},
+		},
+		sys:      fakeSysfs{},
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{"eth0": ndp},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		done:     make(chan struct{}),
+	}
+
+	// eth0 went down.
+	announce.updateInterfaces()
+
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("responders of a down interface were not deleted")
+	}
+	if !arp.closed || !ndp.closed {
+		t.Fatalf("responders of a down interface were not closed")
+	}
+	for _, proto := range []string{"arp", "ndp"} {
+		if v := ptu.ToFloat64(stats.responders.WithLabelValues(proto)); v != 0 {
+			t.Errorf("expected no active %s responders, got %v", proto, v)
+		}
+	}
+}
+
+func TestUpdateInterfacesIndexReuse(t *testing.T) {
+	oldARP := &fakeResponder{intf: "eth0"}
+	oldNDP := &fakeResponder{intf: "eth0"}
+	var created []string
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		lister: &fakeLister{
+			// eth0 was deleted and recreated with another index.
+			ifs: []net.Interface{{Index: 7, Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast}},
+			addrs: map[string][]net.Addr{
+				"eth0": {mustCIDR("192.168.1.2/24"), mustCIDR("fe80::1/64")},
+			},
+		},
+		sys: fakeSysfs{},
+		newARP: func(ifi *net.Interface) (responder, error) {
+			created = append(created, "arp")
+			return &fakeResponder{intf: ifi.Name}, nil
+		},
+		newNDP: func(ifi *net.Interface) (watchingResponder, error) {
+			created = append(created, "ndp")
+			return &fakeResponder{intf: ifi.Name}, nil
+		},
+		arps:     map[string]responder{"eth0": oldARP},
+		ndps:     map[string]watchingResponder{"eth0": oldNDP},
+		ifIndex:  map[string]int{"eth0": 3},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		done:     make(chan struct{}),
+	}
+
+	announce.updateInterfaces()
+
+	if !oldARP.closed || !oldNDP.closed {
+		t.Fatalf("responders of the old interface were not closed")
+	}
+	if len(created) != 2 {
+		t.Fatalf("expected fresh ARP and NDP responders, got %v", created)
+	}
+	if announce.arps["eth0"] == oldARP || announce.ndps["eth0"] == oldNDP {
+		t.Fatalf("responders of the old interface were kept")
+	}
+	if idx := announce.ifIndex["eth0"]; idx != 7 {
+		t.Fatalf("expected eth0 to be recorded with index 7, got %d", idx)
+	}
+
+	// Nothing changes on the next scan.
+	announce.updateInterfaces()
+	if len(created) != 2 {
+		t.Fatalf("expected the responders to be kept, got %v", created)
+	}
+}
+
+func TestUpdateInterfacesEvents(t *testing.T) {
+	events := make(chan InterfaceEvent, 10)
+	lister := &fakeLister{
+		ifs: []net.Interface{{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast}},
+		addrs: map[string][]net.Addr{
+			"eth0": {mustCIDR("192.168.1.2/24"), mustCIDR("fe80::1/64")},
+		},
+	}
+	announce := &Announce{
+		logger: log.NewNopLogger(),
+		cfg:    config{events: events},
+		lister: lister,
+		sys:    fakeSysfs{},
+		newARP: func(ifi *net.Interface) (responder, error) {
+			return &fakeResponder{intf: ifi.Name}, nil
+		},
+		newNDP: func(ifi *net.Interface) (watchingResponder, error) {
+			return &fakeResponder{intf: ifi.Name}, nil
+		},
+		arps:     map[string]responder{},
+		ndps:     map[string]watchingResponder{},
+		ifIndex:  map[string]int{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		done:     make(chan struct{}),
+	}
+
+	drain := func() []InterfaceEvent {
+		var ret []InterfaceEvent
+		for len(events) > 0 {
+			ret = append(ret, <-events)
+		}
+		return ret
+	}
+
+	announce.updateInterfaces()
+	want := []InterfaceEvent{
+		{Name: "eth0", Index: 2, Protocol: "arp", Type: InterfaceAdded},
+		{Name: "eth0", Index: 2, Protocol: "ndp", Type: InterfaceAdded},
+	}
+	if diff := cmp.Diff(want, drain()); diff != "" {
+		t.Fatalf("unexpected events when eth0 came up (-want +got)\n%s", diff)
+	}
+
+	// eth0 went down.
+	lister.ifs[0].Flags = net.FlagBroadcast
+	announce.updateInterfaces()
+	got := drain()
+	sort.Slice(got, func(i, j int) bool { return got[i].Protocol < got[j].Protocol })
+	want = []InterfaceEvent{
+		{Name: "eth0", Index: 2, Protocol: "arp", Type: InterfaceRemoved},
+		{Name: "eth0", Index: 2, Protocol: "ndp", Type: InterfaceRemoved},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected events when eth0 went down (-want +got)\n%s", diff)
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	events := make(chan LifecycleEvent, 10)
+	announce := newFakeAnnounce(&fakeFactory{})
+	WithLifecycleEvents(events)(&announce.cfg)
+	drain := func() []LifecycleEvent {
+		var ret []LifecycleEvent
+		for len(events) > 0 {
+			ev := <-events
+			if ev.Time.IsZero() {
+				t.Errorf("expected %s event to be stamped", ev.Type)
+			}
+			ev.Time = time.Time{}
+			ret = append(ret, ev)
+		}
+		return ret
+	}
+
+	announce.updateInterfaces()
+	ip := net.IPv4(192, 168, 1, 20).To4()
+	announce.SetBalancer("foo", ip)
+	announce.gratuitous(<-announce.spamCh)
+	announce.DeleteBalancer("foo")
+	want := []LifecycleEvent{
+		{Type: ResponderCreated, Interface: "eth0", Protocol: "arp"},
+		{Type: ResponderCreated, Interface: "eth0", Protocol: "ndp"},
+		{Type: BalancerSet, Service: "foo", IP: ip},
+		{Type: GratuitousSent, IP: ip, Interface: "eth0", Protocol: "arp"},
+		{Type: BalancerDeleted, Service: "foo", IP: ip},
+	}
+	got := drain()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected events across a set/delete cycle (-want +got)\n%s", diff)
+	}
+
+	b, err := json.Marshal(got[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"balancer-set","time":"0001-01-01T00:00:00Z","service":"foo","ip":"192.168.1.20"}`; string(b) != want {
+		t.Errorf("expected %s, got %s", want, b)
+	}
+}
+
+func TestEUI64LinkLocal(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	if got, want := eui64LinkLocal(mac), net.ParseIP("fe80::5054:ff:fe12:3456"); !got.Equal(want) {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got := eui64LinkLocal(nil); got != nil {
+		t.Errorf("expected no address without a MAC, got %s", got)
+	}
+}
+
+func TestUpdateInterfacesEnsureLinkLocal(t *testing.T) {
+	var buf bytes.Buffer
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	announce.logger = log.NewLogfmtLogger(&buf)
+	WithEnsureLinkLocal(true)(&announce.cfg)
+	lister := announce.lister.(*fakeLister)
+	// eth0 only has a global IPv6 address.
+	lister.addrs["eth0"] = []net.Addr{mustCIDR("2001:db8::2/64")}
+	lister.ifs[0].HardwareAddr = net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+
+	announce.updateInterfaces()
+	announce.updateInterfaces()
+	if len(factory.ndps) != 0 {
+		t.Fatalf("expected no NDP responder without a link-local address, got %d", len(factory.ndps))
+	}
+	if n := strings.Count(buf.String(), "no link-local address"); n != 1 {
+		t.Fatalf("expected the missing link-local address to be reported once, got %d times:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "fe80::5054:ff:fe12:3456/64 dev eth0") {
+		t.Errorf("expected the EUI-64 link-local address to be suggested, got:\n%s", buf.String())
+	}
+
+	// Once the address is added the responder is created, and the report
+	// is reset.
+	lister.addrs["eth0"] = append(lister.addrs["eth0"], mustCIDR("fe80::5054:ff:fe12:3456/64"))
+	announce.updateInterfaces()
+	if len(factory.ndps) != 1 {
+		t.Errorf("expected an NDP responder with a link-local address, got %d", len(factory.ndps))
+	}
+	if len(announce.noLinkLocal) != 0 {
+		t.Errorf("expected the report to be reset, got %v", announce.noLinkLocal)
+	}
+
+	// Without the option, nothing is reported.
+	buf.Reset()
+	announce = newFakeAnnounce(&fakeFactory{})
+	announce.logger = log.NewLogfmtLogger(&buf)
+	announce.lister.(*fakeLister).addrs["eth0"] = []net.Addr{mustCIDR("2001:db8::2/64")}
+	announce.updateInterfaces()
+	if strings.Contains(buf.String(), "no link-local address") {
+		t.Errorf("expected no report without WithEnsureLinkLocal, got:\n%s", buf.String())
+	}
+}
+
+func TestUpdateInterfacesVirtualLinkPolicy(t *testing.T) {
+	tests := []struct {
+		desc   string
+		policy VirtualLinkPolicy
+		want   []string
+	}{
+		{"both", AnnounceOnParentAndChild, []string{"eth0", "eth1", "ipv0", "mv0"}},
+		{"parent", AnnounceOnParent, []string{"eth0", "eth1"}},
+		{"child", AnnounceOnChild, []string{"eth1", "ipv0", "mv0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			announce := newFakeAnnounce(&fakeFactory{})
+			WithVirtualLinkPolicy(test.policy)(&announce.cfg)
+			announce.sys = fakeSysfs{
+				kinds:   map[string]string{"mv0": "macvlan", "ipv0": "ipvlan", "eth1": "veth"},
+				parents: map[string]string{"mv0": "eth0", "ipv0": "eth0"},
+			}
+			lister := announce.lister.(*fakeLister)
+			for i, name := range []string{"eth1", "mv0", "ipv0"} {
+				lister.ifs = append(lister.ifs, net.Interface{
+					Index:        i + 2,
+					Name:         name,
+					Flags:        net.FlagUp | net.FlagBroadcast,
+					HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 2)},
+				})
+				lister.addrs[name] = []net.Addr{mustCIDR(fmt.Sprintf("192.168.%d.2/24", i+2))}
+			}
+
+			announce.updateInterfaces()
+			var got []string
+			for name := range announce.arps {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("unexpected interfaces (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUpdateInterfacesAddrsError(t *testing.T) {
+	announce := newFakeAnnounce(&fakeFactory{})
+	lister := announce.lister.(*fakeLister)
+	lister.ifs = append(lister.ifs, net.Interface{
+		Index:        2,
+		Name:         "eth1",
+		Flags:        net.FlagUp | net.FlagBroadcast,
+		HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2},
+	})
+	lister.addrs["eth1"] = []net.Addr{mustCIDR("10.0.0.2/24"), mustCIDR("fe80::2/64")}
+
+	// The addresses of eth0 can't be read, eth1 is still processed.
+	lister.addrErrs = map[string]error{"eth0": errors.New("no such device")}
+	announce.updateInterfaces()
+	if announce.arps["eth0"] != nil || announce.ndps["eth0"] != nil {
+		t.Errorf("unexpected responders on eth0")
+	}
+	if announce.arps["eth1"] == nil || announce.ndps["eth1"] == nil {
+		t.Fatalf("expected responders on eth1, got %v and %v", announce.arps, announce.ndps)
+	}
+
+	lister.addrErrs = nil
+	announce.updateInterfaces()
+	if announce.arps["eth0"] == nil || announce.ndps["eth0"] == nil {
+		t.Fatalf("expected responders on eth0, got %v and %v", announce.arps, announce.ndps)
+	}
+
+	// The responders of eth0 are kept while its addresses can't be read.
+	lister.addrErrs = map[string]error{"eth0": errors.New("no such device")}
+	announce.updateInterfaces()
+	if len(announce.arps) != 2 || len(announce.ndps) != 2 {
+		t.Errorf("expected the responders to be kept, got %v and %v", announce.arps, announce.ndps)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		err  bool
+	}{
+		{in: "0x1003\n", want: 0x1003},
+		{in: "0x1083", want: 0x1083},
+		{in: "  4099 \n", want: 4099},
+		{in: "", err: true},
+		{in: "\n", err: true},
+		{in: "up\n", err: true},
+		{in: "0x1003 0x80\n", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseFlags(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("parseFlags(%q): unexpected error %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseFlags(%q) = %#x, want %#x", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRealSysfs(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, attr, contents string) {
+		if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name, attr), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("eth0", "flags", "0x1003\n")
+	write("noarp0", "flags", "0x1083\n")
+	write("bad0", "flags", "garbage\n")
+	write("bond0", "flags", "0x1403\n")
+	write("eth1", "flags", "0x1803\n")
+	if err := os.Symlink("../bond0", filepath.Join(root, "eth1", "master")); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join("bond0", "bonding"), "active_slave", "eth1\n")
+	sys := realSysfs{root: root}
+
+	if flags, err := sys.Flags("eth0"); err != nil || flags != 0x1003 {
+		t.Errorf("unexpected flags for eth0: %#x, %v", flags, err)
+	}
+	if _, err := sys.Flags("bad0"); err == nil {
+		t.Errorf("expected an error for malformed flags")
+	}
+	if _, err := sys.Flags("missing0"); err == nil {
+		t.Errorf("expected an error for a missing interface")
+	}
+	if sys.HasMaster("eth0") {
+		t.Errorf("eth0 has no master")
+	}
+	if master, err := sys.Master("eth1"); !sys.HasMaster("eth1") || err != nil || master != "bond0" {
+		t.Errorf("expected eth1 to be enslaved to bond0, got %q, %v", master, err)
+	}
+	if slave, err := sys.ActiveSlave("bond0"); err != nil || slave != "eth1" {
+		t.Errorf("expected eth1 to be the active slave of bond0, got %q, %v", slave, err)
+	}
+	if slave, err := sys.ActiveSlave("eth0"); err != nil || slave != "" {
+		t.Errorf("expected eth0 to have no active slave, got %q, %v", slave, err)
+	}
+
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"eth0", true},
+		{"noarp0", false},
+		// Interfaces whose flags can't be read are not skipped.
+		{"bad0", true},
+		{"eth1", false},
+	} {
+		ifi := &net.Interface{Index: 1, Name: test.name, Flags: upBroadcast}
+		if got := eligible(config{}, sys, ifi); got != test.want {
+			t.Errorf("eligible(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier:Apache-2.0
+
+//go:build linux
+// +build linux
+
+package layer2
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// watchLinks returns a channel receiving a value whenever a link or an
+// address is added, changed or removed, until done is closed.
+func watchLinks(done <-chan struct{}) (<-chan struct{}, error) {
+	links := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		return nil, err
+	}
+	addrs := make(chan netlink.AddrUpdate)
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		return nil, err
+	}
+
+	ret := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case _, ok := <-links:
+				if !ok {
+					return
+				}
+			case _, ok := <-addrs:
+				if !ok {
+					return
+				}
+			case <-done:
+				return
+			}
+			select {
+			case ret <- struct{}{}:
+			default:
+				// A rescan is already pending, it will see this change too.
+			}
+		}
+	}()
+	return ret, nil
+}
+
+// linkKind returns the kind of the named link, like "dummy" or "vlan".
+func linkKind(name string) (string, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return "", err
+	}
+	return link.Type(), nil
+}
+
+// linkParent returns the name of the link the named link is stacked on,
+// like the parent of a macvlan interface.
+func linkParent(name string) (string, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return "", err
+	}
+	if link.Attrs().ParentIndex == 0 {
+		return "", fmt.Errorf("link %q has no parent", name)
+	}
+	parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+	if err != nil {
+		return "", err
+	}
+	return parent.Attrs().Name, nil
+}
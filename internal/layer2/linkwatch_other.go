@@ -0,0 +1,23 @@
+// SPDX-License-Identifier:Apache-2.0
+
+//go:build !linux
+// +build !linux
+
+package layer2
+
+import "errors"
+
+// watchLinks is only supported on Linux, other platforms rely on polling.
+func watchLinks(done <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errors.New("watching links is not supported on this platform")
+}
+
+// linkKind is only supported on Linux.
+func linkKind(name string) (string, error) {
+	return "", errors.New("link kinds are not supported on this platform")
+}
+
+// linkParent is only supported on Linux.
+func linkParent(name string) (string, error) {
+	return "", errors.New("link parents are not supported on this platform")
+}
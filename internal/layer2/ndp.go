@@ -3,9 +3,12 @@
 package layer2
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"syscall"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -19,12 +22,24 @@ type ndpResponder struct {
 	conn         *ndp.Conn
 	closed       chan struct{}
 	announce     announceFunc
+	conflict     conflictFunc
+	dropped      dropFunc
 	// Refcount of how many watchers for each solicited node
 	// multicast group.
 	solicitedNodeGroups map[string]int64
+	counters            responderCounters
+	// sourceMAC is the MAC address we announce, which is hardwareAddr
+	// unless overridden with WithSourceMAC.
+	sourceMAC net.HardwareAddr
+	// hook is set by WithGratuitousHook.
+	hook GratuitousHook
+	// defendDAD is set by WithDefendDAD.
+	defendDAD bool
+	// noOverride is set by WithNDPOverride.
+	noOverride bool
 }
 
-func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*ndpResponder, error) {
+func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc, conflict conflictFunc, dropped dropFunc, cfg config) (*ndpResponder, error) {
 	// Use link-local address as the source IPv6 address for NDP communications.
 	conn, _, err := ndp.Dial(ifi, ndp.LinkLocal)
 	if err != nil {
@@ -38,7 +53,13 @@ func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 		conn:                conn,
 		closed:              make(chan struct{}),
 		announce:            ann,
+		conflict:            conflict,
+		dropped:             dropped,
 		solicitedNodeGroups: map[string]int64{},
+		sourceMAC:           cfg.announcedMAC(ifi),
+		hook:                cfg.gratuitousHook,
+		defendDAD:           cfg.defendDAD,
+		noOverride:          cfg.ndpNoOverride,
 	}
 	go ret.run()
 	return ret, nil
@@ -46,17 +67,95 @@ func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 
 func (n *ndpResponder) Interface() string { return n.intf }
 
+func (n *ndpResponder) HardwareAddr() net.HardwareAddr { return n.hardwareAddr }
+
 func (n *ndpResponder) Close() error {
 	close(n.closed)
 	return n.conn.Close()
 }
 
+// Stats returns a snapshot of the responder's activity.
+func (n *ndpResponder) Stats() ResponderStat { return n.counters.snapshot() }
+
 func (n *ndpResponder) Gratuitous(ip net.IP) error {
-	err := n.advertise(net.IPv6linklocalallnodes, ip, true)
+	err := n.gratuitous(ip)
+	n.counters.sentGratuitous(err)
+	return err
+}
+
+func (n *ndpResponder) gratuitous(ip net.IP) error {
+	na := advertisement(n.sourceMAC, ip, true)
+	na.Override = !n.noOverride
+	var m ndp.Message = na
+	if n.hook != nil {
+		b, err := ndp.MarshalMessage(m)
+		if err != nil {
+			return fmt.Errorf("assembling gratuitous advertisement for %q: %s", ip, err)
+		}
+		b, send := n.hook(n.intf, ip, b)
+		if !send {
+			return nil
+		}
+		if m, err = ndp.ParseMessage(b); err != nil {
+			return fmt.Errorf("rewriting gratuitous advertisement for %q: %s", ip, err)
+		}
+	}
+	if err := n.conn.WriteTo(m, nil, net.IPv6linklocalallnodes); err != nil {
+		return err
+	}
 	stats.SentGratuitous(ip.String())
+	return nil
+}
+
+// Probe checks that the responder is able to transmit, by sending a
+// router solicitation to the all-routers group. Routers answer with their
+// usual advertisement, so the solicitation is harmless.
+func (n *ndpResponder) Probe() error {
+	err := n.probe()
+	n.counters.probed(err)
 	return err
 }
 
+// Healthy returns whether the last probe succeeded.
+func (n *ndpResponder) Healthy() bool { return n.counters.healthy() }
+
+func (n *ndpResponder) probe() error {
+	m := &ndp.RouterSolicitation{
+		Options: []ndp.Option{
+			&ndp.LinkLayerAddress{
+				Direction: ndp.Source,
+				Addr:      n.hardwareAddr,
+			},
+		},
+	}
+	if err := n.conn.WriteTo(m, nil, net.IPv6linklocalallrouters); err != nil {
+		return fmt.Errorf("writing probe packet on %q: %s", n.intf, err)
+	}
+	return nil
+}
+
+// Solicit sends a neighbor solicitation for ip to its solicited-node
+// multicast group.
+func (n *ndpResponder) Solicit(ip net.IP) error {
+	group, err := ndp.SolicitedNodeMulticast(ip)
+	if err != nil {
+		return fmt.Errorf("looking up solicited node multicast group for %q: %s", ip, err)
+	}
+	m := &ndp.NeighborSolicitation{
+		TargetAddress: ip,
+		Options: []ndp.Option{
+			&ndp.LinkLayerAddress{
+				Direction: ndp.Source,
+				Addr:      n.hardwareAddr,
+			},
+		},
+	}
+	if err := n.conn.WriteTo(m, nil, group); err != nil {
+		return fmt.Errorf("writing solicitation for %q on %q: %s", ip, n.intf, err)
+	}
+	return nil
+}
+
 func (n *ndpResponder) Watch(ip net.IP) error {
 	if ip.To4() != nil {
 		return nil
@@ -71,6 +170,7 @@ func (n *ndpResponder) Watch(ip net.IP) error {
 		}
 	}
 	n.solicitedNodeGroups[group.String()]++
+	n.counters.watched()
 	return nil
 }
 
@@ -82,41 +182,150 @@ func (n *ndpResponder) Unwatch(ip net.IP) error {
 	if err != nil {
 		return fmt.Errorf("looking up solicited node multicast group for %q: %s", ip, err)
 	}
+	if n.solicitedNodeGroups[group.String()] <= 0 {
+		// The watch failed to join the group.
+		return nil
+	}
 	n.solicitedNodeGroups[group.String()]--
 	if n.solicitedNodeGroups[group.String()] == 0 {
 		if err = n.conn.LeaveGroup(group); err != nil {
 			return fmt.Errorf("leaving solicited node multicast group for %q: %s", ip, err)
 		}
 	}
+	n.counters.unwatched()
+	return nil
+}
+
+// Rewatch joins the solicited node multicast group of ip again, in case
+// the membership was lost, e.g. when the interface was recreated, or
+// watches ip if the group couldn't be joined by Watch. It is only called
+// for the IPs which should be watched. Already being a member is not an
+// error.
+func (n *ndpResponder) Rewatch(ip net.IP) error {
+	if ip.To4() != nil {
+		return nil
+	}
+	group, err := ndp.SolicitedNodeMulticast(ip)
+	if err != nil {
+		return fmt.Errorf("looking up solicited node multicast group for %q: %s", ip, err)
+	}
+	if n.solicitedNodeGroups[group.String()] <= 0 {
+		return n.Watch(ip)
+	}
+	if err = n.conn.JoinGroup(group); err != nil && !errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("rejoining solicited node multicast group for %q: %s", ip, err)
+	}
+	return nil
+}
+
+// Withdraw sends an unsolicited advertisement of ip with the Override flag
+// cleared. It is best effort: per RFC 4861 section 7.2.5, the neighbors
+// leave the cache entries which already point at us unchanged, they move
+// to the new owner when it overrides the entries or once they expire.
+func (n *ndpResponder) Withdraw(ip net.IP) error {
+	if ip.To4() != nil {
+		return nil
+	}
+	if err := n.conn.WriteTo(withdrawal(n.sourceMAC, ip), nil, net.IPv6linklocalallnodes); err != nil {
+		return fmt.Errorf("writing withdrawal of %q on %q: %s", ip, n.intf, err)
+	}
 	return nil
 }
 
 func (n *ndpResponder) run() {
-	for n.processRequest() != dropReasonClosed {
+	for {
+		reason, ip, requester := n.processRequest()
+		if reason == DropReasonClosed {
+			return
+		}
+		if reason != DropReasonNone {
+			stats.Dropped("ndp", n.intf, reason)
+			if n.dropped != nil {
+				n.dropped(ip, n.intf, requester, reason)
+			}
+		}
 	}
 }
 
-func (n *ndpResponder) processRequest() dropReason {
+// processRequest reads a message and answers it if needed. It returns why
+// the message was dropped, the target IP of the neighbor solicitation or
+// advertisement, and the source IP of the solicitation unless it is a
+// duplicate address detection one.
+func (n *ndpResponder) processRequest() (DropReason, net.IP, net.IP) {
 	msg, _, src, err := n.conn.ReadFrom()
 	if err != nil {
 		select {
 		case <-n.closed:
-			return dropReasonClosed
+			return DropReasonClosed, nil, nil
 		default:
 		}
 		if err == io.EOF {
-			return dropReasonClosed
+			return DropReasonClosed, nil, nil
 		}
-		return dropReasonError
+		return DropReasonError, nil, nil
+	}
+
+	if na, ok := msg.(*ndp.NeighborAdvertisement); ok {
+		n.checkConflict(na)
+		return DropReasonMessageType, na.TargetAddress, nil
 	}
 
 	ns, ok := msg.(*ndp.NeighborSolicitation)
 	if !ok {
-		return dropReasonMessageType
+		return DropReasonMessageType, nil, nil
 	}
+	stats.ResponderRequest("ndp", n.intf)
 
-	// Retrieve sender's source link-layer address
-	var nsLLAddr net.HardwareAddr
+	requester := src
+	if requester.IsUnspecified() {
+		requester = nil
+	}
+	na, dst, reason := n.answer(ns, src)
+	if reason != DropReasonNone {
+		return reason, ns.TargetAddress, requester
+	}
+
+	stats.GotRequest(ns.TargetAddress.String())
+	level.Debug(n.logger).Log("interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", sourceLLAddr(ns), "responseMAC", n.sourceMAC, "msg", "got NDP request for service IP, sending response")
+
+	if err := n.conn.WriteTo(na, nil, dst); err != nil {
+		level.Error(n.logger).Log("op", "arpReply", "interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", sourceLLAddr(ns), "responseMAC", n.sourceMAC, "error", err, "msg", "failed to send ARP reply")
+	} else {
+		stats.SentResponse(ns.TargetAddress.String())
+		stats.ResponderResponse("ndp", n.intf)
+	}
+	return DropReasonNone, ns.TargetAddress, requester
+}
+
+// answer returns the advertisement answering ns, sent from src, along
+// with its destination, or why ns is not answered. When defendDAD is set,
+// the duplicate address detection solicitations, sent from the
+// unspecified address, are answered with an unsolicited advertisement to
+// the all-nodes group as RFC 4861 requires.
+func (n *ndpResponder) answer(ns *ndp.NeighborSolicitation, src net.IP) (*ndp.NeighborAdvertisement, net.IP, DropReason) {
+	if n.defendDAD && src.IsUnspecified() {
+		// DAD solicitations have no source link-layer address, nor
+		// a sender to check against the ACL.
+		if reason := n.announce(ns.TargetAddress, n.intf, nil); reason != DropReasonNone {
+			return nil, nil, reason
+		}
+		return advertisement(n.sourceMAC, ns.TargetAddress, true), net.IPv6linklocalallnodes, DropReasonNone
+	}
+
+	if sourceLLAddr(ns) == nil {
+		return nil, nil, DropReasonNoSourceLL
+	}
+
+	// Ignore NDP requests that the announcer tells us to ignore.
+	if reason := n.announce(ns.TargetAddress, n.intf, src); reason != DropReasonNone {
+		return nil, nil, reason
+	}
+	return advertisement(n.sourceMAC, ns.TargetAddress, false), src, DropReasonNone
+}
+
+// sourceLLAddr returns the source link-layer address option of ns, or nil
+// if it has none.
+func sourceLLAddr(ns *ndp.NeighborSolicitation) net.HardwareAddr {
 	for _, o := range ns.Options {
 		// Ignore other options, including target link-layer address instead of source.
 		lla, ok := o.(*ndp.LinkLayerAddress)
@@ -126,41 +335,48 @@ func (n *ndpResponder) processRequest() dropReason {
 		if lla.Direction != ndp.Source {
 			continue
 		}
-
-		nsLLAddr = lla.Addr
-		break
-	}
-	if nsLLAddr == nil {
-		return dropReasonNoSourceLL
+		return lla.Addr
 	}
+	return nil
+}
 
-	// Ignore NDP requests that the announcer tells us to ignore.
-	if reason := n.announce(ns.TargetAddress); reason != dropReasonNone {
-		return reason
+// checkConflict reports na if it advertises a link-layer address other
+// than ours.
+func (n *ndpResponder) checkConflict(na *ndp.NeighborAdvertisement) {
+	if n.conflict == nil {
+		return
 	}
-
-	stats.GotRequest(ns.TargetAddress.String())
-	level.Debug(n.logger).Log("interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", n.hardwareAddr, "msg", "got NDP request for service IP, sending response")
-
-	if err := n.advertise(src, ns.TargetAddress, false); err != nil {
-		level.Error(n.logger).Log("op", "arpReply", "interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", n.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
-	} else {
-		stats.SentResponse(ns.TargetAddress.String())
+	for _, o := range na.Options {
+		lla, ok := o.(*ndp.LinkLayerAddress)
+		if !ok || lla.Direction != ndp.Target {
+			continue
+		}
+		if !bytes.Equal(lla.Addr, n.hardwareAddr) && !bytes.Equal(lla.Addr, n.sourceMAC) {
+			n.conflict(na.TargetAddress, lla.Addr, n.intf)
+		}
+		return
 	}
-	return dropReasonNone
 }
 
-func (n *ndpResponder) advertise(dst, target net.IP, gratuitous bool) error {
-	m := &ndp.NeighborAdvertisement{
+// advertisement returns a neighbor advertisement of target at mac.
+func advertisement(mac net.HardwareAddr, target net.IP, gratuitous bool) *ndp.NeighborAdvertisement {
+	return &ndp.NeighborAdvertisement{
 		Solicited:     !gratuitous, // <Adam Jensen> I never asked for this...
 		Override:      gratuitous,  // Should clients replace existing cache entries
 		TargetAddress: target,
 		Options: []ndp.Option{
 			&ndp.LinkLayerAddress{
 				Direction: ndp.Target,
-				Addr:      n.hardwareAddr,
+				Addr:      mac,
 			},
 		},
 	}
-	return n.conn.WriteTo(m, nil, dst)
+}
+
+// withdrawal returns the unsolicited advertisement of target at mac sent
+// by Withdraw, which doesn't override the existing cache entries.
+func withdrawal(mac net.HardwareAddr, target net.IP) *ndp.NeighborAdvertisement {
+	na := advertisement(mac, target, true)
+	na.Override = false
+	return na
 }
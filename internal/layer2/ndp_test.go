@@ -0,0 +1,131 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/ndp"
+)
+
+func TestAdvertisementSourceMAC(t *testing.T) {
+	ifi := &net.Interface{Index: 1, Name: "bond0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	virtualMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0xaa}
+	c := config{sourceMAC: virtualMAC}
+
+	na := advertisement(c.announcedMAC(ifi), net.ParseIP("1000::1"), true)
+	if !na.Override || na.Solicited {
+		t.Errorf("expected an unsolicited overriding advertisement, got %+v", na)
+	}
+	want := []ndp.Option{&ndp.LinkLayerAddress{Direction: ndp.Target, Addr: virtualMAC}}
+	if diff := cmp.Diff(want, na.Options); diff != "" {
+		t.Errorf("unexpected options (-want +got)\n%s", diff)
+	}
+}
+
+func TestWithdrawal(t *testing.T) {
+	na := withdrawal(net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.ParseIP("1000::1"))
+	if na.Override || na.Solicited {
+		t.Errorf("expected an unsolicited advertisement without override, got %+v", na)
+	}
+}
+
+func TestNDPGratuitousOverride(t *testing.T) {
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	ip := net.ParseIP("1000::1")
+	for _, test := range []struct {
+		opts     []Option
+		override bool
+	}{
+		// The flag is set by default.
+		{nil, true},
+		{[]Option{WithNDPOverride(true)}, true},
+		{[]Option{WithNDPOverride(false)}, false},
+	} {
+		var cfg config
+		for _, o := range test.opts {
+			o(&cfg)
+		}
+		override := test.override
+		var sent []byte
+		n := &ndpResponder{
+			intf:       "eth0",
+			sourceMAC:  mac,
+			noOverride: cfg.ndpNoOverride,
+			// Capture the advertisement rather than sending it.
+			hook: func(intf string, ip net.IP, b []byte) ([]byte, bool) {
+				sent = b
+				return b, false
+			},
+		}
+		if err := n.gratuitous(ip); err != nil {
+			t.Fatalf("override=%v: %s", override, err)
+		}
+		m, err := ndp.ParseMessage(sent)
+		if err != nil {
+			t.Fatalf("override=%v: parsing the advertisement: %s", override, err)
+		}
+		na, ok := m.(*ndp.NeighborAdvertisement)
+		if !ok {
+			t.Fatalf("override=%v: expected a neighbor advertisement, got %T", override, m)
+		}
+		if na.Override != override || na.Solicited || !na.TargetAddress.Equal(ip) {
+			t.Errorf("override=%v: unexpected advertisement %+v", override, na)
+		}
+	}
+}
+
+func TestNDPAnswerDAD(t *testing.T) {
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	announced := net.ParseIP("1000::1")
+	n := &ndpResponder{
+		intf:         "eth0",
+		hardwareAddr: mac,
+		sourceMAC:    mac,
+		announce: func(ip net.IP, intf string, requester net.IP) DropReason {
+			if ip.Equal(announced) {
+				return DropReasonNone
+			}
+			return DropReasonAnnounceIP
+		},
+	}
+	// Sent from the unspecified address, without a source link-layer
+	// address.
+	dad := func(target net.IP) *ndp.NeighborSolicitation {
+		return &ndp.NeighborSolicitation{TargetAddress: target}
+	}
+
+	if _, _, reason := n.answer(dad(announced), net.IPv6unspecified); reason != DropReasonNoSourceLL {
+		t.Errorf("expected the DAD solicitation to be ignored by default, got %v", reason)
+	}
+
+	n.defendDAD = true
+	na, dst, reason := n.answer(dad(announced), net.IPv6unspecified)
+	if reason != DropReasonNone {
+		t.Fatalf("expected the DAD solicitation to be answered, got %v", reason)
+	}
+	if !dst.Equal(net.IPv6linklocalallnodes) {
+		t.Errorf("expected the advertisement to be sent to all nodes, got %s", dst)
+	}
+	if diff := cmp.Diff(advertisement(mac, announced, true), na); diff != "" {
+		t.Errorf("unexpected advertisement (-want +got)\n%s", diff)
+	}
+
+	if _, _, reason := n.answer(dad(net.ParseIP("1000::2")), net.IPv6unspecified); reason != DropReasonAnnounceIP {
+		t.Errorf("expected the DAD solicitation of another IP to be ignored, got %v", reason)
+	}
+
+	// The regular solicitations are answered to their sender.
+	src := net.ParseIP("fe80::2")
+	ns := dad(announced)
+	ns.Options = []ndp.Option{&ndp.LinkLayerAddress{Direction: ndp.Source, Addr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}}
+	na, dst, reason = n.answer(ns, src)
+	if reason != DropReasonNone {
+		t.Fatalf("expected the solicitation to be answered, got %v", reason)
+	}
+	if !dst.Equal(src) || !na.Solicited {
+		t.Errorf("expected a solicited advertisement to %s, got %+v to %s", src, na, dst)
+	}
+}
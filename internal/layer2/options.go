@@ -0,0 +1,1176 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// defaultScanInterval is how often interfaces are rescanned by default.
+	defaultScanInterval = 10 * time.Second
+	// minScanRetry is the delay before retrying a failed interface scan,
+	// doubled for each consecutive failure up to the scan interval.
+	minScanRetry = 100 * time.Millisecond
+	// minSpamInterval is the smallest delay allowed between gratuitous
+	// announcements of an IP, to avoid flooding the network.
+	minSpamInterval = 100 * time.Millisecond
+	// defaultGratuitousTimeout is how long a gratuitous announcement may
+	// take by default before we stop waiting for it.
+	defaultGratuitousTimeout = time.Second
+	// gratuitousBurstDelay is the delay between the packets of a burst,
+	// see WithGratuitousBurst.
+	gratuitousBurstDelay = 10 * time.Millisecond
+	// defaultNDPReWatchInterval is how often the NDP multicast groups of
+	// the announced IPs are joined again by default.
+	defaultNDPReWatchInterval = time.Minute
+	// defaultRecentDrops is the number of drops kept per IP for
+	// Announce.RecentDrops by default.
+	defaultRecentDrops = 16
+	// handoverBurst is the number of gratuitous packets sent per
+	// responder by Announce.Handover.
+	handoverBurst = 3
+	// defaultSpamChannelSize is the default number of IPs waiting to be
+	// handled by the spam loop.
+	defaultSpamChannelSize = 1024
+)
+
+// Option configures optional behavior of an Announce.
+type Option func(*config)
+
+// config holds the optional settings of an Announce. The zero value
+// gives the default behavior.
+type config struct {
+	// runtime is set while applying options to a running Announce, see
+	// Announce.Configure.
+	runtime bool
+	// err records the first invalid option.
+	err error
+
+	// roleFile is the path of a file assigning roles to interfaces. When
+	// set, only interfaces with the frontend role get responders.
+	roleFile string
+	// waitRouting makes the announcer hold off on IPs until routing is
+	// marked ready for them with Announce.SetRoutingReady.
+	waitRouting bool
+	// senderOnLink makes the ARP responders ignore requests from senders
+	// outside of the subnet of the requested IP.
+	senderOnLink bool
+	// requesterACL restricts the hosts whose requests are answered,
+	// see WithRequesterACL. It is never modified in place.
+	requesterACL []*net.IPNet
+	// defendOnProbe makes the ARP responders answer ARP probes.
+	defendOnProbe bool
+	// defendDAD makes the NDP responders answer the duplicate address
+	// detection solicitations.
+	defendDAD bool
+	// ndpNoOverride clears the Override flag of the gratuitous neighbor
+	// advertisements, see WithNDPOverride.
+	ndpNoOverride bool
+	// subnetOnly makes the ARP responders ignore requests from senders
+	// outside of the subnets of the interface.
+	subnetOnly bool
+	// onlyMatchingSubnet restricts the announcements of an IP to the
+	// interfaces with a subnet containing it.
+	onlyMatchingSubnet bool
+	// interfacePriority holds the priorities of the interfaces, see
+	// WithInterfacePriority.
+	interfacePriority map[string]int
+	// segmentGroups maps the interfaces to their L2 segment, see
+	// WithSegmentGroups.
+	segmentGroups map[string]string
+	// segmentsBySubnet puts the interfaces with a subnet containing an IP
+	// on the same L2 segment, see WithSegmentsBySubnet.
+	segmentsBySubnet bool
+	// scheduler decides when gratuitous announcements are sent, the
+	// default scheduler is used when nil.
+	scheduler Scheduler
+	// keepaliveInterval is the delay between the periodic announcements
+	// of all the owned IPs, they are disabled when zero.
+	keepaliveInterval time.Duration
+	// scanInterval is the delay between interface scans, the default is
+	// used when zero.
+	scanInterval time.Duration
+	// minMTU is the smallest MTU of the interfaces getting responders,
+	// see WithMinInterfaceMTU.
+	minMTU int
+	// disableV4 and disableV6 turn an IP family off, see
+	// WithDisabledFamilies.
+	disableV4, disableV6 bool
+	// interfaceProtocols restricts the responders of some interfaces,
+	// see WithPerInterfaceProtocols.
+	interfaceProtocols map[string]ProtocolSet
+	// interfaceTypes holds the interface types opted into ARP responders,
+	// see WithAllowedInterfaceTypes.
+	interfaceTypes map[string]bool
+	// virtualLinkPolicy selects the interfaces announced on among the
+	// macvlan and ipvlan interfaces and their parents.
+	virtualLinkPolicy VirtualLinkPolicy
+	// allowlist and denylist restrict the interfaces used for
+	// announcements by name, see interfaceAllowed.
+	allowlist map[string]bool
+	denylist  map[string]bool
+	// include and exclude restrict the interfaces used for announcements
+	// by name pattern, see interfaceAllowed.
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	// discovery lists the interfaces instead of net.Interfaces, see
+	// WithInterfaceDiscovery.
+	discovery func() ([]net.Interface, error)
+	// spamDuration is how long IPs are announced after a change, the
+	// default is used when zero.
+	spamDuration time.Duration
+	// spamInterval is the delay between announcements of an IP, the
+	// default is used when zero.
+	spamInterval time.Duration
+	// spamJitter is the fraction of spamInterval by which each interval is
+	// randomly shortened or lengthened.
+	spamJitter float64
+	// minGratuitousSpacing is the smallest delay between announcements
+	// of an IP, none when zero.
+	minGratuitousSpacing time.Duration
+	// announceOnNoARP lets interfaces flagged NOARP get responders.
+	announceOnNoARP bool
+	// announceOnEnslaved lets interfaces enslaved to a bond or a bridge
+	// get responders.
+	announceOnEnslaved bool
+	// vrf is the name of the VRF whose interfaces get responders, see
+	// WithVRF.
+	vrf string
+	// bondActiveSlave also sends the gratuitous ARP announcements of the
+	// bonds on their active slave, see WithBondActiveSlave.
+	bondActiveSlave bool
+	// ensureLinkLocal reports the interfaces which can't get an NDP
+	// responder for lack of a link-local address.
+	ensureLinkLocal bool
+	// spamChannelSize is the buffer size of the spam channel, the default
+	// is used when zero.
+	spamChannelSize int
+	// maxSpamWindow caps the number of IPs being announced by the default
+	// scheduler, unbounded when zero.
+	maxSpamWindow int
+	// gratuitousRate and gratuitousRateBurst limit the rate of the
+	// gratuitous announcements, see WithGratuitousRateLimit.
+	gratuitousRate      float64
+	gratuitousRateBurst int
+	// sourceMAC replaces the MAC address of the interfaces in the
+	// announcements when set.
+	sourceMAC net.HardwareAddr
+	// gratuitousHook sees the gratuitous announcements before they are
+	// sent, see WithGratuitousHook.
+	gratuitousHook GratuitousHook
+	// gratuitousMode selects the operations of the gratuitous ARP
+	// packets, see WithGratuitousMode.
+	gratuitousMode GratuitousMode
+	// gratuitousTimeout is how long to wait for a gratuitous
+	// announcement, the default is used when zero.
+	gratuitousTimeout time.Duration
+	// gratuitousBurst is the number of packets sent per gratuitous
+	// announcement, the default of 1 is used when zero.
+	gratuitousBurst int
+	// interfaceDebounce is the number of consecutive scans an interface
+	// must be missing from before its responders are deleted, the
+	// default of 1 is used when zero.
+	interfaceDebounce int
+	// responderGrace is how long the responders of a missing interface
+	// are kept, see WithResponderGracePeriod.
+	responderGrace time.Duration
+	// startupStagger is the delay between the creation of the responders
+	// of each interface during the first scan, see WithStartupStagger.
+	startupStagger time.Duration
+	// events receives the InterfaceEvents, see WithEventChannel.
+	events chan<- InterfaceEvent
+	// lifecycleEvents receives the LifecycleEvents, see
+	// WithLifecycleEvents.
+	lifecycleEvents chan<- LifecycleEvent
+	// conflictHandler is called when another host claims an owned IP.
+	conflictHandler func(ip net.IP, mac net.HardwareAddr, intf string)
+	// verbosity filters the per-packet and per-scan logs.
+	verbosity Verbosity
+	// ownershipHandler is called when an IP starts or stops being owned.
+	ownershipHandler func(ip net.IP, owned bool)
+	// spamCompleteHandler is called when the announcements of an IP
+	// are over.
+	spamCompleteHandler func(ip net.IP)
+	// dropHandler is called when a responder drops a packet.
+	dropHandler func(ip net.IP, intf string, reason DropReason)
+	// recentDrops is the number of drops kept per IP for RecentDrops,
+	// the default is used when zero and none are kept when negative.
+	recentDrops int
+	// ndpReWatchInterval is the delay between the NDP re-watches, the
+	// default is used when zero and there are none when negative.
+	ndpReWatchInterval time.Duration
+	// announceGate decides whether this node announces an IP, see
+	// WithAnnounceGate.
+	announceGate func(ip net.IP) bool
+	// leaderElection makes the node announce only while it holds the
+	// lease, see WithLeaderElection.
+	leaderElection bool
+}
+
+// WithInterfaceRoleFile restricts the interfaces used for announcements
+// to those listed with the "frontend" role in the file at path. The file
+// is re-read on every interface scan, so it can be maintained by an
+// external provisioning system. Each line holds an interface name and
+// its role separated by whitespace, and lines starting with # are
+// ignored. A missing or empty file places no restriction.
+func WithInterfaceRoleFile(path string) Option {
+	return func(c *config) {
+		c.roleFile = path
+	}
+}
+
+// WithRoutingReadiness makes the announcer neither answer requests for nor
+// send gratuitous packets about an IP until Announce.SetRoutingReady marks
+// routing as ready for it. It avoids attracting traffic before the routing
+// daemon running alongside MetalLB has installed the routes for the IP.
+func WithRoutingReadiness(enabled bool) Option {
+	return func(c *config) {
+		c.waitRouting = enabled
+	}
+}
+
+// WithSenderOnLinkOnly makes the ARP responders answer a request only if
+// its sender is in the same subnet of the receiving interface as the
+// requested IP. It hardens exposed segments against spoofed or misrouted
+// requests. It can only be set in New.
+func WithSenderOnLinkOnly(enabled bool) Option {
+	return func(c *config) {
+		if c.static("WithSenderOnLinkOnly") {
+			c.senderOnLink = enabled
+		}
+	}
+}
+
+// WithRespondOnSubnetOnly makes the ARP responders answer a request only
+// if its sender is in one of the IPv4 subnets of the receiving interface.
+// Unlike WithSenderOnLinkOnly, the requested IP may be outside of these
+// subnets. It can only be set in New.
+func WithRespondOnSubnetOnly(enabled bool) Option {
+	return func(c *config) {
+		if c.static("WithRespondOnSubnetOnly") {
+			c.subnetOnly = enabled
+		}
+	}
+}
+
+// WithOnlyMatchingSubnet makes the responders answer for an IP only on
+// the interfaces with an address in a subnet containing the IP. By default
+// the IPs are announced on all interfaces, as they need not be in the
+// subnets of the node. This guards multi-homed nodes against answering
+// on the wrong segment.
+func WithOnlyMatchingSubnet(enabled bool) Option {
+	return func(c *config) {
+		c.onlyMatchingSubnet = enabled
+	}
+}
+
+// WithInterfacePriority sets the priorities of the interfaces, the
+// interfaces missing from priorities have priority 0. When several
+// interfaces with responders have a subnet containing an IP, only those
+// with the highest priority answer for it and announce it, the others drop
+// the requests with the lower_priority reason. Interfaces with the same
+// priority all answer. This keeps switches from seeing an IP behind
+// several ports of a multi-homed node. An empty map, the default, answers
+// on all interfaces.
+func WithInterfacePriority(priorities map[string]int) Option {
+	return func(c *config) {
+		c.interfacePriority = nil
+		if len(priorities) == 0 {
+			return
+		}
+		c.interfacePriority = make(map[string]int, len(priorities))
+		for name, prio := range priorities {
+			c.interfacePriority[name] = prio
+		}
+	}
+}
+
+// WithSegmentGroups tells which interfaces are on the same L2 segment,
+// for instance because they are bridged together: groups maps interface
+// names to segment names. The gratuitous announcements of an IP are then
+// sent on a single interface of each segment, the first by name, rather
+// than reaching the same switch port several times. Replies to requests
+// are unaffected. An empty map, the default, sends on all interfaces.
+func WithSegmentGroups(groups map[string]string) Option {
+	return func(c *config) {
+		c.segmentGroups = nil
+		if len(groups) == 0 {
+			return
+		}
+		c.segmentGroups = make(map[string]string, len(groups))
+		for name, group := range groups {
+			c.segmentGroups[name] = group
+		}
+	}
+}
+
+// WithSegmentsBySubnet considers the interfaces with a subnet containing
+// an IP to be on the same L2 segment, so that the gratuitous
+// announcements of the IP are sent on only one of them, like with
+// WithSegmentGroups, which takes precedence for the interfaces it names.
+func WithSegmentsBySubnet(enabled bool) Option {
+	return func(c *config) {
+		c.segmentsBySubnet = enabled
+	}
+}
+
+// WithDefendOnProbe makes the ARP responders answer the ARP probes of
+// RFC 5227, sent with an all-zero sender IP by hosts checking that an IP is
+// free before using it, for the announced IPs. Answering defends the IPs
+// against hosts about to claim them. By default the probes are ignored,
+// since they are not resolution requests. It can only be set in New.
+func WithDefendOnProbe(enabled bool) Option {
+	return func(c *config) {
+		if c.static("WithDefendOnProbe") {
+			c.defendOnProbe = enabled
+		}
+	}
+}
+
+// WithDefendDAD makes the NDP responders answer the duplicate address
+// detection solicitations of RFC 4862, sent from the unspecified address
+// by hosts checking that an IPv6 address is free before using it, for the
+// announced IPs. The answer is an unsolicited advertisement to the
+// all-nodes group, which makes the other host give up the address, so
+// that a host starting up at the same time as the announcements can't
+// take over an IP. By default these solicitations are ignored. It can only
+// be set in New.
+func WithDefendDAD(enabled bool) Option {
+	return func(c *config) {
+		if c.static("WithDefendDAD") {
+			c.defendDAD = enabled
+		}
+	}
+}
+
+// WithNDPOverride sets the Override flag of the unsolicited neighbor
+// advertisements sent as gratuitous announcements. With the flag set, the
+// default, the neighbors replace their cache entries for the IP with our
+// MAC address. Clearing it only updates the entries which are missing or
+// already point at us, so that a node can't hijack an IP another one
+// holds, at the cost of slower failovers. It can only be set in New.
+func WithNDPOverride(enabled bool) Option {
+	return func(c *config) {
+		if c.static("WithNDPOverride") {
+			c.ndpNoOverride = !enabled
+		}
+	}
+}
+
+// WithRequesterACL makes the ARP and NDP responders answer only the
+// requests sent from an address in one of acl, for instance to only let
+// the load balancer tier resolve the announced IPs. An empty acl lets
+// every host resolve them, which is the default. The ACL can also be
+// replaced with Announce.SetRequesterACL.
+func WithRequesterACL(acl []*net.IPNet) Option {
+	return func(c *config) {
+		c.requesterACL = copyIPNets(acl)
+	}
+}
+
+// WithScheduler replaces the default scheduling of gratuitous
+// announcements, see NewDefaultScheduler. It can only be set in New.
+func WithScheduler(s Scheduler) Option {
+	return func(c *config) {
+		if c.static("WithScheduler") {
+			c.scheduler = s
+		}
+	}
+}
+
+// WithScanInterval sets how often interfaces are rescanned to create and
+// delete responders. A non-positive d gives the default of 10 seconds.
+func WithScanInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d <= 0 {
+			d = defaultScanInterval
+		}
+		c.scanInterval = d
+	}
+}
+
+// WithKeepaliveInterval makes the announcer announce all the owned IPs
+// again every d, as ReannounceAll does, even when nothing changes. It
+// keeps the IPs in the MAC address tables of switches with a short aging
+// time during idle periods. With the default scheduler, a keepalive
+// during the spam window of an IP only extends the window, so d should be
+// longer than the spam duration. A non-positive d disables the
+// keepalives, which is the default. It can only be set in New.
+func WithKeepaliveInterval(d time.Duration) Option {
+	return func(c *config) {
+		if !c.static("WithKeepaliveInterval") {
+			return
+		}
+		if d < 0 {
+			d = 0
+		}
+		c.keepaliveInterval = d
+	}
+}
+
+// WithInterfaceAllowlist restricts announcements to the named interfaces.
+// An empty list allows all interfaces.
+func WithInterfaceAllowlist(names []string) Option {
+	return func(c *config) {
+		c.allowlist = nameSet(names)
+	}
+}
+
+// WithInterfaceDenylist prevents announcements on the named interfaces.
+// It takes precedence over WithInterfaceAllowlist.
+func WithInterfaceDenylist(names []string) Option {
+	return func(c *config) {
+		c.denylist = nameSet(names)
+	}
+}
+
+// WithInterfaceRegex restricts announcements to the interfaces whose name
+// matches include and doesn't match exclude. A nil pattern doesn't
+// restrict anything. The patterns apply on top of the allow and deny
+// lists.
+func WithInterfaceRegex(include, exclude *regexp.Regexp) Option {
+	return func(c *config) {
+		c.include = include
+		c.exclude = exclude
+	}
+}
+
+// WithInterfaceDiscovery makes the interface scans list the interfaces
+// with discover instead of net.Interfaces, for instance to only consider
+// the interfaces labeled in sysfs or a curated list. Their addresses are
+// still read from the system, and the allow and deny lists and patterns
+// still apply to the interfaces discover returns. A failure of discover
+// fails the scan, which is retried like when net.Interfaces fails. It can
+// only be set in New.
+func WithInterfaceDiscovery(discover func() ([]net.Interface, error)) Option {
+	return func(c *config) {
+		if c.static("WithInterfaceDiscovery") {
+			c.discovery = discover
+		}
+	}
+}
+
+func nameSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	ret := make(map[string]bool, len(names))
+	for _, n := range names {
+		ret[n] = true
+	}
+	return ret
+}
+
+// WithDisabledFamilies turns the IPv4 family off when v4 is set and the
+// IPv6 family off when v6 is set, for nodes meant to serve a single
+// family. No ARP responder is created when IPv4 is off and no NDP
+// responder when IPv6 is off, and the IPs of a disabled family are not
+// registered: SetBalancerE returns an error and the other methods log it.
+// It can only be set in New.
+func WithDisabledFamilies(v4, v6 bool) Option {
+	return func(c *config) {
+		if c.static("WithDisabledFamilies") {
+			c.disableV4, c.disableV6 = v4, v6
+		}
+	}
+}
+
+// familyDisabled returns whether the family of ip is turned off.
+func (c *config) familyDisabled(ip net.IP) bool {
+	if ip.To4() != nil {
+		return c.disableV4
+	}
+	return c.disableV6
+}
+
+// ProtocolSet is a set of responder protocols, see
+// WithPerInterfaceProtocols.
+type ProtocolSet int
+
+const (
+	// ProtocolARP is the ARP responder, for IPv4.
+	ProtocolARP ProtocolSet = 1 << iota
+	// ProtocolNDP is the NDP responder, for IPv6.
+	ProtocolNDP
+)
+
+// WithPerInterfaceProtocols restricts the responders created for the
+// interfaces in protocols, by name, to the given protocols, for instance
+// to answer ARP but not NDP on an interface supporting both. An empty set
+// gets an interface no responder. The interfaces missing from protocols
+// get the responders they support, as by default. Unlike
+// WithDisabledFamilies, the IPs of all families are still registered.
+func WithPerInterfaceProtocols(protocols map[string]ProtocolSet) Option {
+	return func(c *config) {
+		c.interfaceProtocols = nil
+		if len(protocols) == 0 {
+			return
+		}
+		c.interfaceProtocols = make(map[string]ProtocolSet, len(protocols))
+		for name, set := range protocols {
+			c.interfaceProtocols[name] = set
+		}
+	}
+}
+
+// WithMinInterfaceMTU prevents announcements on the interfaces with an
+// MTU below mtu, like some overlay and tunnel interfaces on which they
+// are pointless. The responders of an interface whose MTU drops below
+// mtu are deleted. A non-positive mtu, the default, disables the filter.
+func WithMinInterfaceMTU(mtu int) Option {
+	return func(c *config) {
+		if mtu < 0 {
+			mtu = 0
+		}
+		c.minMTU = mtu
+	}
+}
+
+// Interface types which can be opted into ARP responders with
+// WithAllowedInterfaceTypes.
+const (
+	// InterfaceTypeLoopback is the type of loopback interfaces, like lo.
+	InterfaceTypeLoopback = "loopback"
+	// InterfaceTypeDummy is the type of the interfaces created with the
+	// dummy driver.
+	InterfaceTypeDummy = "dummy"
+)
+
+// VirtualLinkPolicy selects where to announce when macvlan or ipvlan
+// interfaces are stacked on another interface, see WithVirtualLinkPolicy.
+type VirtualLinkPolicy int
+
+const (
+	// AnnounceOnParentAndChild announces on both the parents and the
+	// macvlan and ipvlan interfaces stacked on them. It is the default.
+	AnnounceOnParentAndChild VirtualLinkPolicy = iota
+	// AnnounceOnParent announces on the parents only.
+	AnnounceOnParent
+	// AnnounceOnChild announces on the macvlan and ipvlan interfaces
+	// only, not on their parents.
+	AnnounceOnChild
+)
+
+// WithVirtualLinkPolicy selects whether to announce on the macvlan and
+// ipvlan interfaces, on the interfaces they are stacked on, or on both.
+// A macvlan interface has a MAC address of its own, so announcing on both
+// answers for an IP with two MAC addresses on the same segment. An ipvlan
+// interface shares the MAC address of its parent, so announcing on both
+// sends every gratuitous announcement twice. The interface kinds are only
+// detected on Linux.
+func WithVirtualLinkPolicy(p VirtualLinkPolicy) Option {
+	return func(c *config) {
+		c.virtualLinkPolicy = p
+	}
+}
+
+// WithAllowedInterfaceTypes lets interfaces of the given types, among
+// InterfaceTypeLoopback and InterfaceTypeDummy, get ARP responders for
+// their IPv4 addresses even though they lack the broadcast flag or are
+// flagged NOARP, for setups where the VIPs are hosted on such an
+// interface. The usual caveats apply: the packets sent on these
+// interfaces don't reach other hosts by themselves, so the responders are
+// only useful when another mechanism brings the requests to the interface
+// and the replies to the network. Loopback interfaces have no MAC
+// address, so WithSourceMAC is needed for their responders to answer.
+// The types are only detected on Linux. An empty list, the default, opts
+// no interface in.
+func WithAllowedInterfaceTypes(types []string) Option {
+	return func(c *config) {
+		c.interfaceTypes = nameSet(types)
+	}
+}
+
+// WithAnnounceOnNoARP lets interfaces flagged NOARP, like some
+// point-to-point links and tunnels, get responders. By default they are
+// skipped.
+func WithAnnounceOnNoARP(enabled bool) Option {
+	return func(c *config) {
+		c.announceOnNoARP = enabled
+	}
+}
+
+// WithAnnounceOnEnslaved lets interfaces enslaved to a master interface
+// get responders, for instance to announce directly on the ports of a
+// bridge. By default they are skipped, which is what bonds need: the bond
+// members share the MAC address of the bond, so a bond and its members
+// with responders would announce the same IPs several times. When
+// enabling this with bonds, exclude either the bond or its members with
+// WithInterfaceDenylist.
+func WithAnnounceOnEnslaved(enabled bool) Option {
+	return func(c *config) {
+		c.announceOnEnslaved = enabled
+	}
+}
+
+// WithVRF lets the interfaces enslaved to the VRF device named name get
+// responders, for nodes hosting the VIPs in a Linux VRF. Enslaved
+// interfaces are skipped otherwise, like the members of a bond or a
+// bridge, which are still skipped. The VRF is only detected on Linux. The
+// default empty name opts no VRF in.
+func WithVRF(name string) Option {
+	return func(c *config) {
+		c.vrf = name
+	}
+}
+
+// WithBondActiveSlave also sends the gratuitous ARP announcements made on
+// an active-backup bond directly on its active slave, read from
+// bonding/active_slave in sysfs, so that the switch the slave is plugged
+// into relearns the IPs faster after a failover. The active slave gets an
+// ARP responder which only sends these announcements, the requests are
+// still answered on the bond. The active slave is detected again on every
+// scan, and the announcements follow it when it changes. IPv6 is not
+// covered: the slaves have no link-local address to send NDP packets
+// from.
+func WithBondActiveSlave(enabled bool) Option {
+	return func(c *config) {
+		c.bondActiveSlave = enabled
+	}
+}
+
+// WithEnsureLinkLocal makes the announcer log an error for the
+// interfaces which have IPv6 addresses but no link-local one. NDP packets
+// must be sent from a link-local address, so these interfaces get no NDP
+// responder and their IPv6 addresses are not announced. The error names
+// the EUI-64 link-local address derived from the MAC address of the
+// interface, which can be added to fix the configuration. It is logged
+// once, until the interface gets a link-local address or disappears.
+func WithEnsureLinkLocal(enabled bool) Option {
+	return func(c *config) {
+		c.ensureLinkLocal = enabled
+	}
+}
+
+// WithSpamChannelSize sets the number of IPs which can wait to be
+// scheduled for gratuitous announcements. When the buffer is full, further
+// IPs are dropped and counted in the spam_dropped metric. Non-positive
+// values select the default of 1024. It can only be set in New.
+func WithSpamChannelSize(n int) Option {
+	return func(c *config) {
+		if !c.static("WithSpamChannelSize") {
+			return
+		}
+		if n < 0 {
+			n = 0
+		}
+		c.spamChannelSize = n
+	}
+}
+
+// WithMaxSpamWindow caps the number of IPs the default scheduler keeps
+// announcing at n. When a new IP would exceed it, the IP scheduled the
+// longest ago is evicted and counted in the spam_window_evicted metric,
+// which tells that convergence may be degraded during a mass failover.
+// Non-positive values select the default of no limit.
+func WithMaxSpamWindow(n int) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxSpamWindow = n
+	}
+}
+
+// WithGratuitousRateLimit limits the gratuitous announcements to
+// perSecond on average, with bursts of up to burst, across all the IPs and
+// interfaces, so that a failover of thousands of IPs doesn't flood the
+// NICs and the switches. Each interface an IP is announced on counts as
+// one announcement per packet of the burst, see WithGratuitousBurst. The
+// announcements over the limit are delayed rather than dropped, which
+// slows down the convergence. A non-positive perSecond disables the
+// limit, which is the default.
+func WithGratuitousRateLimit(perSecond float64, burst int) Option {
+	return func(c *config) {
+		if burst < 1 {
+			burst = 1
+		}
+		c.gratuitousRate, c.gratuitousRateBurst = perSecond, burst
+	}
+}
+
+// WithSourceMAC makes the responders announce the IPs at mac, for instance
+// a virtual MAC shared by a bond or team, instead of the MAC address of
+// their interface. mac must be a unicast address. It can only be set in
+// New.
+func WithSourceMAC(mac net.HardwareAddr) Option {
+	return func(c *config) {
+		if !c.static("WithSourceMAC") {
+			return
+		}
+		if len(mac) == 0 || mac[0]&1 != 0 {
+			c.setErr(fmt.Errorf("source MAC %q is not a unicast address", mac))
+			return
+		}
+		c.sourceMAC = append(net.HardwareAddr(nil), mac...)
+	}
+}
+
+// GratuitousHook is called by the responders with each gratuitous
+// announcement for ip they are about to send on the interface named
+// iface, see WithGratuitousHook. frame is the ARP packet or the ICMPv6
+// neighbor advertisement, without the link-layer header. The hook returns
+// the frame to send, which must still parse as such, or false to suppress
+// the send.
+type GratuitousHook func(iface string, ip net.IP, frame []byte) ([]byte, bool)
+
+// WithGratuitousHook makes the responders pass their gratuitous
+// announcements through hook before sending them, to inspect or rewrite
+// them. The replies to requests are not passed to hook. hook is called
+// from the announcement goroutines and must not block. It can only be set
+// in New.
+func WithGratuitousHook(hook GratuitousHook) Option {
+	return func(c *config) {
+		if c.static("WithGratuitousHook") {
+			c.gratuitousHook = hook
+		}
+	}
+}
+
+// GratuitousMode selects the ARP operations sent for each gratuitous
+// announcement, see WithGratuitousMode.
+type GratuitousMode int
+
+const (
+	// GratuitousRequestAndReply sends a request then a reply. It is the
+	// default.
+	GratuitousRequestAndReply GratuitousMode = iota
+	// GratuitousRequest sends a request only.
+	GratuitousRequest
+	// GratuitousReply sends a reply only.
+	GratuitousReply
+)
+
+// WithGratuitousMode selects whether the gratuitous ARP announcements are
+// sent as requests, as replies or as both, for the switches and hosts
+// which only update their tables on one of them. In all modes, the
+// target IP of the packets is the announced IP and they are broadcast.
+// NDP is not affected. It can only be set in New.
+func WithGratuitousMode(m GratuitousMode) Option {
+	return func(c *config) {
+		if c.static("WithGratuitousMode") {
+			c.gratuitousMode = m
+		}
+	}
+}
+
+// WithGratuitousTimeout sets how long to wait for a responder to send a
+// gratuitous announcement before logging a warning and moving on, so that
+// a hung socket does not stall the announcements. Non-positive values
+// select the default of 1s.
+func WithGratuitousTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d < 0 {
+			d = 0
+		}
+		c.gratuitousTimeout = d
+	}
+}
+
+// WithGratuitousBurst makes each responder send n gratuitous packets in a
+// row, 10ms apart, every time an IP is announced, so that announcements
+// survive the loss of a packet on lossy networks. This is on top of the
+// repeated announcements over the spam window. Values below 1 select the
+// default of a single packet.
+func WithGratuitousBurst(n int) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.gratuitousBurst = n
+	}
+}
+
+// WithInterfaceDebounce keeps the responders of an interface which
+// disappears, or no longer qualifies for announcements, until it has
+// been missing from n consecutive interface scans, so that a flapping
+// interface doesn't recreate its responders over and over. Values below
+// 1 select the default of deleting the responders on the first scan.
+func WithInterfaceDebounce(n int) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.interfaceDebounce = n
+	}
+}
+
+// WithResponderGracePeriod keeps the responders of an interface which
+// disappears, or no longer qualifies for announcements, for d before
+// deleting them, so that an interface going down briefly, for instance
+// during a driver reset, keeps its responders. Along with
+// WithInterfaceDebounce, the responders are deleted once both the scans
+// and the grace period have elapsed. The default of zero deletes them
+// right away.
+func WithResponderGracePeriod(d time.Duration) Option {
+	return func(c *config) {
+		if d < 0 {
+			d = 0
+		}
+		c.responderGrace = d
+	}
+}
+
+// WithStartupStagger spaces the creation of the responders of the
+// interfaces by d during the first interface scan, so that a node with
+// many interfaces doesn't send the gratuitous announcements of all its
+// IPs on all of them at once when it starts. The IPs are announced on each
+// interface as soon as its responders are created. The later scans are
+// not staggered. The default of zero creates all the responders at once.
+func WithStartupStagger(d time.Duration) Option {
+	return func(c *config) {
+		if d < 0 {
+			d = 0
+		}
+		c.startupStagger = d
+	}
+}
+
+// WithEventChannel makes the announcer send an InterfaceEvent on ch
+// whenever it creates or removes a responder. The events are dropped
+// when ch is full, so that a slow consumer can't stall the interface
+// scans.
+func WithEventChannel(ch chan<- InterfaceEvent) Option {
+	return func(c *config) {
+		c.events = ch
+	}
+}
+
+// WithLifecycleEvents makes the announcer send a LifecycleEvent on ch for
+// each of its actions: IPs added to and removed from services, responders
+// created and closed, and gratuitous announcements sent, so that they can
+// be forwarded to an event bus. The events encode to JSON. Like with
+// WithEventChannel, the events are dropped when ch is full.
+func WithLifecycleEvents(ch chan<- LifecycleEvent) Option {
+	return func(c *config) {
+		c.lifecycleEvents = ch
+	}
+}
+
+// WithConflictHandler sets a function called when another host answers
+// for an announced IP, with the MAC address it claims the IP with and the
+// interface the answer was seen on. The announcer keeps announcing the
+// IP, it is up to the handler to act on the conflict. The handler is
+// called from the responders' receive loops and must not block.
+func WithConflictHandler(f func(ip net.IP, mac net.HardwareAddr, intf string)) Option {
+	return func(c *config) {
+		c.conflictHandler = f
+	}
+}
+
+// WithDropHandler sets a function called when a responder drops a
+// packet rather than answering it, with the IP the packet is about, which
+// is nil if it could not be read, the interface it was received on and
+// why it was dropped. Most of the ARP requests seen on a segment are for
+// IPs we don't announce, so the handler is called often: it is called
+// from the responders' receive loops, without holding any lock, and must
+// be cheap and not block.
+func WithDropHandler(f func(ip net.IP, intf string, reason DropReason)) Option {
+	return func(c *config) {
+		c.dropHandler = f
+	}
+}
+
+// WithRecentDrops sets how many of the last requests for an announced IP
+// which were dropped rather than answered are kept for RecentDrops, 16 by
+// default. Zero or less keeps none.
+func WithRecentDrops(n int) Option {
+	return func(c *config) {
+		if n <= 0 {
+			n = -1
+		}
+		c.recentDrops = n
+	}
+}
+
+// WithNDPReWatchInterval sets how often the NDP responders join the
+// multicast groups of the announced IPv6 addresses again, so that a
+// membership lost when the kernel recreates an interface or a driver
+// resets heals by itself. The re-watches happen with the interface scans,
+// so d is rounded up to the scan interval. The default is a minute, zero
+// or less disables them.
+func WithNDPReWatchInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d <= 0 {
+			d = -1
+		}
+		c.ndpReWatchInterval = d
+	}
+}
+
+// getNDPReWatchInterval returns the delay between the NDP re-watches, or
+// zero if they are disabled.
+func (c *config) getNDPReWatchInterval() time.Duration {
+	switch {
+	case c.ndpReWatchInterval == 0:
+		return defaultNDPReWatchInterval
+	case c.ndpReWatchInterval < 0:
+		return 0
+	}
+	return c.ndpReWatchInterval
+}
+
+// getRecentDrops returns the number of drops kept per IP.
+func (c *config) getRecentDrops() int {
+	switch {
+	case c.recentDrops == 0:
+		return defaultRecentDrops
+	case c.recentDrops < 0:
+		return 0
+	}
+	return c.recentDrops
+}
+
+// WithAnnounceGate sets a function deciding, per IP, whether this node
+// takes part in announcing it, for anycast-like setups driven by an
+// external signal such as a health check or the state of a BGP session.
+// While f returns false for an IP, its requests are dropped with
+// DropReasonGated and its gratuitous announcements are skipped, without
+// touching the services it belongs to. f is called for every request
+// received and every announcement sent, with the announcer's lock held:
+// it must return quickly, without blocking or calling the Announce
+// methods, typically by reading a value maintained elsewhere.
+func WithAnnounceGate(f func(ip net.IP) bool) Option {
+	return func(c *config) {
+		c.announceGate = f
+	}
+}
+
+// WithLeaderElection makes the node answer requests and send gratuitous
+// announcements only while it holds the leader election lease, as told
+// with Announce.SetLeaderState, so that only the elected node answers.
+// The node starts without the lease. While it doesn't hold it, requests
+// are dropped with DropReasonNotLeader, but the IPs are still tracked so
+// that it can take over as soon as it gets the lease.
+func WithLeaderElection(enabled bool) Option {
+	return func(c *config) {
+		c.leaderElection = enabled
+	}
+}
+
+// WithSpamCompleteHandler sets a function called when the gratuitous
+// announcements of an IP are over, once the spam window has elapsed since
+// it was last scheduled, for instance to consider a failover settled. It
+// is not called for the IPs evicted by WithMaxSpamWindow, nor when
+// draining, and only works with the default scheduler. The handler is
+// called from the announcement goroutine without holding any lock, and
+// must not block.
+func WithSpamCompleteHandler(f func(ip net.IP)) Option {
+	return func(c *config) {
+		c.spamCompleteHandler = f
+	}
+}
+
+// WithOwnershipChangeHandler sets a function called when an IP starts
+// being announced, with owned set, and when the last service using it is
+// deleted, with owned unset, for instance to let a leader election layer
+// follow the IPs of the node without polling OwnedIPs. The handler is
+// called in order, without holding any lock, so it may call the Announce:
+// the changes it makes are passed to it once it returns. The changes are
+// usually passed before the Announce method making them returns, but
+// not when another call is already passing changes, which passes these
+// ones too.
+func WithOwnershipChangeHandler(f func(ip net.IP, owned bool)) Option {
+	return func(c *config) {
+		c.ownershipHandler = f
+	}
+}
+
+// Verbosity selects the per-packet and per-scan events logged by the
+// announcer, see WithVerbosity.
+type Verbosity int
+
+const (
+	// VerbosityDebug logs all the events, it is the default.
+	VerbosityDebug Verbosity = iota
+	// VerbosityInfo drops the debug events.
+	VerbosityInfo
+	// VerbosityQuiet drops the debug and info events, keeping the
+	// warnings and errors only.
+	VerbosityQuiet
+)
+
+// WithVerbosity filters the events logged for every packet, like the
+// requests answered, and on every interface scan, like the interfaces
+// going missing, which are noisy on busy or churny nodes. The lifecycle
+// events, like the creation and deletion of responders, are not filtered,
+// and neither are the warnings and errors. The responders use the
+// verbosity set when they are created.
+func WithVerbosity(v Verbosity) Option {
+	return func(c *config) {
+		c.verbosity = v
+	}
+}
+
+// eventLogger returns l filtered for the per-packet and per-scan events,
+// see WithVerbosity.
+func (c *config) eventLogger(l log.Logger) log.Logger {
+	switch c.verbosity {
+	case VerbosityInfo:
+		return level.NewFilter(l, level.AllowInfo())
+	case VerbosityQuiet:
+		return level.NewFilter(l, level.AllowWarn())
+	default:
+		return l
+	}
+}
+
+// getScanInterval returns the delay between interface scans.
+func (c *config) getScanInterval() time.Duration {
+	if c.scanInterval <= 0 {
+		return defaultScanInterval
+	}
+	return c.scanInterval
+}
+
+// WithSpamDuration sets how long gratuitous announcements keep being sent
+// for an IP after it was last set. Announcements are sent every spam
+// interval, so about d divided by the interval announcements are sent in
+// addition to the initial one. A non-positive d gives the default of 5
+// seconds. It only applies with the default scheduler.
+func WithSpamDuration(d time.Duration) Option {
+	return func(c *config) {
+		if d <= 0 {
+			d = defaultSpamWindow
+		}
+		c.spamDuration = d
+	}
+}
+
+// getSpamDuration returns how long IPs are announced after a change.
+func (c *config) getSpamDuration() time.Duration {
+	if c.spamDuration <= 0 {
+		return defaultSpamWindow
+	}
+	return c.spamDuration
+}
+
+// WithSpamInterval sets the delay between the gratuitous announcements
+// sent for an IP after it was set. A non-positive d gives the default of
+// 1100ms, and d is raised to 100ms if smaller. It only applies with the
+// default scheduler.
+func WithSpamInterval(d time.Duration) Option {
+	return func(c *config) {
+		switch {
+		case d <= 0:
+			d = defaultSpamInterval
+		case d < minSpamInterval:
+			d = minSpamInterval
+		}
+		c.spamInterval = d
+	}
+}
+
+// WithMinGratuitousSpacing keeps the gratuitous announcements of an IP at
+// least d apart, so that an IP set again and again in a short time, or
+// announced right away and then on the next tick, doesn't send bursts of
+// duplicate packets. The announcements coming too early are coalesced
+// into one, sent once d elapsed. It applies with all the schedulers. A
+// non-positive d, the default, doesn't space the announcements.
+func WithMinGratuitousSpacing(d time.Duration) Option {
+	return func(c *config) {
+		if d < 0 {
+			d = 0
+		}
+		c.minGratuitousSpacing = d
+	}
+}
+
+// announcedMAC returns the MAC address to announce on ifi.
+func (c *config) announcedMAC(ifi *net.Interface) net.HardwareAddr {
+	if c.sourceMAC != nil {
+		return c.sourceMAC
+	}
+	return ifi.HardwareAddr
+}
+
+// getGratuitousTimeout returns how long to wait for a gratuitous
+// announcement.
+func (c *config) getGratuitousTimeout() time.Duration {
+	if c.gratuitousTimeout == 0 {
+		return defaultGratuitousTimeout
+	}
+	return c.gratuitousTimeout
+}
+
+// getGratuitousBurst returns the number of packets per gratuitous
+// announcement.
+func (c *config) getGratuitousBurst() int {
+	if c.gratuitousBurst == 0 {
+		return 1
+	}
+	return c.gratuitousBurst
+}
+
+// getInterfaceDebounce returns the number of scans an interface must be
+// missing from before its responders are deleted.
+func (c *config) getInterfaceDebounce() int {
+	if c.interfaceDebounce == 0 {
+		return 1
+	}
+	return c.interfaceDebounce
+}
+
+// getSpamChannelSize returns the buffer size of the spam channel.
+func (c *config) getSpamChannelSize() int {
+	if c.spamChannelSize == 0 {
+		return defaultSpamChannelSize
+	}
+	return c.spamChannelSize
+}
+
+// getSpamInterval returns the delay between announcements of an IP.
+func (c *config) getSpamInterval() time.Duration {
+	if c.spamInterval <= 0 {
+		return defaultSpamInterval
+	}
+	return c.spamInterval
+}
+
+// WithSpamJitter randomizes each delay between gratuitous announcements
+// within plus or minus fraction of the spam interval, to avoid nodes
+// failing over at the same time from sending their announcements in
+// lockstep. fraction must be in [0, 1), 0 disables the jitter. It only
+// applies with the default scheduler.
+func WithSpamJitter(fraction float64) Option {
+	return func(c *config) {
+		if fraction < 0 || fraction >= 1 {
+			c.setErr(fmt.Errorf("invalid spam jitter %v, must be in [0, 1)", fraction))
+			return
+		}
+		c.spamJitter = fraction
+	}
+}
+
+// jitter returns d randomly shortened or lengthened by up to fraction of
+// itself.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction == 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// static reports whether an option that can only be set when creating an
+// Announce may be applied to c, recording an error if not.
+func (c *config) static(name string) bool {
+	if c.runtime {
+		c.setErr(fmt.Errorf("%s can't be changed at runtime", name))
+		return false
+	}
+	return true
+}
+
+func (c *config) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
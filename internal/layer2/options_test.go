@@ -0,0 +1,207 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWithScanInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+		want time.Duration
+	}{
+		{name: "unset", want: defaultScanInterval},
+		{name: "custom", d: 2 * time.Second, want: 2 * time.Second},
+		{name: "zero", d: 0, want: defaultScanInterval},
+		{name: "negative", d: -time.Second, want: defaultScanInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c config
+			if tt.name != "unset" {
+				WithScanInterval(tt.d)(&c)
+			}
+			if got := c.getScanInterval(); got != tt.want {
+				t.Fatalf("expected scan interval %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWithSpamDuration(t *testing.T) {
+	var c config
+	if got := c.getSpamDuration(); got != defaultSpamWindow {
+		t.Fatalf("expected default spam duration, got %v", got)
+	}
+	WithSpamDuration(20 * time.Second)(&c)
+	if got := c.getSpamDuration(); got != 20*time.Second {
+		t.Fatalf("expected spam duration of 20s, got %v", got)
+	}
+	WithSpamDuration(-time.Second)(&c)
+	if got := c.getSpamDuration(); got != defaultSpamWindow {
+		t.Fatalf("expected default spam duration for a negative value, got %v", got)
+	}
+}
+
+func TestWithSpamInterval(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want time.Duration
+	}{
+		{0, defaultSpamInterval},
+		{-time.Second, defaultSpamInterval},
+		{time.Millisecond, minSpamInterval},
+		{500 * time.Millisecond, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		var c config
+		WithSpamInterval(tt.d)(&c)
+		if got := c.getSpamInterval(); got != tt.want {
+			t.Errorf("WithSpamInterval(%v): expected %v, got %v", tt.d, tt.want, got)
+		}
+	}
+}
+
+func TestWithSpamJitter(t *testing.T) {
+	for _, fraction := range []float64{-0.1, 1, 2} {
+		var c config
+		WithSpamJitter(fraction)(&c)
+		if c.err == nil {
+			t.Errorf("expected an error for jitter %v", fraction)
+		}
+	}
+
+	var c config
+	WithSpamJitter(0.2)(&c)
+	if c.err != nil {
+		t.Fatalf("unexpected error: %s", c.err)
+	}
+
+	base := time.Second
+	lo, hi := 800*time.Millisecond, 1200*time.Millisecond
+	distinct := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		d := jitter(base, c.spamJitter)
+		if d < lo || d > hi {
+			t.Fatalf("jittered interval %v out of [%v, %v]", d, lo, hi)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 2 {
+		t.Fatalf("jitter doesn't vary the interval")
+	}
+	if d := jitter(base, 0); d != base {
+		t.Fatalf("expected no jitter with fraction 0, got %v", d)
+	}
+}
+
+func TestWithSpamChannelSize(t *testing.T) {
+	var c config
+	if got := c.getSpamChannelSize(); got != defaultSpamChannelSize {
+		t.Fatalf("expected default spam channel size, got %d", got)
+	}
+	WithSpamChannelSize(16)(&c)
+	if got := c.getSpamChannelSize(); got != 16 {
+		t.Fatalf("expected spam channel size of 16, got %d", got)
+	}
+	WithSpamChannelSize(-1)(&c)
+	if got := c.getSpamChannelSize(); got != defaultSpamChannelSize {
+		t.Fatalf("expected default spam channel size for a negative value, got %d", got)
+	}
+	c.runtime = true
+	WithSpamChannelSize(16)(&c)
+	if c.err == nil {
+		t.Fatalf("expected an error when changing the spam channel size at runtime")
+	}
+}
+
+func TestWithSourceMAC(t *testing.T) {
+	ifi := &net.Interface{HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	var c config
+	if got := c.announcedMAC(ifi); got.String() != ifi.HardwareAddr.String() {
+		t.Fatalf("expected the interface MAC by default, got %s", got)
+	}
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 0xaa}
+	WithSourceMAC(mac)(&c)
+	if c.err != nil {
+		t.Fatalf("unexpected error for a unicast MAC: %s", c.err)
+	}
+	if got := c.announcedMAC(ifi); got.String() != mac.String() {
+		t.Fatalf("expected %s, got %s", mac, got)
+	}
+
+	for _, bad := range []net.HardwareAddr{nil, {1, 0, 0x5e, 0, 0, 1}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff}} {
+		var c config
+		WithSourceMAC(bad)(&c)
+		if c.err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	tests := []struct {
+		verbosity Verbosity
+		want      []string
+	}{
+		{VerbosityDebug, []string{"debug", "info", "warn", "error"}},
+		{VerbosityInfo, []string{"info", "warn", "error"}},
+		{VerbosityQuiet, []string{"warn", "error"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		c := &config{}
+		WithVerbosity(tt.verbosity)(c)
+		l := c.eventLogger(log.NewLogfmtLogger(&buf))
+		level.Debug(l).Log("msg", "debug")
+		level.Info(l).Log("msg", "info")
+		level.Warn(l).Log("msg", "warn")
+		level.Error(l).Log("msg", "error")
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			got = append(got, strings.TrimPrefix(line[strings.Index(line, "msg="):], "msg="))
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("unexpected events logged with verbosity %d (-want +got)\n%s", tt.verbosity, diff)
+		}
+	}
+}
+
+func TestVerbosityScanEvents(t *testing.T) {
+	var buf bytes.Buffer
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	announce.logger = log.NewLogfmtLogger(&buf)
+	WithVerbosity(VerbosityQuiet)(&announce.cfg)
+	WithInterfaceDebounce(2)(&announce.cfg)
+	lister := announce.lister.(*fakeLister)
+	ifs := lister.ifs
+
+	announce.updateInterfaces()
+	lister.ifs = nil
+	announce.updateInterfaces()
+	lister.ifs = ifs
+	announce.updateInterfaces()
+
+	out := buf.String()
+	for _, event := range []string{"interfaceMissing", "interfaceFlapping"} {
+		if strings.Contains(out, event) {
+			t.Errorf("expected %s to be suppressed, got:\n%s", event, out)
+		}
+	}
+	if !strings.Contains(out, "createARPResponder") {
+		t.Errorf("expected the lifecycle events to be logged, got:\n%s", out)
+	}
+}
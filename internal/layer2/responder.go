@@ -0,0 +1,46 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import "net"
+
+// responder answers layer2 requests for the announced IPs on a single
+// interface. It is implemented by arpResponder and ndpResponder.
+type responder interface {
+	// Interface returns the name of the interface.
+	Interface() string
+	// HardwareAddr returns the MAC address of the interface.
+	HardwareAddr() net.HardwareAddr
+	// Gratuitous sends an unsolicited announcement for ip.
+	Gratuitous(ip net.IP) error
+	// Solicit asks the hosts on the link which of them owns ip. The
+	// replies of the other hosts are reported as conflicts.
+	Solicit(ip net.IP) error
+	// Probe checks that the responder is able to transmit.
+	Probe() error
+	// Healthy returns whether the last probe succeeded.
+	Healthy() bool
+	// Stats returns a snapshot of the responder's activity.
+	Stats() ResponderStat
+	Close() error
+}
+
+// watcher is implemented by responders which have to subscribe to the
+// IPs they answer for, like ndpResponder.
+type watcher interface {
+	Watch(ip net.IP) error
+	Unwatch(ip net.IP) error
+	// Rewatch subscribes again to ip, which is already watched, in case
+	// the subscription was lost. It doesn't count as another Watch,
+	// unless the Watch of ip failed to subscribe.
+	Rewatch(ip net.IP) error
+	// Withdraw tells the neighbors that ip is no longer announced by
+	// this node, once it is released.
+	Withdraw(ip net.IP) error
+}
+
+// watchingResponder is a responder which is also a watcher.
+type watchingResponder interface {
+	responder
+	watcher
+}
@@ -0,0 +1,900 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeResponder is a watchingResponder recording the calls made to it.
+type fakeResponder struct {
+	sync.Mutex
+	intf string
+	mac  net.HardwareAddr
+	// delay makes Gratuitous hang for a while.
+	delay time.Duration
+	// probeErr is returned by Probe, and makes the responder unhealthy.
+	probeErr error
+	probes   int
+	// gratuitousErr makes Gratuitous fail.
+	gratuitousErr error
+	gratuitous    []net.IP
+	watched       []net.IP
+	unwatched     []net.IP
+	// joined holds the watched IPs, tests delete them to simulate lost
+	// memberships.
+	joined map[string]bool
+	// watchErrs and unwatchErrs make Watch and Unwatch fail for some
+	// IPs.
+	watchErrs   map[string]error
+	unwatchErrs map[string]error
+	// ops records the Withdraw and Unwatch calls, in order.
+	ops    []string
+	closed bool
+
+	// created is when the factory created the responder.
+	created time.Time
+	// sendOnly is set on the responders of the active bond slaves.
+	sendOnly bool
+	// onSolicit is called by Solicit, to inject the replies.
+	onSolicit func(ip net.IP)
+	// onWithdraw is called by Withdraw.
+	onWithdraw func(ip net.IP)
+	solicited  []net.IP
+}
+
+func (f *fakeResponder) Interface() string { return f.intf }
+
+func (f *fakeResponder) HardwareAddr() net.HardwareAddr { return f.mac }
+
+func (f *fakeResponder) Gratuitous(ip net.IP) error {
+	time.Sleep(f.delay)
+	f.Lock()
+	defer f.Unlock()
+	if f.gratuitousErr != nil {
+		return f.gratuitousErr
+	}
+	f.gratuitous = append(f.gratuitous, ip)
+	return nil
+}
+
+func (f *fakeResponder) Solicit(ip net.IP) error {
+	f.Lock()
+	f.solicited = append(f.solicited, ip)
+	onSolicit := f.onSolicit
+	f.Unlock()
+	if onSolicit != nil {
+		go onSolicit(ip)
+	}
+	return nil
+}
+
+func (f *fakeResponder) Probe() error {
+	f.Lock()
+	defer f.Unlock()
+	f.probes++
+	return f.probeErr
+}
+
+func (f *fakeResponder) Healthy() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.probeErr == nil
+}
+
+func (f *fakeResponder) Stats() ResponderStat {
+	f.Lock()
+	defer f.Unlock()
+	return ResponderStat{
+		Healthy:        f.probeErr == nil,
+		GratuitousSent: uint64(len(f.gratuitous)),
+		Watches:        uint64(len(f.watched)),
+		Unwatches:      uint64(len(f.unwatched)),
+		LastActivity:   f.created,
+	}
+}
+
+func (f *fakeResponder) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeResponder) Watch(ip net.IP) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.watchErrs[ip.String()]; err != nil {
+		return err
+	}
+	f.watched = append(f.watched, ip)
+	if f.joined == nil {
+		f.joined = map[string]bool{}
+	}
+	f.joined[ip.String()] = true
+	return nil
+}
+
+func (f *fakeResponder) Rewatch(ip net.IP) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.joined == nil {
+		f.joined = map[string]bool{}
+	}
+	f.joined[ip.String()] = true
+	return nil
+}
+
+func (f *fakeResponder) Unwatch(ip net.IP) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.unwatchErrs[ip.String()]; err != nil {
+		return err
+	}
+	f.unwatched = append(f.unwatched, ip)
+	delete(f.joined, ip.String())
+	f.ops = append(f.ops, "unwatch "+ip.String())
+	return nil
+}
+
+func (f *fakeResponder) Withdraw(ip net.IP) error {
+	f.Lock()
+	f.ops = append(f.ops, "withdraw "+ip.String())
+	onWithdraw := f.onWithdraw
+	f.Unlock()
+	if onWithdraw != nil {
+		onWithdraw(ip)
+	}
+	return nil
+}
+
+func (f *fakeResponder) gratuitousCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.gratuitous)
+}
+
+// fakeFactory creates fakeResponders in place of the real responders,
+// and records them.
+type fakeFactory struct {
+	arps, ndps []*fakeResponder
+	// probeErr is set on the created responders.
+	probeErr error
+	// err makes the creation fail.
+	err error
+}
+
+func (f *fakeFactory) newARP(ifi *net.Interface) (responder, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	r := &fakeResponder{intf: ifi.Name, mac: ifi.HardwareAddr, probeErr: f.probeErr, created: time.Now()}
+	f.arps = append(f.arps, r)
+	return r, nil
+}
+
+func (f *fakeFactory) newSlaveARP(ifi *net.Interface) (responder, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	r := &fakeResponder{intf: ifi.Name, mac: ifi.HardwareAddr, created: time.Now(), sendOnly: true}
+	f.arps = append(f.arps, r)
+	return r, nil
+}
+
+func (f *fakeFactory) newNDP(ifi *net.Interface) (watchingResponder, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	r := &fakeResponder{intf: ifi.Name, mac: ifi.HardwareAddr, probeErr: f.probeErr, created: time.Now()}
+	f.ndps = append(f.ndps, r)
+	return r, nil
+}
+
+func newFakeAnnounce(factory *fakeFactory) *Announce {
+	return &Announce{
+		logger: log.NewNopLogger(),
+		lister: &fakeLister{
+			ifs: []net.Interface{{
+				Index:        1,
+				Name:         "eth0",
+				Flags:        net.FlagUp | net.FlagBroadcast,
+				HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			}},
+			addrs: map[string][]net.Addr{
+				"eth0": {mustCIDR("192.168.1.2/24"), mustCIDR("fe80::1/64")},
+			},
+		},
+		sys:         fakeSysfs{},
+		newARP:      factory.newARP,
+		newNDP:      factory.newNDP,
+		newSlaveARP: factory.newSlaveARP,
+		arps:        map[string]responder{},
+		ndps:        map[string]watchingResponder{},
+		ifIndex:     map[string]int{},
+		ips:         map[string][]net.IP{},
+		ipRefcnt:    map[ipKey]int{},
+		svcIfaces:   map[string]map[string]bool{},
+		spamCh:      make(chan net.IP, 10),
+		done:        make(chan struct{}),
+	}
+}
+
+func TestUpdateInterfacesCreatesResponders(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	v4, v6 := net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	<-announce.spamCh
+	<-announce.spamCh
+
+	announce.updateInterfaces()
+
+	if len(factory.arps) != 1 || len(factory.ndps) != 1 {
+		t.Fatalf("expected one ARP and one NDP responder, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	arp, ndp := factory.arps[0], factory.ndps[0]
+	if arp.probes != 1 || ndp.probes != 1 {
+		t.Errorf("expected the new responders to be probed once, got %d and %d", arp.probes, ndp.probes)
+	}
+	for _, proto := range []string{"arp", "ndp"} {
+		if v := ptu.ToFloat64(stats.healthy.WithLabelValues(proto, "eth0", "02:00:00:00:00:01")); v != 1 {
+			t.Errorf("expected the %s responder of eth0 to be healthy with its MAC as label, got %v", proto, v)
+		}
+	}
+	if diff := cmp.Diff([]net.IP{v6}, ndp.watched); diff != "" {
+		t.Errorf("unexpected watched IPs (-want +got)\n%s", diff)
+	}
+	if len(announce.spamCh) != 2 {
+		t.Errorf("expected the owned IPs to be announced on the new responders, got %d", len(announce.spamCh))
+	}
+
+	// The gratuitous and watch flows go through the new responders.
+	for len(announce.spamCh) > 0 {
+		announce.gratuitous(<-announce.spamCh)
+	}
+	if arp.gratuitousCount() != 1 || ndp.gratuitousCount() != 1 {
+		t.Errorf("expected one announcement per responder, got %d and %d", arp.gratuitousCount(), ndp.gratuitousCount())
+	}
+	announce.DeleteBalancer("foo")
+	// The fake records IPv4 addresses too, ndpResponder ignores them.
+	if diff := cmp.Diff([]net.IP{v4, v6}, ndp.unwatched); diff != "" {
+		t.Errorf("unexpected unwatched IPs (-want +got)\n%s", diff)
+	}
+
+	// Nothing is created again on the next scan.
+	announce.updateInterfaces()
+	if len(factory.arps) != 1 || len(factory.ndps) != 1 {
+		t.Errorf("expected the responders to be kept, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+}
+
+func TestUpdateInterfacesRetriesUnhealthy(t *testing.T) {
+	factory := &fakeFactory{probeErr: errors.New("can't transmit")}
+	announce := newFakeAnnounce(factory)
+
+	announce.updateInterfaces()
+	stats.Dropped("arp", "eth0", DropReasonEthernetDestination)
+	factory.probeErr = nil
+	announce.updateInterfaces()
+
+	if len(factory.arps) != 2 || len(factory.ndps) != 2 {
+		t.Fatalf("expected the unhealthy responders to be recreated, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	if !factory.arps[0].closed || !factory.ndps[0].closed {
+		t.Errorf("expected the unhealthy responders to be closed")
+	}
+	if announce.arps["eth0"] != factory.arps[1] || announce.ndps["eth0"] != factory.ndps[1] {
+		t.Errorf("expected the new responders to be used")
+	}
+	// The unhealthy responders are deleted like any other.
+	if v := ptu.ToFloat64(stats.dropped.WithLabelValues("arp", "eth0", DropReasonEthernetDestination.String())); v != 0 {
+		t.Errorf("expected the drop counters of the unhealthy responder to be forgotten, got %v", v)
+	}
+}
+
+func TestResponderStats(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	announce.updateInterfaces()
+	announce.SetBalancerIPs("foo", []net.IP{net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")})
+	for len(announce.spamCh) > 0 {
+		announce.gratuitous(<-announce.spamCh)
+	}
+
+	// The ARP and NDP responders of eth0 are combined. The fake watches
+	// IPv4 addresses too.
+	want := map[string]ResponderStat{
+		"eth0": {Healthy: true, GratuitousSent: 2, Watches: 2, LastActivity: factory.ndps[0].created},
+	}
+	if diff := cmp.Diff(want, announce.ResponderStats()); diff != "" {
+		t.Errorf("unexpected stats (-want +got)\n%s", diff)
+	}
+	factory.ndps[0].Lock()
+	factory.ndps[0].probeErr = errors.New("can't transmit")
+	factory.ndps[0].Unlock()
+	if announce.ResponderStats()["eth0"].Healthy {
+		t.Errorf("expected eth0 to be unhealthy when its NDP responder is")
+	}
+
+	// Recreating the responders resets their counters.
+	announce.lister.(*fakeLister).ifs[0].HardwareAddr = net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	announce.updateInterfaces()
+	if len(factory.arps) != 2 || len(factory.ndps) != 2 {
+		t.Fatalf("expected the responders to be recreated, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	want = map[string]ResponderStat{
+		"eth0": {Healthy: true, Watches: 1, LastActivity: factory.ndps[1].created},
+	}
+	if diff := cmp.Diff(want, announce.ResponderStats()); diff != "" {
+		t.Errorf("unexpected stats after recreation (-want +got)\n%s", diff)
+	}
+}
+
+func TestUpdateInterfacesCreationError(t *testing.T) {
+	factory := &fakeFactory{err: errors.New("permission denied")}
+	announce := newFakeAnnounce(factory)
+
+	announce.updateInterfaces()
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("expected no responders when their creation fails")
+	}
+
+	factory.err = nil
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+		t.Fatalf("expected the responders to be created on the next scan")
+	}
+}
+
+func TestVLANSubInterfaces(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+	announce.lister = &fakeLister{
+		ifs: []net.Interface{
+			{Index: 1, Name: "eth0", Flags: upBroadcast},
+			{Index: 2, Name: "eth0.100", Flags: upBroadcast},
+			{Index: 3, Name: "eth0.200", Flags: upBroadcast},
+		},
+		addrs: map[string][]net.Addr{
+			"eth0":     {mustCIDR("192.168.1.2/24")},
+			"eth0.100": {mustCIDR("10.0.100.2/24")},
+			"eth0.200": {mustCIDR("10.0.200.2/24")},
+		},
+	}
+	// The trunk itself is enslaved to nothing, and neither are its VLANs.
+	announce.sys = fakeSysfs{masters: map[string]bool{}}
+
+	announce.updateInterfaces()
+	if len(factory.arps) != 3 {
+		t.Fatalf("expected ARP responders on the trunk and both VLANs, got %d", len(factory.arps))
+	}
+
+	ip := net.IPv4(10, 0, 100, 10)
+	announce.SetBalancerWithInterfaces("foo", ip, []string{"eth0.100"})
+	<-announce.spamCh
+	announce.gratuitous(ip)
+	for _, r := range factory.arps {
+		want := 0
+		if r.intf == "eth0.100" {
+			want = 1
+		}
+		if got := r.gratuitousCount(); got != want {
+			t.Errorf("expected %d announcements on %s, got %d", want, r.intf, got)
+		}
+	}
+	for intf, want := range map[string]DropReason{
+		"eth0":     DropReasonInterfaceRestricted,
+		"eth0.100": DropReasonNone,
+		"eth0.200": DropReasonInterfaceRestricted,
+	} {
+		if got := announce.shouldAnnounce(ip, intf); got != want {
+			t.Errorf("expected %v on %s, got %v", want, intf, got)
+		}
+	}
+}
+
+func TestBondActiveSlave(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithBondActiveSlave(true)(&announce.cfg)
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+	announce.lister = &fakeLister{
+		ifs: []net.Interface{
+			{Index: 1, Name: "bond0", Flags: upBroadcast},
+			{Index: 2, Name: "eth0", Flags: upBroadcast},
+			{Index: 3, Name: "eth1", Flags: upBroadcast},
+		},
+		addrs: map[string][]net.Addr{
+			"bond0": {mustCIDR("192.168.1.2/24"), mustCIDR("fe80::1/64")},
+		},
+	}
+	sys := fakeSysfs{
+		masters:      map[string]bool{"eth0": true, "eth1": true},
+		activeSlaves: map[string]string{"bond0": "eth0"},
+	}
+	announce.sys = sys
+
+	announce.updateInterfaces()
+	if len(announce.arps) != 2 || announce.arps["bond0"] == nil || announce.arps["eth0"] == nil {
+		t.Fatalf("expected ARP responders on bond0 and eth0, got %v", announce.arps)
+	}
+	if len(announce.ndps) != 1 || announce.ndps["bond0"] == nil {
+		t.Fatalf("expected an NDP responder on bond0 only, got %v", announce.ndps)
+	}
+	if factory.arps[0].sendOnly || !factory.arps[1].sendOnly {
+		t.Errorf("expected the responder of eth0 only to be send-only")
+	}
+
+	ip := net.IPv4(192, 168, 1, 10)
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+	announce.gratuitous(ip)
+	for _, r := range factory.arps {
+		if got := r.gratuitousCount(); got != 1 {
+			t.Errorf("expected one announcement on %s, got %d", r.intf, got)
+		}
+	}
+	// The requests are only answered on the bond.
+	if got := announce.shouldAnnounce(ip, "bond0"); got != DropReasonNone {
+		t.Errorf("expected bond0 to answer, got %v", got)
+	}
+	if got := announce.shouldAnnounce(ip, "eth0"); got != DropReasonBondSlave {
+		t.Errorf("expected eth0 not to answer, got %v", got)
+	}
+
+	// The bond fails over to eth1.
+	sys.activeSlaves["bond0"] = "eth1"
+	announce.updateInterfaces()
+	if len(announce.arps) != 2 || announce.arps["eth1"] == nil {
+		t.Fatalf("expected the ARP responder to move to eth1, got %v", announce.arps)
+	}
+	if !factory.arps[1].closed {
+		t.Errorf("expected the responder of eth0 to be closed")
+	}
+	// The new slave announces the IP again.
+	announce.gratuitous(<-announce.spamCh)
+	eth1 := factory.arps[2]
+	if eth1.intf != "eth1" || eth1.gratuitousCount() != 1 {
+		t.Errorf("expected one announcement on eth1, got %d on %s", eth1.gratuitousCount(), eth1.intf)
+	}
+}
+
+func TestActiveInterfaces(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+	announce.lister = &fakeLister{
+		ifs: []net.Interface{
+			{Index: 3, Name: "eth1", Flags: upBroadcast, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 3}},
+			{Index: 2, Name: "eth0", Flags: upBroadcast, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}},
+			{Index: 4, Name: "eth2", Flags: upBroadcast, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 4}},
+			// No addresses, no responders.
+			{Index: 5, Name: "eth3", Flags: upBroadcast},
+		},
+		addrs: map[string][]net.Addr{
+			"eth0": {mustCIDR("192.168.1.2/24"), mustCIDR("fe80::1/64")},
+			"eth1": {mustCIDR("fe80::2/64")},
+			"eth2": {mustCIDR("192.168.2.2/24")},
+		},
+	}
+
+	if got := announce.ActiveInterfaces(); len(got) != 0 {
+		t.Errorf("expected no active interface before the first scan, got %v", got)
+	}
+	announce.updateInterfaces()
+	want := []InterfaceInfo{
+		{Name: "eth0", Index: 2, Protocols: []string{"arp", "ndp"}, MAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}},
+		{Name: "eth1", Index: 3, Protocols: []string{"ndp"}, MAC: net.HardwareAddr{2, 0, 0, 0, 0, 3}},
+		{Name: "eth2", Index: 4, Protocols: []string{"arp"}, MAC: net.HardwareAddr{2, 0, 0, 0, 0, 4}},
+	}
+	if diff := cmp.Diff(want, announce.ActiveInterfaces()); diff != "" {
+		t.Errorf("unexpected active interfaces (-want +got):\n%s", diff)
+	}
+}
+
+func TestRescanNow(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	lister := announce.lister.(*fakeLister)
+	ifs := lister.ifs
+	lister.ifs = nil
+
+	announce.RescanNow()
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("expected no responders, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+
+	lister.ifs = ifs
+	announce.RescanNow()
+	if announce.arps["eth0"] == nil || announce.ndps["eth0"] == nil {
+		t.Fatalf("expected responders on eth0, got %v and %v", announce.arps, announce.ndps)
+	}
+}
+
+func TestUpdateInterfacesDebounce(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithInterfaceDebounce(3)(&announce.cfg)
+	lister := announce.lister.(*fakeLister)
+	ifs := lister.ifs
+
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+		t.Fatalf("expected responders on eth0, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+
+	// eth0 flaps: the responders survive short absences.
+	for _, present := range []bool{false, false, true, false, false} {
+		if present {
+			lister.ifs = ifs
+		} else {
+			lister.ifs = nil
+		}
+		announce.updateInterfaces()
+		if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+			t.Fatalf("expected the responders of eth0 to be kept, got %d and %d", len(announce.arps), len(announce.ndps))
+		}
+	}
+	if len(factory.arps) != 1 || len(factory.ndps) != 1 {
+		t.Fatalf("expected no new responders while flapping, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+
+	// The third scan in a row without eth0 deletes its responders.
+	announce.updateInterfaces()
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("expected the responders of eth0 to be deleted, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+	if !factory.arps[0].closed || !factory.ndps[0].closed {
+		t.Errorf("expected the responders of eth0 to be closed")
+	}
+	if len(announce.missed) != 0 {
+		t.Errorf("expected the missed scans to be forgotten, got %v", announce.missed)
+	}
+}
+
+func TestUpdateInterfacesMACChange(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	lister := announce.lister.(*fakeLister)
+	announce.updateInterfaces()
+	v4, v6 := net.IPv4(192, 168, 1, 20).To4(), net.ParseIP("1000::1")
+	announce.SetBalancerIPs("foo", []net.IP{v4, v6})
+	for len(announce.spamCh) > 0 {
+		<-announce.spamCh
+	}
+
+	// Nothing happens while the MAC address is unchanged.
+	announce.updateInterfaces()
+	if len(announce.spamCh) != 0 {
+		t.Fatalf("unexpected announcements without a MAC change")
+	}
+
+	newMAC := net.HardwareAddr{2, 0, 0, 0, 0, 0xaa}
+	lister.ifs[0].HardwareAddr = newMAC
+	announce.updateInterfaces()
+	if len(factory.arps) != 2 || len(factory.ndps) != 2 {
+		t.Fatalf("expected the responders to be recreated, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	if diff := cmp.Diff(newMAC, announce.arps["eth0"].HardwareAddr()); diff != "" {
+		t.Errorf("unexpected MAC address (-want +got)\n%s", diff)
+	}
+	var got []string
+	for len(announce.spamCh) > 0 {
+		got = append(got, (<-announce.spamCh).String())
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"1000::1", "192.168.1.20"}, got); diff != "" {
+		t.Errorf("expected the IPs to be announced again (-want +got)\n%s", diff)
+	}
+}
+
+func TestUpdateInterfacesGracePeriod(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	announce.rescanCh = make(chan struct{}, 1)
+	WithResponderGracePeriod(50 * time.Millisecond)(&announce.cfg)
+	lister := announce.lister.(*fakeLister)
+
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+		t.Fatalf("expected responders on eth0, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+
+	// eth0 goes down and comes back within the grace period.
+	lister.ifs[0].Flags &^= net.FlagUp
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+		t.Fatalf("expected the responders of eth0 to be kept, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+	lister.ifs[0].Flags |= net.FlagUp
+	announce.updateInterfaces()
+	if len(factory.arps) != 1 || len(factory.ndps) != 1 {
+		t.Fatalf("expected no new responders, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	if len(announce.missingSince) != 0 {
+		t.Errorf("expected the missing interfaces to be forgotten, got %v", announce.missingSince)
+	}
+	// Drain the rescan requested at the end of the first grace period.
+	<-announce.rescanCh
+
+	// eth0 stays down beyond the grace period, a rescan is requested
+	// when it is over.
+	lister.ifs[0].Flags &^= net.FlagUp
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+		t.Fatalf("expected the responders of eth0 to be kept, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+	select {
+	case <-announce.rescanCh:
+	case <-time.After(time.Second):
+		t.Fatalf("no rescan requested after the grace period")
+	}
+	announce.updateInterfaces()
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("expected the responders of eth0 to be deleted, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+	if !factory.arps[0].closed || !factory.ndps[0].closed {
+		t.Errorf("expected the responders of eth0 to be closed")
+	}
+}
+
+func TestUpdateInterfacesStartupStagger(t *testing.T) {
+	const stagger = 20 * time.Millisecond
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithStartupStagger(stagger)(&announce.cfg)
+	lister := announce.lister.(*fakeLister)
+	addInterface := func(index int) {
+		name := fmt.Sprintf("eth%d", index-1)
+		lister.ifs = append(lister.ifs, net.Interface{
+			Index:        index,
+			Name:         name,
+			Flags:        net.FlagUp | net.FlagBroadcast,
+			HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, byte(index)},
+		})
+		lister.addrs[name] = []net.Addr{mustCIDR(fmt.Sprintf("192.168.%d.2/24", index))}
+	}
+	addInterface(2)
+	addInterface(3)
+
+	announce.updateInterfaces()
+	if len(factory.arps) != 3 || len(factory.ndps) != 1 {
+		t.Fatalf("expected responders on all interfaces, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	// The NDP responder of eth0 is created along with its ARP one.
+	if d := factory.ndps[0].created.Sub(factory.arps[0].created); d >= stagger {
+		t.Errorf("expected the responders of eth0 to be created together, got %s apart", d)
+	}
+	for i := 1; i < len(factory.arps); i++ {
+		if d := factory.arps[i].created.Sub(factory.arps[i-1].created); d < stagger {
+			t.Errorf("expected the responders of %s to be created %s after the previous ones, got %s", factory.arps[i].intf, stagger, d)
+		}
+	}
+
+	// The later scans are not staggered.
+	addInterface(4)
+	addInterface(5)
+	announce.updateInterfaces()
+	if len(factory.arps) != 5 {
+		t.Fatalf("expected responders on the new interfaces, got %d", len(factory.arps))
+	}
+	if d := factory.arps[4].created.Sub(factory.arps[3].created); d >= stagger {
+		t.Errorf("expected the responders of the later scans not to be staggered, got %s apart", d)
+	}
+}
+
+// flakyLister is a fakeLister whose Interfaces fails a number of times
+// before succeeding, recording when it is called.
+type flakyLister struct {
+	*fakeLister
+	mu       sync.Mutex
+	failures int
+	calls    []time.Time
+}
+
+func (f *flakyLister) Interfaces() ([]net.Interface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, time.Now())
+	if len(f.calls) <= f.failures {
+		return nil, errors.New("netlink dump interrupted")
+	}
+	return f.fakeLister.Interfaces()
+}
+
+func (f *flakyLister) callTimes() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Time(nil), f.calls...)
+}
+
+func TestInterfaceScanBackoff(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithScanInterval(time.Minute)(&announce.cfg)
+	announce.rescanCh = make(chan struct{}, 1)
+	lister := &flakyLister{fakeLister: announce.lister.(*fakeLister), failures: 3}
+	announce.lister = lister
+
+	announce.loops.Add(1)
+	go announce.interfaceScan()
+	defer func() {
+		close(announce.done)
+		announce.loops.Wait()
+	}()
+
+	// The retries back off, then the scans settle on the interval.
+	time.Sleep(minScanRetry*7 + 500*time.Millisecond)
+	calls := lister.callTimes()
+	if len(calls) != 4 {
+		t.Fatalf("expected 3 failed scans and a successful one, got %d scans", len(calls))
+	}
+	for i, want := range []time.Duration{minScanRetry, 2 * minScanRetry, 4 * minScanRetry} {
+		if got := calls[i+1].Sub(calls[i]); got < want || got > want+200*time.Millisecond {
+			t.Errorf("expected retry %d after %s, got %s", i+1, want, got)
+		}
+	}
+	announce.RLock()
+	defer announce.RUnlock()
+	if len(announce.arps) != 1 {
+		t.Errorf("expected the responders to be created once the scan succeeds, got %d", len(announce.arps))
+	}
+}
+
+func TestScanRetryDelay(t *testing.T) {
+	for _, test := range []struct {
+		failures int
+		interval time.Duration
+		want     time.Duration
+	}{
+		{0, 10 * time.Second, minScanRetry},
+		{1, 10 * time.Second, 2 * minScanRetry},
+		{3, 10 * time.Second, 8 * minScanRetry},
+		// Persistent failures are retried at the scan interval.
+		{20, 10 * time.Second, 10 * time.Second},
+		{0, minScanRetry / 2, minScanRetry / 2},
+	} {
+		if got := scanRetryDelay(test.failures, test.interval); got != test.want {
+			t.Errorf("scanRetryDelay(%d, %s) = %s, want %s", test.failures, test.interval, got, test.want)
+		}
+	}
+}
+
+func TestUpdateInterfacesPerInterfaceProtocols(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithPerInterfaceProtocols(map[string]ProtocolSet{
+		"eth0": ProtocolARP,
+		"eth1": ProtocolNDP,
+		"eth2": 0,
+	})(&announce.cfg)
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+	lister := announce.lister.(*fakeLister)
+	for i, name := range []string{"eth1", "eth2", "eth3"} {
+		lister.ifs = append(lister.ifs, net.Interface{Index: i + 2, Name: name, Flags: upBroadcast})
+		lister.addrs[name] = []net.Addr{mustCIDR(fmt.Sprintf("192.168.%d.2/24", i+2)), mustCIDR(fmt.Sprintf("fe80::%d/64", i+2))}
+	}
+
+	announce.updateInterfaces()
+	var arps, ndps []string
+	for name := range announce.arps {
+		arps = append(arps, name)
+	}
+	for name := range announce.ndps {
+		ndps = append(ndps, name)
+	}
+	sort.Strings(arps)
+	sort.Strings(ndps)
+	// eth3 isn't listed and gets both responders.
+	if diff := cmp.Diff([]string{"eth0", "eth3"}, arps); diff != "" {
+		t.Errorf("unexpected ARP responders (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"eth1", "eth3"}, ndps); diff != "" {
+		t.Errorf("unexpected NDP responders (-want +got)\n%s", diff)
+	}
+}
+
+func TestUpdateInterfacesDiscovery(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithInterfaceDenylist([]string{"eth2"})(&announce.cfg)
+	upBroadcast := net.FlagUp | net.FlagBroadcast
+	lister := announce.lister.(*fakeLister)
+	for i, name := range []string{"eth1", "eth2", "eth3"} {
+		lister.ifs = append(lister.ifs, net.Interface{Index: i + 2, Name: name, Flags: upBroadcast})
+		lister.addrs[name] = []net.Addr{mustCIDR(fmt.Sprintf("192.168.%d.2/24", i+2))}
+	}
+	// Only eth1 and eth2 are discovered, and eth2 is denied.
+	announce.lister = discoveredInterfaces{
+		interfaceLister: lister,
+		discover: func() ([]net.Interface, error) {
+			return []net.Interface{lister.ifs[1], lister.ifs[2]}, nil
+		},
+	}
+
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || announce.arps["eth1"] == nil {
+		t.Errorf("expected an ARP responder on eth1 only, got %v", announce.arps)
+	}
+	if len(announce.ndps) != 0 {
+		t.Errorf("expected no NDP responder, got %v", announce.ndps)
+	}
+}
+
+func TestUpdateInterfacesMinMTU(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	WithMinInterfaceMTU(1280)(&announce.cfg)
+	lister := announce.lister.(*fakeLister)
+
+	lister.ifs[0].MTU = 1000
+	announce.updateInterfaces()
+	if len(factory.arps) != 0 || len(factory.ndps) != 0 {
+		t.Fatalf("expected no responders below the minimum MTU, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+
+	lister.ifs[0].MTU = 1500
+	announce.updateInterfaces()
+	if len(announce.arps) != 1 || len(announce.ndps) != 1 {
+		t.Fatalf("expected responders above the minimum MTU, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+
+	// The MTU drops below the minimum.
+	lister.ifs[0].MTU = 1000
+	announce.updateInterfaces()
+	if len(announce.arps) != 0 || len(announce.ndps) != 0 {
+		t.Fatalf("expected the responders to be deleted, got %d and %d", len(announce.arps), len(announce.ndps))
+	}
+	if !factory.arps[0].closed || !factory.ndps[0].closed {
+		t.Errorf("expected the responders to be closed")
+	}
+}
+
+func TestUpdateInterfacesAddressChange(t *testing.T) {
+	factory := &fakeFactory{}
+	announce := newFakeAnnounce(factory)
+	lister := announce.lister.(*fakeLister)
+
+	announce.updateInterfaces()
+	if len(factory.arps) != 1 || len(factory.ndps) != 1 {
+		t.Fatalf("expected responders on eth0, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+
+	// Global IPv6 addresses don't matter to the responders.
+	lister.addrs["eth0"] = append(lister.addrs["eth0"], mustCIDR("2001:db8::1/64"))
+	announce.updateInterfaces()
+	if len(factory.arps) != 1 || len(factory.ndps) != 1 {
+		t.Fatalf("expected the responders to be kept, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+
+	// The primary address of eth0 changes.
+	lister.addrs["eth0"] = []net.Addr{mustCIDR("192.168.2.2/24"), mustCIDR("fe80::1/64")}
+	announce.updateInterfaces()
+	if len(factory.arps) != 2 || len(factory.ndps) != 2 {
+		t.Fatalf("expected the responders to be recreated, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+	if !factory.arps[0].closed || !factory.ndps[0].closed {
+		t.Errorf("expected the old responders to be closed")
+	}
+	if announce.arps["eth0"] != factory.arps[1] || announce.ndps["eth0"] != factory.ndps[1] {
+		t.Errorf("expected the new responders to be used")
+	}
+
+	// Nothing changes on the next scan.
+	announce.updateInterfaces()
+	if len(factory.arps) != 2 || len(factory.ndps) != 2 {
+		t.Errorf("expected no new responders, got %d and %d", len(factory.arps), len(factory.ndps))
+	}
+}
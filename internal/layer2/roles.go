@@ -0,0 +1,47 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// interfaceRoleFrontend is the role an interface must have in the role
+// file to get responders.
+const interfaceRoleFrontend = "frontend"
+
+// parseInterfaceRoles returns the role of each interface listed in r.
+func parseInterfaceRoles(r io.Reader) (map[string]string, error) {
+	ret := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed interface role line %q", line)
+		}
+		ret[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// readInterfaceRoles returns the role of each interface listed in the
+// file at path.
+func readInterfaceRoles(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseInterfaceRoles(f)
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseInterfaceRoles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    map[string]string{},
+		},
+		{
+			name:    "roles",
+			content: "# provisioned\neth0 frontend\n\neth1   backend\n  bond0\tfrontend  \n",
+			want: map[string]string{
+				"eth0":  "frontend",
+				"eth1":  "backend",
+				"bond0": "frontend",
+			},
+		},
+		{
+			name:    "malformed",
+			content: "eth0\n",
+			wantErr: true,
+		},
+		{
+			name:    "typo after valid lines",
+			content: "eth0 frontend\neth1 backend frontend\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseInterfaceRoles(strings.NewReader(tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("unexpected roles (-want +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInterfaceRolesFailClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles")
+	announce := &Announce{logger: log.NewNopLogger()}
+	cfg := config{roleFile: path}
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A missing or empty file doesn't restrict the interfaces.
+	if got := announce.interfaceRoles(cfg); got != nil {
+		t.Errorf("expected no restriction without a file, got %v", got)
+	}
+	write("")
+	if got := announce.interfaceRoles(cfg); got != nil {
+		t.Errorf("expected no restriction with an empty file, got %v", got)
+	}
+
+	// A broken file gives no interface a role.
+	write("eth0\n")
+	if diff := cmp.Diff(map[string]string{}, announce.interfaceRoles(cfg)); diff != "" {
+		t.Errorf("unexpected roles for a broken file (-want +got)\n%s", diff)
+	}
+
+	// Once the file was read, a broken file keeps the last roles.
+	write("eth0 frontend\n")
+	want := map[string]string{"eth0": "frontend"}
+	if diff := cmp.Diff(want, announce.interfaceRoles(cfg)); diff != "" {
+		t.Errorf("unexpected roles (-want +got)\n%s", diff)
+	}
+	write("eth0 frontend\neth1 frontend typo\n")
+	if diff := cmp.Diff(want, announce.interfaceRoles(cfg)); diff != "" {
+		t.Errorf("expected the last roles to be kept (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,246 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"net"
+	"time"
+)
+
+// Scheduler decides when gratuitous announcements are sent for the IPs
+// that just got announced. It is only used from a single goroutine, so
+// implementations don't need to be safe for concurrent use.
+type Scheduler interface {
+	// Schedule starts or extends the announcements for ip at now. It
+	// returns true if an announcement should be sent right away.
+	Schedule(ip net.IP, now time.Time) bool
+	// Next returns when Due should be called next, or false if no
+	// announcement is pending.
+	Next() (time.Time, bool)
+	// Due returns the IPs to announce at now, and forgets the IPs that
+	// have been announced enough.
+	Due(now time.Time) []net.IP
+}
+
+const (
+	// defaultSpamWindow is how long an IP keeps being announced after it
+	// was last scheduled.
+	defaultSpamWindow = 5 * time.Second
+	// defaultSpamInterval is the delay between announcements of an IP.
+	// See https://github.com/metallb/metallb/issues/172 for the 1100 choice.
+	defaultSpamInterval = 1100 * time.Millisecond
+)
+
+// SpamPolicy overrides the announcement settings for an IP, see
+// SetBalancerWithPolicy. The zero fields keep the global settings.
+type SpamPolicy struct {
+	// Interval is the delay between announcements.
+	Interval time.Duration
+	// Duration is how long the IP keeps being announced after it was
+	// last scheduled.
+	Duration time.Duration
+	// Burst is the number of packets sent per announcement.
+	Burst int
+}
+
+// NewDefaultScheduler returns the Scheduler used by default: an IP is
+// announced right away, then on every tick of a 1100ms ticker until 5
+// seconds have passed since it was last scheduled.
+func NewDefaultScheduler() Scheduler {
+	return newWindowScheduler(func() (time.Duration, time.Duration) {
+		return defaultSpamWindow, defaultSpamInterval
+	}, nil)
+}
+
+// windowScheduler announces IPs on a shared ticker for a window of time
+// after they were last scheduled. The IPs with a SpamPolicy setting the
+// interval or the window tick on their own instead.
+type windowScheduler struct {
+	// timing returns the window and the ticker interval. It is called on
+	// each use so that they can be changed at runtime.
+	timing func() (window, interval time.Duration)
+	// policy returns the SpamPolicy of an IP, if any. It may be nil.
+	policy func(ip net.IP) (SpamPolicy, bool)
+	// until holds the IPs on the shared ticker, with their spam stop
+	// time.
+	until map[ipKey]scheduledIP
+	// next is the time of the next tick, only meaningful while until is
+	// not empty.
+	next time.Time
+	// own holds the IPs with their own ticker.
+	own map[ipKey]scheduledIP
+	// maxSize returns the maximum number of scheduled IPs, unbounded when
+	// zero. It may be nil.
+	maxSize func() int
+	// completed is called with the IPs forgotten by Due because their
+	// window elapsed. It may be nil.
+	completed func(ip net.IP)
+}
+
+type scheduledIP struct {
+	ip    net.IP
+	until time.Time
+	// next and interval are the ticker of the IPs in own.
+	next     time.Time
+	interval time.Duration
+}
+
+func newWindowScheduler(timing func() (window, interval time.Duration), policy func(ip net.IP) (SpamPolicy, bool)) *windowScheduler {
+	return &windowScheduler{
+		timing: timing,
+		policy: policy,
+		until:  map[ipKey]scheduledIP{},
+		own:    map[ipKey]scheduledIP{},
+	}
+}
+
+func (s *windowScheduler) Schedule(ip net.IP, now time.Time) bool {
+	window, interval := s.timing()
+	k := keyOf(ip)
+	_, shared := s.until[k]
+	owned, ok := s.own[k]
+	// Spam right away to avoid waiting up to a whole interval even if it
+	// means we announce twice in a row in a short amount of time, see
+	// WithMinGratuitousSpacing.
+	first := !shared && !ok
+	if first && s.maxSize != nil {
+		if max := s.maxSize(); max > 0 {
+			for len(s.until)+len(s.own) >= max {
+				s.evictOldest()
+			}
+		}
+	}
+
+	if p, found := s.ownPolicy(ip); found {
+		if p.Duration > 0 {
+			window = p.Duration
+		}
+		if p.Interval > 0 {
+			interval = p.Interval
+		}
+		delete(s.until, k)
+		if !ok {
+			owned.next = now.Add(interval)
+		}
+		s.own[k] = scheduledIP{ip: ip, until: now.Add(window), next: owned.next, interval: interval}
+		return first
+	}
+
+	delete(s.own, k)
+	if len(s.until) == 0 {
+		s.next = now.Add(interval)
+	}
+	s.until[k] = scheduledIP{ip: ip, until: now.Add(window)}
+	return first
+}
+
+// evictOldest forgets the IP scheduled the longest ago.
+func (s *windowScheduler) evictOldest() {
+	var oldest ipKey
+	var until time.Time
+	found := false
+	for _, m := range []map[ipKey]scheduledIP{s.until, s.own} {
+		for k, sched := range m {
+			if !found || sched.until.Before(until) {
+				oldest, until, found = k, sched.until, true
+			}
+		}
+	}
+	// An IP is either on the shared ticker or on its own.
+	delete(s.until, oldest)
+	delete(s.own, oldest)
+	stats.SpamWindowEvicted()
+}
+
+// ownPolicy returns the policy of ip if it sets the interval or the
+// window, so that ip needs a ticker of its own.
+func (s *windowScheduler) ownPolicy(ip net.IP) (SpamPolicy, bool) {
+	if s.policy == nil {
+		return SpamPolicy{}, false
+	}
+	p, ok := s.policy(ip)
+	return p, ok && (p.Interval > 0 || p.Duration > 0)
+}
+
+func (s *windowScheduler) Next() (time.Time, bool) {
+	var next time.Time
+	found := false
+	if len(s.until) > 0 {
+		next, found = s.next, true
+	}
+	for _, sched := range s.own {
+		if !found || sched.next.Before(next) {
+			next, found = sched.next, true
+		}
+	}
+	return next, found
+}
+
+func (s *windowScheduler) Due(now time.Time) []net.IP {
+	var ret []net.IP
+	if len(s.until) > 0 && !now.Before(s.next) {
+		// Like a ticker, skip the ticks we were too late for.
+		_, interval := s.timing()
+		for !s.next.After(now) {
+			s.next = s.next.Add(interval)
+		}
+		for k, sched := range s.until {
+			if now.After(sched.until) {
+				// We have spammed enough - forget the IP.
+				delete(s.until, k)
+				s.complete(sched.ip)
+				continue
+			}
+			ret = append(ret, sched.ip)
+		}
+	}
+	for k, sched := range s.own {
+		if now.Before(sched.next) {
+			continue
+		}
+		for !sched.next.After(now) {
+			sched.next = sched.next.Add(sched.interval)
+		}
+		if now.After(sched.until) {
+			delete(s.own, k)
+			s.complete(sched.ip)
+			continue
+		}
+		s.own[k] = sched
+		ret = append(ret, sched.ip)
+	}
+	return ret
+}
+
+func (s *windowScheduler) complete(ip net.IP) {
+	if s.completed != nil {
+		s.completed(ip)
+	}
+}
+
+// scheduled returns the IPs with announcements pending.
+func (s *windowScheduler) scheduled() []net.IP {
+	ret := make([]net.IP, 0, len(s.until)+len(s.own))
+	for _, m := range []map[ipKey]scheduledIP{s.until, s.own} {
+		for _, sched := range m {
+			ret = append(ret, sched.ip)
+		}
+	}
+	return ret
+}
+
+// cancel forgets ip, and returns whether it had announcements pending.
+func (s *windowScheduler) cancel(ip net.IP) bool {
+	k := keyOf(ip)
+	_, shared := s.until[k]
+	_, own := s.own[k]
+	delete(s.until, k)
+	delete(s.own, k)
+	return shared || own
+}
+
+// clear forgets all the scheduled IPs.
+func (s *windowScheduler) clear() {
+	s.until = map[ipKey]scheduledIP{}
+	s.own = map[ipKey]scheduledIP{}
+}
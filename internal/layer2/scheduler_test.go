@@ -0,0 +1,196 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDefaultScheduler(t *testing.T) {
+	s := NewDefaultScheduler()
+	start := time.Unix(1000, 0)
+	ip1 := net.IPv4(192, 168, 1, 20)
+	ip2 := net.ParseIP("1000::1")
+
+	if _, ok := s.Next(); ok {
+		t.Fatalf("empty scheduler has a next tick")
+	}
+
+	if !s.Schedule(ip1, start) {
+		t.Fatalf("first schedule of an IP should announce right away")
+	}
+	next, ok := s.Next()
+	if !ok || !next.Equal(start.Add(1100*time.Millisecond)) {
+		t.Fatalf("expected next tick at +1100ms, got %v (%v)", next.Sub(start), ok)
+	}
+
+	// Before the tick, nothing is due.
+	if due := s.Due(start.Add(time.Second)); len(due) != 0 {
+		t.Fatalf("expected nothing due before the tick, got %v", due)
+	}
+
+	ticks := map[string]int{}
+	for now := start; now.Before(start.Add(10 * time.Second)); now = now.Add(100 * time.Millisecond) {
+		if now.Equal(start.Add(2 * time.Second)) {
+			// A second IP joins the existing ticker, rescheduling doesn't
+			// announce right away.
+			if !s.Schedule(ip2, now) {
+				t.Fatalf("first schedule of an IP should announce right away")
+			}
+			if s.Schedule(ip1, now) {
+				t.Fatalf("rescheduling an IP shouldn't announce right away")
+			}
+		}
+		for _, ip := range s.Due(now) {
+			ticks[ip.String()]++
+		}
+	}
+	// Both IPs are in their window until +7s, so they are announced on
+	// the ticks at +2.2s, +3.3s, +4.4s, +5.5s and +6.6s, and the first one
+	// on the tick at +1.1s too.
+	want := map[string]int{ip1.String(): 6, ip2.String(): 5}
+	if diff := cmp.Diff(want, ticks); diff != "" {
+		t.Fatalf("unexpected announcements (-want +got)\n%s", diff)
+	}
+
+	if _, ok := s.Next(); ok {
+		t.Fatalf("scheduler still has a next tick after all windows elapsed")
+	}
+}
+
+func TestDefaultSchedulerSkipsLateTicks(t *testing.T) {
+	s := NewDefaultScheduler()
+	start := time.Unix(1000, 0)
+	ips := []net.IP{net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21)}
+	for _, ip := range ips {
+		s.Schedule(ip, start)
+	}
+
+	due := s.Due(start.Add(3 * time.Second))
+	var got []string
+	for _, ip := range due {
+		got = append(got, ip.String())
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"192.168.1.20", "192.168.1.21"}, got); diff != "" {
+		t.Fatalf("unexpected due IPs (-want +got)\n%s", diff)
+	}
+	next, _ := s.Next()
+	if !next.Equal(start.Add(3300 * time.Millisecond)) {
+		t.Fatalf("expected next tick at +3.3s, got %v", next.Sub(start))
+	}
+}
+
+func TestWindowSchedulerCustomWindow(t *testing.T) {
+	window := 3 * time.Second
+	s := newWindowScheduler(func() (time.Duration, time.Duration) {
+		return window, defaultSpamInterval
+	}, nil)
+	start := time.Unix(1000, 0)
+	s.Schedule(net.IPv4(192, 168, 1, 20), start)
+
+	count := 0
+	for now := start; now.Before(start.Add(10 * time.Second)); now = now.Add(100 * time.Millisecond) {
+		count += len(s.Due(now))
+	}
+	// Ticks at +1.1s and +2.2s fall in the 3s window.
+	if count != 2 {
+		t.Fatalf("expected 2 announcements in a 3s window, got %d", count)
+	}
+}
+
+func TestWindowSchedulerJitter(t *testing.T) {
+	interval := 1100 * time.Millisecond
+	s := newWindowScheduler(func() (time.Duration, time.Duration) {
+		return time.Minute, jitter(interval, 0.1)
+	}, nil)
+	now := time.Unix(1000, 0)
+	s.Schedule(net.IPv4(192, 168, 1, 20), now)
+
+	lo, hi := 990*time.Millisecond, 1210*time.Millisecond
+	prev := now
+	for i := 0; i < 20; i++ {
+		next, ok := s.Next()
+		if !ok {
+			t.Fatalf("no next tick")
+		}
+		if d := next.Sub(prev); d < lo || d > hi {
+			t.Fatalf("tick %d after %v, expected within [%v, %v]", i, d, lo, hi)
+		}
+		s.Due(next)
+		prev = next
+	}
+}
+
+func TestWindowSchedulerPolicies(t *testing.T) {
+	fast, slow, plain := net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21), net.IPv4(192, 168, 1, 22)
+	policies := map[string]SpamPolicy{
+		fast.String(): {Interval: 200 * time.Millisecond, Duration: 2 * time.Second},
+		slow.String(): {Interval: 3 * time.Second},
+	}
+	s := newWindowScheduler(func() (time.Duration, time.Duration) {
+		return 5 * time.Second, defaultSpamInterval
+	}, func(ip net.IP) (SpamPolicy, bool) {
+		p, ok := policies[ip.String()]
+		return p, ok
+	})
+	start := time.Unix(1000, 0)
+	for _, ip := range []net.IP{fast, slow, plain} {
+		if !s.Schedule(ip, start) {
+			t.Fatalf("first schedule of %s should announce right away", ip)
+		}
+	}
+	if next, _ := s.Next(); !next.Equal(start.Add(200 * time.Millisecond)) {
+		t.Fatalf("expected next tick at +200ms, got %v", next.Sub(start))
+	}
+
+	ticks := map[string]int{}
+	for now := start; now.Before(start.Add(10 * time.Second)); now = now.Add(100 * time.Millisecond) {
+		for _, ip := range s.Due(now) {
+			ticks[ip.String()]++
+		}
+	}
+	// fast ticks every 200ms for 2s, slow at +3s only within the default
+	// 5s window, and plain on the shared 1100ms ticker.
+	want := map[string]int{fast.String(): 10, slow.String(): 1, plain.String(): 4}
+	if diff := cmp.Diff(want, ticks); diff != "" {
+		t.Fatalf("unexpected announcements (-want +got)\n%s", diff)
+	}
+	if _, ok := s.Next(); ok {
+		t.Fatalf("scheduler still has a next tick after all windows elapsed")
+	}
+}
+
+func TestWindowSchedulerMaxSize(t *testing.T) {
+	s := newWindowScheduler(func() (time.Duration, time.Duration) {
+		return 5 * time.Second, time.Second
+	}, nil)
+	s.maxSize = func() int { return 2 }
+	before := ptu.ToFloat64(stats.spamWindowEvicted)
+
+	start := time.Unix(1000, 0)
+	ips := []net.IP{net.IPv4(192, 168, 1, 20), net.IPv4(192, 168, 1, 21), net.IPv4(192, 168, 1, 22)}
+	for i, ip := range ips {
+		s.Schedule(ip, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	// Rescheduling an IP in the window evicts nothing.
+	s.Schedule(ips[2], start.Add(300*time.Millisecond))
+
+	var got []string
+	for _, ip := range s.Due(start.Add(time.Second)) {
+		got = append(got, ip.String())
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"192.168.1.21", "192.168.1.22"}, got); diff != "" {
+		t.Errorf("expected the oldest IP to be evicted (-want +got)\n%s", diff)
+	}
+	if v := ptu.ToFloat64(stats.spamWindowEvicted); v != before+1 {
+		t.Errorf("expected 1 eviction, got %v", v-before)
+	}
+}
@@ -2,7 +2,12 @@
 
 package layer2
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var stats = metrics{
 	in: prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -31,12 +36,170 @@ var stats = metrics{
 	}, []string{
 		"ip",
 	}),
+
+	healthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "responder_healthy",
+		Help:      "Whether the layer2 responder passed its transmit probe (1) or not (0)",
+	}, []string{
+		"protocol",
+		"interface",
+		// The MAC address identifies the port when interface names are
+		// unstable. It is only a label of the responder lifecycle
+		// metrics, which have a series per responder, not of the per
+		// packet ones.
+		"mac",
+	}),
+
+	dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "requests_dropped",
+		Help:      "Number of layer2 packets received and not responded to, by interface and reason",
+	}, []string{
+		"protocol",
+		"interface",
+		"reason",
+	}),
+
+	announcements: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "gratuitous_announcements",
+		Help:      "Number of successful gratuitous announcements, by protocol and interface",
+	}, []string{
+		"protocol",
+		"interface",
+	}),
+
+	announcementErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "gratuitous_announcement_errors",
+		Help:      "Number of failed gratuitous announcements, by protocol and interface",
+	}, []string{
+		"protocol",
+		"interface",
+	}),
+
+	spamDropped: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "spam_dropped",
+		Help:      "Number of IPs dropped instead of being announced because the spam channel was full",
+	}),
+
+	lastAnnounced: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "last_announced_timestamp_seconds",
+		Help:      "Time of the last successful gratuitous announcement of an owned IP, in seconds since the epoch",
+	}, []string{
+		"ip",
+	}),
+
+	responders: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "responders",
+		Help:      "Number of active layer2 responders, by protocol",
+	}, []string{
+		"protocol",
+	}),
+
+	announcedIPs: prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "announced_ips",
+		Help:      "Number of distinct IPs announced",
+	}),
+
+	responderRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "responder_requests_received",
+		Help:      "Number of ARP requests and neighbor solicitations received, by protocol and interface",
+	}, []string{
+		"protocol",
+		"interface",
+	}),
+
+	responderResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "responder_responses_sent",
+		Help:      "Number of ARP replies and neighbor advertisements sent in response to requests, by protocol and interface",
+	}, []string{
+		"protocol",
+		"interface",
+	}),
+
+	balancerSets: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "balancer_set",
+		Help:      "Number of calls setting the IPs of a service",
+	}),
+
+	balancerDeletes: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "balancer_delete",
+		Help:      "Number of calls deleting a service",
+	}),
+
+	announceAge: newAgeCollector(prometheus.NewDesc(
+		"metallb_layer2_ip_announce_age_seconds",
+		"Time elapsed since the last successful gratuitous announcement of an owned IP",
+		[]string{"ip"}, nil,
+	)),
+
+	spamWindowEvicted: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "spam_window_evicted",
+		Help:      "Number of IPs evicted from the gratuitous announcements because too many IPs were being announced",
+	}),
+
+	lostOwnership: prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "lost_ownership",
+		Help:      "Number of gratuitous announcements skipped because the IP was no longer owned",
+	}),
+
+	conflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "layer2",
+		Name:      "ip_conflicts",
+		Help:      "Number of packets from other hosts claiming owned IPs, by interface",
+	}, []string{
+		"interface",
+	}),
 }
 
 type metrics struct {
 	in         *prometheus.CounterVec
 	out        *prometheus.CounterVec
 	gratuitous *prometheus.CounterVec
+	healthy    *prometheus.GaugeVec
+	dropped    *prometheus.CounterVec
+
+	announcements      *prometheus.CounterVec
+	announcementErrors *prometheus.CounterVec
+	conflicts          *prometheus.CounterVec
+	spamDropped        prometheus.Counter
+	spamWindowEvicted  prometheus.Counter
+	lastAnnounced      *prometheus.GaugeVec
+	announceAge        *ageCollector
+	responders         *prometheus.GaugeVec
+	announcedIPs       prometheus.Gauge
+	lostOwnership      prometheus.Counter
+	responderRequests  *prometheus.CounterVec
+	responderResponses *prometheus.CounterVec
+	balancerSets       prometheus.Counter
+	balancerDeletes    prometheus.Counter
 }
 
 func init() {
@@ -45,6 +208,34 @@ func init() {
 	prometheus.MustRegister(stats.gratuitous)
 }
 
+// RegisterMetrics registers with reg the announcer metrics which are not
+// registered with the default registry on startup.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		stats.healthy,
+		stats.dropped,
+		stats.announcements,
+		stats.announcementErrors,
+		stats.conflicts,
+		stats.spamDropped,
+		stats.spamWindowEvicted,
+		stats.lastAnnounced,
+		stats.announceAge,
+		stats.responders,
+		stats.announcedIPs,
+		stats.lostOwnership,
+		stats.responderRequests,
+		stats.responderResponses,
+		stats.balancerSets,
+		stats.balancerDeletes,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *metrics) GotRequest(addr string) {
 	m.in.WithLabelValues(addr).Add(1)
 }
@@ -56,3 +247,230 @@ func (m *metrics) SentResponse(addr string) {
 func (m *metrics) SentGratuitous(addr string) {
 	m.gratuitous.WithLabelValues(addr).Add(1)
 }
+
+func (m *metrics) GratuitousResult(protocol, intf string, err error) {
+	if err != nil {
+		m.announcementErrors.WithLabelValues(protocol, intf).Add(1)
+		return
+	}
+	m.announcements.WithLabelValues(protocol, intf).Add(1)
+}
+
+func (m *metrics) Dropped(protocol, intf string, reason DropReason) {
+	m.dropped.WithLabelValues(protocol, intf, reason.String()).Add(1)
+}
+
+// DeleteDrops forgets the drop counters of a deleted responder, so that
+// the number of series stays bounded by the number of interfaces.
+func (m *metrics) DeleteDrops(protocol, intf string) {
+	for _, reason := range allDropReasons {
+		m.dropped.DeleteLabelValues(protocol, intf, reason.String())
+	}
+}
+
+func (m *metrics) ResponderHealth(protocol, intf, mac string, healthy bool) {
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	m.healthy.WithLabelValues(protocol, intf, mac).Set(v)
+}
+
+func (m *metrics) ResponderDeleted(protocol, intf, mac string) {
+	m.healthy.DeleteLabelValues(protocol, intf, mac)
+	m.announcements.DeleteLabelValues(protocol, intf)
+	m.announcementErrors.DeleteLabelValues(protocol, intf)
+	m.responderRequests.DeleteLabelValues(protocol, intf)
+	m.responderResponses.DeleteLabelValues(protocol, intf)
+}
+
+// ResponderRequest records a request received by the responder of
+// protocol on intf, whether it is answered or not.
+func (m *metrics) ResponderRequest(protocol, intf string) {
+	m.responderRequests.WithLabelValues(protocol, intf).Add(1)
+}
+
+// ResponderResponse records a response sent by the responder of protocol
+// on intf.
+func (m *metrics) ResponderResponse(protocol, intf string) {
+	m.responderResponses.WithLabelValues(protocol, intf).Add(1)
+}
+
+// Conflict records another host claiming an owned IP on intf. The IP is
+// not a label, the series of the released IPs would be kept forever: it
+// is logged and passed to the handler set with WithConflictHandler.
+func (m *metrics) Conflict(intf string) {
+	m.conflicts.WithLabelValues(intf).Add(1)
+}
+
+// SpamDropped records an IP dropped because the spam channel was full.
+func (m *metrics) SpamDropped() {
+	m.spamDropped.Add(1)
+}
+
+// SpamWindowEvicted records an IP evicted from the announcements by
+// WithMaxSpamWindow.
+func (m *metrics) SpamWindowEvicted() {
+	m.spamWindowEvicted.Add(1)
+}
+
+// LostOwnership records a gratuitous announcement skipped because the IP
+// was released while it was still being announced.
+func (m *metrics) LostOwnership() {
+	m.lostOwnership.Add(1)
+}
+
+// LastAnnounced records that addr was announced at t.
+func (m *metrics) LastAnnounced(addr string, t time.Time) {
+	m.lastAnnounced.WithLabelValues(addr).Set(float64(t.UnixNano()) / 1e9)
+	m.announceAge.set(addr, t)
+}
+
+// DeleteLastAnnounced forgets the last announcement of addr.
+func (m *metrics) DeleteLastAnnounced(addr string) {
+	m.lastAnnounced.DeleteLabelValues(addr)
+	m.announceAge.delete(addr)
+}
+
+// Responders records the number of active responders for protocol.
+func (m *metrics) Responders(protocol string, n int) {
+	m.responders.WithLabelValues(protocol).Set(float64(n))
+}
+
+// BalancerSet records a call setting the IPs of a service. Along with
+// BalancerDeleted, it shows how much the services churn.
+func (m *metrics) BalancerSet() {
+	m.balancerSets.Add(1)
+}
+
+// BalancerDeleted records a call deleting a service.
+func (m *metrics) BalancerDeleted() {
+	m.balancerDeletes.Add(1)
+}
+
+// AnnouncedIPs records the number of distinct announced IPs.
+func (m *metrics) AnnouncedIPs(n int) {
+	m.announcedIPs.Set(float64(n))
+}
+
+// ageCollector exposes, for each IP, the time elapsed since its last
+// announcement. Unlike a gauge, the age is computed when the metrics are
+// collected.
+type ageCollector struct {
+	desc *prometheus.Desc
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newAgeCollector(desc *prometheus.Desc) *ageCollector {
+	return &ageCollector{desc: desc, last: map[string]time.Time{}}
+}
+
+func (c *ageCollector) set(addr string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last[addr] = t
+}
+
+func (c *ageCollector) delete(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.last, addr)
+}
+
+// Describe implements prometheus.Collector.
+func (c *ageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *ageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for addr, t := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(t).Seconds(), addr)
+	}
+}
+
+// ResponderStat is a snapshot of the activity of the layer2 responders
+// running on a single interface.
+type ResponderStat struct {
+	// Healthy is true when the responder passed its transmit probe.
+	Healthy        bool
+	GratuitousSent uint64
+	SendErrors     uint64
+	Watches        uint64
+	Unwatches      uint64
+	LastActivity   time.Time
+}
+
+// responderCounters accumulates the activity of a single responder. It
+// is created along with the responder, so recreating a responder resets
+// its counters.
+type responderCounters struct {
+	sync.Mutex
+	stat ResponderStat
+}
+
+func (c *responderCounters) sentGratuitous(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if err != nil {
+		c.stat.SendErrors++
+	} else {
+		c.stat.GratuitousSent++
+	}
+	c.stat.LastActivity = time.Now()
+}
+
+func (c *responderCounters) probed(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.stat.Healthy = err == nil
+	c.stat.LastActivity = time.Now()
+}
+
+func (c *responderCounters) healthy() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.stat.Healthy
+}
+
+func (c *responderCounters) watched() {
+	c.Lock()
+	defer c.Unlock()
+	c.stat.Watches++
+	c.stat.LastActivity = time.Now()
+}
+
+func (c *responderCounters) unwatched() {
+	c.Lock()
+	defer c.Unlock()
+	c.stat.Unwatches++
+	c.stat.LastActivity = time.Now()
+}
+
+func (c *responderCounters) snapshot() ResponderStat {
+	c.Lock()
+	defer c.Unlock()
+	return c.stat
+}
+
+// merge adds the counters of o to s, keeping the most recent activity.
+// The result is healthy only if both s and o are, an empty s takes the
+// health of o.
+func (s ResponderStat) merge(o ResponderStat) ResponderStat {
+	if s == (ResponderStat{}) {
+		return o
+	}
+	s.Healthy = s.Healthy && o.Healthy
+	s.GratuitousSent += o.GratuitousSent
+	s.SendErrors += o.SendErrors
+	s.Watches += o.Watches
+	s.Unwatches += o.Unwatches
+	if o.LastActivity.After(s.LastActivity) {
+		s.LastActivity = o.LastActivity
+	}
+	return s
+}
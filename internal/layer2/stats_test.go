@@ -0,0 +1,260 @@
+// SPDX-License-Identifier:Apache-2.0
+
+package layer2
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDropStats(t *testing.T) {
+	stats.Dropped("arp", "eth0", DropReasonEthernetDestination)
+	stats.Dropped("arp", "eth0", DropReasonEthernetDestination)
+	stats.Dropped("arp", "eth1", DropReasonAnnounceIP)
+
+	if v := ptu.ToFloat64(stats.dropped.WithLabelValues("arp", "eth0", "ethernet_destination")); v != 2 {
+		t.Fatalf("expected 2 drops on eth0, got %v", v)
+	}
+
+	stats.DeleteDrops("arp", "eth0")
+	if n := ptu.CollectAndCount(stats.dropped); n != 1 {
+		t.Fatalf("expected only eth1 drops after deleting eth0, got %d series", n)
+	}
+	stats.DeleteDrops("arp", "eth1")
+}
+
+func TestGratuitousStats(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := RegisterMetrics(reg); err != nil {
+		t.Fatalf("failed to register metrics: %s", err)
+	}
+	if !reg.Unregister(stats.healthy) || !reg.Unregister(stats.dropped) {
+		t.Errorf("expected the health and drop metrics to be registered with reg")
+	}
+
+	// Forget the announcements made by other tests.
+	stats.ResponderDeleted("arp", "eth0", "")
+
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+
+	announce.gratuitous(ip)
+	announce.gratuitous(ip)
+
+	if v := ptu.ToFloat64(stats.announcements.WithLabelValues("arp", "eth0")); v != 2 {
+		t.Fatalf("expected 2 gratuitous announcements on eth0, got %v", v)
+	}
+	if v := ptu.ToFloat64(stats.announcementErrors.WithLabelValues("arp", "eth0")); v != 0 {
+		t.Fatalf("expected no gratuitous announcement errors on eth0, got %v", v)
+	}
+	stats.ResponderDeleted("arp", "eth0", "")
+}
+
+func TestDropReasonLabels(t *testing.T) {
+	seen := map[string]DropReason{}
+	for _, reason := range allDropReasons {
+		label := reason.String()
+		if strings.HasPrefix(label, "unknown") {
+			t.Errorf("drop reason %d has no label", int(reason))
+		}
+		if other, ok := seen[label]; ok {
+			t.Errorf("drop reasons %d and %d share label %q", int(other), int(reason), label)
+		}
+		seen[label] = reason
+	}
+	if got := DropReasonAnnounceIP.String(); got != "announce_ip" {
+		t.Errorf("unexpected label for DropReasonAnnounceIP: %q", got)
+	}
+}
+
+func TestConflictStats(t *testing.T) {
+	// Forget the conflicts counted by earlier runs.
+	stats.conflicts.DeleteLabelValues("eth0")
+
+	var got []string
+	own := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth1": &fakeResponder{intf: "eth1", mac: own}},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+		cfg: config{
+			conflictHandler: func(ip net.IP, mac net.HardwareAddr, intf string) {
+				got = append(got, ip.String()+" "+mac.String()+" "+intf)
+			},
+		},
+	}
+	ip := net.IPv4(192, 168, 1, 30)
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+
+	announce.conflict(ip, mac, "eth0")
+	if len(got) != 0 {
+		t.Fatalf("expected no conflict for an IP we do not own, got %v", got)
+	}
+
+	announce.SetBalancer("foo", ip)
+	<-announce.spamCh
+	announce.conflict(ip, mac, "eth0")
+	if want := []string{"192.168.1.30 01:02:03:04:05:06 eth0"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected conflicts %v, got %v", want, got)
+	}
+	if v := ptu.ToFloat64(stats.conflicts.WithLabelValues("eth0")); v != 1 {
+		t.Errorf("expected 1 conflict on eth0, got %v", v)
+	}
+
+	// Our other interfaces on the same segment are not in conflict.
+	announce.conflict(ip, own, "eth0")
+	if len(got) != 1 {
+		t.Errorf("expected no conflict with the MAC of eth1, got %v", got)
+	}
+	if v := ptu.ToFloat64(stats.conflicts.WithLabelValues("eth0")); v != 1 {
+		t.Errorf("expected still 1 conflict on eth0, got %v", v)
+	}
+}
+
+func TestAnnouncedIPsStats(t *testing.T) {
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 3),
+	}
+	announce.SetBalancerIPs("foo", []net.IP{net.IPv4(192, 168, 1, 20), net.ParseIP("1000::1")})
+	announce.SetBalancer("bar", net.IPv4(192, 168, 1, 20))
+	if v := ptu.ToFloat64(stats.announcedIPs); v != 2 {
+		t.Errorf("expected 2 announced IPs, got %v", v)
+	}
+	announce.DeleteBalancer("foo")
+	if v := ptu.ToFloat64(stats.announcedIPs); v != 1 {
+		t.Errorf("expected 1 announced IP, got %v", v)
+	}
+
+	// Extra deletes don't move the gauge.
+	announce.DeleteBalancerIP("bar", net.IPv4(192, 168, 1, 20))
+	announce.releaseIP("bar", net.IPv4(192, 168, 1, 20))
+	announce.LoadState(map[string][]net.IP{"baz": {net.IPv4(192, 168, 1, 21), net.IPv4(192, 168, 1, 22)}})
+	if v := ptu.ToFloat64(stats.announcedIPs); v != 2 {
+		t.Errorf("expected 2 announced IPs, got %v", v)
+	}
+}
+
+func TestLostOwnershipStats(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 40)
+	announce.SetBalancer("foo", ip)
+
+	// The IP is released while it is still in the spam window.
+	announce.DeleteBalancer("foo")
+	before := ptu.ToFloat64(stats.lostOwnership)
+	announce.gratuitous(<-announce.spamCh)
+	if v := ptu.ToFloat64(stats.lostOwnership); v != before+1 {
+		t.Errorf("expected the lost ownership counter to be incremented, got %v after %v", v, before)
+	}
+	if arp.gratuitousCount() != 0 {
+		t.Errorf("expected no announcement of a released IP, got %d", arp.gratuitousCount())
+	}
+}
+
+func TestBalancerChurnStats(t *testing.T) {
+	announce := &Announce{
+		logger:    log.NewNopLogger(),
+		ips:       map[string][]net.IP{},
+		ipRefcnt:  map[ipKey]int{},
+		svcIfaces: map[string]map[string]bool{},
+		spamCh:    make(chan net.IP, 10),
+	}
+	sets, deletes := ptu.ToFloat64(stats.balancerSets), ptu.ToFloat64(stats.balancerDeletes)
+
+	for i := 0; i < 3; i++ {
+		announce.SetBalancer("foo", net.IPv4(192, 168, 1, 20))
+		announce.SetBalancerIPs("bar", []net.IP{net.IPv4(192, 168, 1, 21), net.ParseIP("1000::1")})
+		announce.DeleteBalancer("foo")
+	}
+	if v := ptu.ToFloat64(stats.balancerSets) - sets; v != 6 {
+		t.Errorf("expected 6 sets, got %v", v)
+	}
+	if v := ptu.ToFloat64(stats.balancerDeletes) - deletes; v != 3 {
+		t.Errorf("expected 3 deletes, got %v", v)
+	}
+	if v := ptu.ToFloat64(stats.announcedIPs); v != 2 {
+		t.Errorf("expected 2 announced IPs, got %v", v)
+	}
+}
+
+func TestAnnounceAgeStats(t *testing.T) {
+	arp := &fakeResponder{intf: "eth0"}
+	announce := &Announce{
+		logger:   log.NewNopLogger(),
+		arps:     map[string]responder{"eth0": arp},
+		ndps:     map[string]watchingResponder{},
+		ips:      map[string][]net.IP{},
+		ipRefcnt: map[ipKey]int{},
+		spamCh:   make(chan net.IP, 1),
+	}
+	ip := net.IPv4(192, 168, 1, 50)
+	announce.SetBalancer("foo", ip)
+	// age returns the announce age of ip, or false if it is not
+	// exported.
+	age := func() (float64, bool) {
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(stats.announceAge)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("failed to gather metrics: %s", err)
+		}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				if m.GetLabel()[0].GetValue() == ip.String() {
+					return m.GetGauge().GetValue(), true
+				}
+			}
+		}
+		return 0, false
+	}
+
+	if _, ok := age(); ok {
+		t.Fatalf("expected no announce age before the first announcement")
+	}
+	announce.gratuitous(ip)
+	v, ok := age()
+	if !ok {
+		t.Fatalf("expected the announce age to be exported after an announcement")
+	}
+	if v < 0 || v > 60 {
+		t.Errorf("expected a fresh announcement, got an age of %vs", v)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if later, _ := age(); later <= v {
+		t.Errorf("expected the age to grow, got %v then %v", v, later)
+	}
+
+	announce.DeleteBalancer("foo")
+	if _, ok := age(); ok {
+		t.Errorf("expected the announce age to be deleted with the IP")
+	}
+}
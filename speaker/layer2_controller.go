@@ -135,7 +135,9 @@ func (c *layer2Controller) ShouldAnnounce(l log.Logger, name string, toAnnounce
 
 func (c *layer2Controller) SetBalancer(l log.Logger, name string, lbIPs []net.IP, pool *config.Pool) error {
 	for _, lbIP := range lbIPs {
-		c.announcer.SetBalancer(name, lbIP)
+		if err := c.announcer.SetBalancerE(name, lbIP); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -60,6 +60,10 @@ type service interface {
 
 func main() {
 	prometheus.MustRegister(announcing)
+	if err := layer2.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		fmt.Printf("failed to register layer2 metrics: %s\n", err)
+		os.Exit(1)
+	}
 
 	var (
 		namespace       = flag.String("namespace", os.Getenv("METALLB_NAMESPACE"), "config file and speakers namespace")